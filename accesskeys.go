@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	accessKeyHeader = "X-Proxy-Key"
+	// Ключ в пути: /~<key>/method/users.get. Так его можно указать вместе с доменом в приложениях, где настраивается
+	// только адрес прокси.
+	accessKeyPrefix = "/~"
+)
+
+var (
+	accessKeyPrefixBytes = []byte(accessKeyPrefix)
+	apiMethodPrefix      = []byte("/method/")
+
+	accessDeniedBody = []byte(`{"error":{"error_code":5,"error_msg":"User authorization failed: invalid proxy access key","request_params":[]}}`)
+)
+
+type accessKey struct {
+	key  string
+	name string
+
+	requests atomic.Uint64
+	bytes    atomic.Uint64
+	lastUsed atomic.Int64
+}
+
+func (k *accessKey) track(size int) {
+	k.requests.Add(1)
+	k.bytes.Add(uint64(size))
+	k.lastUsed.Store(time.Now().Unix())
+}
+
+// Ключи доступа из файла -access-keys. Файл перечитывается по SIGHUP, удаленный из файла ключ сразу перестает
+// работать.
+type accessKeys struct {
+	file string
+	keys map[string]*accessKey
+	// В том же порядке, что и в файле
+	list []*accessKey
+}
+
+// Формат файла: одна строка - один ключ, через пробел можно указать имя для статистики. Строки с # пропускаются.
+// Статистика ключей, которые есть в old, сохраняется.
+func loadAccessKeys(file string, old *accessKeys) (*accessKeys, error) {
+	if file == "" {
+		return nil, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result := &accessKeys{file: file, keys: make(map[string]*accessKey)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		key := fields[0]
+		if strings.ContainsAny(key, "/?%#") {
+			return nil, fmt.Errorf("%s:%d: access key can not contain '/', '?', '%%' or '#'", file, line)
+		}
+		if result.keys[key] != nil {
+			return nil, fmt.Errorf("%s:%d: duplicate access key", file, line)
+		}
+		name := key
+		if len(fields) > 1 {
+			name = fields[1]
+		} else if len(name) > 4 {
+			// Ключ целиком в статистике и логах не показывается
+			name = name[:4] + "..."
+		}
+		var k *accessKey
+		if old != nil {
+			k = old.keys[key]
+		}
+		if k == nil {
+			k = &accessKey{key: key}
+		}
+		k.name = name
+		result.keys[key] = k
+		result.list = append(result.list, k)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(result.list) == 0 {
+		return nil, fmt.Errorf("%s: no access keys", file)
+	}
+	return result, nil
+}
+
+func (k *accessKeys) getFile() string {
+	if k == nil {
+		return ""
+	}
+	return k.file
+}
+
+// Проверяет ключ из заголовка или из начала пути и убирает его из запроса. Возвращает nil, если ключа нет или он
+// неверный.
+func (k *accessKeys) authenticate(ctx *fasthttp.RequestCtx) *accessKey {
+	if header := ctx.Request.Header.Peek(accessKeyHeader); header != nil {
+		key := k.keys[string(header)]
+		ctx.Request.Header.Del(accessKeyHeader)
+		return key
+	}
+	uri := ctx.RequestURI()
+	if !bytes.HasPrefix(uri, accessKeyPrefixBytes) {
+		return nil
+	}
+	end := bytes.IndexByte(uri[len(accessKeyPrefix):], '/')
+	if end == -1 {
+		return nil
+	}
+	end += len(accessKeyPrefix)
+	key := k.keys[string(uri[len(accessKeyPrefix):end])]
+	if key != nil {
+		ctx.Request.SetRequestURI(string(uri[end:]))
+	}
+	return key
+}
+
+// VKUI на статик домене загружает ресурсы по абсолютным путям, в которые ключ не вставить, поэтому запросы без
+// ключа, которые уйдут на маршрут static, его не проверяют. /@, /_/ и Proxy-Host на любом домене ведут на другие
+// маршруты и требуют ключ, проверка повторяет выбор маршрута в prepareProxyRequest.
+func isStaticAssetRequest(ctx *fasthttp.RequestCtx, state *proxyState) bool {
+	if string(ctx.Host()) != state.config.BaseStaticDomain || state.routes.staticRoute == nil {
+		return false
+	}
+	uri := ctx.RequestURI()
+	return !bytes.HasPrefix(uri, passThroughPrefixBytes) && !bytes.HasPrefix(uri, endpointPrefix) &&
+		!bytes.HasPrefix(uri, accessKeyPrefixBytes) && ctx.Request.Header.Peek("Proxy-Host") == nil &&
+		ctx.Request.Header.Peek(accessKeyHeader) == nil
+}
+
+// Путь, который нужно добавлять к ссылкам на прокси, чтобы запросы по ним тоже проходили проверку
+func (k *accessKey) pathPrefix() string {
+	if k == nil {
+		return ""
+	}
+	return accessKeyPrefix + k.key
+}
+
+func accessDenied(ctx *fasthttp.RequestCtx) {
+	ctx.Response.Reset()
+	// Ошибку апи приложение покажет пользователю, остальным клиентам нужен нормальный код ответа
+	if !bytes.Contains(ctx.Path(), apiMethodPrefix) {
+		ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+	}
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.SetBody(accessDeniedBody)
+}
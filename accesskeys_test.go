@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestAccessKeyOnStaticDomain(t *testing.T) {
+	_, client := newTestProxy(t, ProxyConfig{
+		BaseDomain:       "proxy.test",
+		BaseStaticDomain: "static.proxy.test",
+		AccessKeysFile:   writeTestFile(t, "keys.txt", "secret-key test\n"),
+	}, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString(string(ctx.Host()) + string(ctx.Path()))
+	})
+
+	withKey := func(req *fasthttp.Request) {
+		req.Header.Set(accessKeyHeader, "secret-key")
+	}
+	proxyHost := func(req *fasthttp.Request) {
+		req.Header.Set("Proxy-Host", "files.test")
+	}
+	for _, c := range []struct {
+		uri      string
+		prepare  func(req *fasthttp.Request)
+		expected string
+	}{
+		// Только ресурсы VKUI на статик домене доступны без ключа
+		{"http://static.proxy.test/vkui.js", nil, "static.test/vkui.js"},
+		{"http://static.proxy.test/@files.test/a", nil, ""},
+		{"http://static.proxy.test/_/sun9-1.userapi.com/a", nil, ""},
+		{"http://static.proxy.test/a", proxyHost, ""},
+		{"http://proxy.test/a", nil, ""},
+		{"http://static.proxy.test/@files.test/a", withKey, "files.test/a"},
+		{"http://static.proxy.test/~secret-key/@files.test/a", nil, "files.test/a"},
+		{"http://static.proxy.test/a", func(req *fasthttp.Request) {
+			proxyHost(req)
+			withKey(req)
+		}, "files.test/a"},
+		{"http://proxy.test/~secret-key/a", nil, "files.test/a"},
+		{"http://static.proxy.test/~secret-key/vkui.js", nil, "static.test/vkui.js"},
+		{"http://static.proxy.test/~wrong-key/vkui.js", nil, ""},
+	} {
+		res := doTestRequest(t, client, c.uri, c.prepare)
+		if c.expected == "" {
+			if res.StatusCode() != fasthttp.StatusUnauthorized {
+				t.Errorf("%s without key got %d %q, expected access denied", c.uri, res.StatusCode(), res.Body())
+			}
+		} else if string(res.Body()) != c.expected {
+			t.Errorf("%s got %d %q, expected %q", c.uri, res.StatusCode(), res.Body(), c.expected)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/phuslu/iploc"
+	"github.com/valyala/bytebufferpool"
+)
+
+const (
+	accessLogFormatJson   = "json"
+	accessLogFormatLogfmt = "logfmt"
+)
+
+type AccessLogConfig struct {
+	// Путь к файлу лога, пустая строка - лог выключен
+	File   string
+	Format string
+	// Поля через запятую, пустая строка - все поля
+	Fields string
+	// Файл переименовывается и начинается заново, когда превышает MaxSize или старше MaxAge. Ноль - без ограничения.
+	MaxSize byteSize
+	MaxAge  time.Duration
+	// Сколько старых файлов хранить, 0 - все
+	MaxBackups int
+}
+
+// Запись лога запросов. Заполняется по ходу обработки запроса, пишется в конце.
+type accessLogEntry struct {
+	start      time.Time
+	clientIp   string
+	key        string
+	method     string
+	host       string
+	path       string
+	upstream   string
+	apiMethod  string
+	limitClass string
+	status     int
+	cache      string
+	err        string
+	rules      []string
+	// Режим -log-redact на момент запроса
+	redact string
+	// Запись обмена с апстримом для -record-dir, nil если запись выключена
+	exchange *exchange
+
+	// Размер тела от апстрима после распаковки, то есть до замен, и размер отданного клиенту
+	bytesBefore int
+	bytesAfter  int
+
+	duration     time.Duration
+	upstreamTime time.Duration
+	gunzipTime   time.Duration
+	replaceTime  time.Duration
+}
+
+var accessLogEntryPool = sync.Pool{New: func() interface{} {
+	return &accessLogEntry{}
+}}
+
+func (e *accessLogEntry) reset() {
+	rules := e.rules[:0]
+	*e = accessLogEntry{}
+	e.rules = rules
+}
+
+type accessLogField struct {
+	name string
+	// Числа пишутся без кавычек
+	number bool
+	value  func(e *accessLogEntry) string
+}
+
+var accessLogFields = []accessLogField{
+	{"time", false, func(e *accessLogEntry) string { return e.start.Format("2006-01-02T15:04:05.000Z07:00") }},
+	{"client_ip", false, func(e *accessLogEntry) string { return e.clientIp }},
+	{"country", false, func(e *accessLogEntry) string {
+		ip := parseIP([]byte(e.clientIp))
+		if ip == nil {
+			return ""
+		}
+		return string(iploc.Country(ip))
+	}},
+	{"key", false, func(e *accessLogEntry) string { return e.key }},
+	{"method", false, func(e *accessLogEntry) string { return e.method }},
+	{"host", false, func(e *accessLogEntry) string { return e.host }},
+	{"path", false, func(e *accessLogEntry) string { return string(redactPath(e.redact, []byte(e.path))) }},
+	{"upstream", false, func(e *accessLogEntry) string { return e.upstream }},
+	{"api_method", false, func(e *accessLogEntry) string { return e.apiMethod }},
+	{"class", false, func(e *accessLogEntry) string { return e.limitClass }},
+	{"status", true, func(e *accessLogEntry) string { return strconv.Itoa(e.status) }},
+	{"cache", false, func(e *accessLogEntry) string { return e.cache }},
+	{"bytes_before", true, func(e *accessLogEntry) string { return strconv.Itoa(e.bytesBefore) }},
+	{"bytes_after", true, func(e *accessLogEntry) string { return strconv.Itoa(e.bytesAfter) }},
+	{"duration_ms", true, func(e *accessLogEntry) string { return formatMillis(e.duration) }},
+	{"upstream_ms", true, func(e *accessLogEntry) string { return formatMillis(e.upstreamTime) }},
+	{"gunzip_ms", true, func(e *accessLogEntry) string { return formatMillis(e.gunzipTime) }},
+	{"replace_ms", true, func(e *accessLogEntry) string { return formatMillis(e.replaceTime) }},
+	{"rules", false, func(e *accessLogEntry) string { return strings.Join(e.rules, ",") }},
+	{"error", false, func(e *accessLogEntry) string { return e.err }},
+}
+
+func accessLogFieldNames() string {
+	names := make([]string, len(accessLogFields))
+	for i, field := range accessLogFields {
+		names[i] = field.name
+	}
+	return strings.Join(names, ",")
+}
+
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+type accessLog struct {
+	json   bool
+	fields []accessLogField
+	out    *rotatingFile
+}
+
+func newAccessLog(config AccessLogConfig) (*accessLog, error) {
+	l := &accessLog{}
+	switch config.Format {
+	case accessLogFormatJson:
+		l.json = true
+	case accessLogFormatLogfmt:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q, expected json or logfmt", config.Format)
+	}
+	if config.Fields == "" {
+		l.fields = accessLogFields
+	} else {
+		for _, name := range strings.Split(config.Fields, ",") {
+			name = strings.TrimSpace(name)
+			found := false
+			for _, field := range accessLogFields {
+				if field.name == name {
+					l.fields = append(l.fields, field)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unknown access log field %q", name)
+			}
+		}
+	}
+	var err error
+	l.out, err = openRotatingFile(config.File, int64(config.MaxSize), config.MaxAge, config.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Пустые строковые поля пропускаются
+func (l *accessLog) write(e *accessLogEntry) {
+	buf := bytebufferpool.Get()
+	if l.json {
+		buf.B = append(buf.B, '{')
+	}
+	first := true
+	for _, field := range l.fields {
+		value := field.value(e)
+		if value == "" {
+			continue
+		}
+		if !first {
+			if l.json {
+				buf.B = append(buf.B, ',')
+			} else {
+				buf.B = append(buf.B, ' ')
+			}
+		}
+		first = false
+		if l.json {
+			buf.B = appendJsonString(buf.B, field.name)
+			buf.B = append(buf.B, ':')
+			if field.number {
+				buf.B = append(buf.B, value...)
+			} else {
+				buf.B = appendJsonString(buf.B, value)
+			}
+		} else {
+			buf.B = append(buf.B, field.name...)
+			buf.B = append(buf.B, '=')
+			if field.number || !needsLogfmtQuote(value) {
+				buf.B = append(buf.B, value...)
+			} else {
+				buf.B = strconv.AppendQuote(buf.B, value)
+			}
+		}
+	}
+	if l.json {
+		buf.B = append(buf.B, '}')
+	}
+	buf.B = append(buf.B, '\n')
+	if err := l.out.write(buf.B); err != nil {
+		log.Printf("Could not write access log: %s", err)
+	}
+	bytebufferpool.Put(buf)
+}
+
+// Дописывает в запись то, что известно только после ответа, и пишет ее в лог, если он включен
+func (p *Proxy) finishAccessLog(e *accessLogEntry, status int) {
+	if p.accessLog != nil {
+		e.status = status
+		e.duration = time.Since(e.start)
+		p.accessLog.write(e)
+	}
+	e.reset()
+	accessLogEntryPool.Put(e)
+}
+
+func (l *accessLog) close() error {
+	return l.out.close()
+}
+
+func needsLogfmtQuote(s string) bool {
+	for _, c := range s {
+		if c <= ' ' || c == '"' || c == '=' || c == '\\' || c >= utf8.RuneSelf {
+			return true
+		}
+	}
+	return false
+}
+
+func appendJsonString(dst []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	dst = append(dst, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			dst = append(dst, '\\', c)
+		case c == '\n':
+			dst = append(dst, '\\', 'n')
+		case c == '\r':
+			dst = append(dst, '\\', 'r')
+		case c == '\t':
+			dst = append(dst, '\\', 't')
+		case c < ' ':
+			dst = append(dst, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return append(dst, '"')
+}
+
+// Формат времени ротации в именах старых файлов
+const rotatedFileTimeFormat = "20060102-150405.000"
+
+// Файл с ротацией по размеру и времени. Старый файл переименовывается в <file>.<время ротации>.
+type rotatingFile struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	// nil, если новый файл не удалось открыть при ротации: тогда он открывается заново при следующей записи
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	// Время начала файла, от него считается maxAge
+	opened time.Time
+	closed bool
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	// Запись буферизуется, поэтому сбрасывается на диск раз в секунду
+	go func() {
+		for range time.Tick(time.Second) {
+			f.lock.Lock()
+			if f.closed {
+				f.lock.Unlock()
+				return
+			}
+			if f.file != nil {
+				f.writer.Flush()
+			}
+			f.lock.Unlock()
+		}
+	}()
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.writer = bufio.NewWriterSize(file, 64*1024)
+	f.size = info.Size()
+	f.opened = time.Now()
+	if f.size > 0 {
+		f.opened = f.startTime(info.ModTime())
+	}
+	return nil
+}
+
+// Время начала уже существующего файла: время последней ротации из имени старого файла, а если старых файлов
+// нет -- время изменения. Иначе после каждого перезапуска maxAge отсчитывался бы заново.
+func (f *rotatingFile) startTime(modTime time.Time) time.Time {
+	backups, _ := filepath.Glob(f.path + ".*")
+	sort.Strings(backups)
+	for i := len(backups) - 1; i >= 0; i-- {
+		rotated, err := time.ParseInLocation(rotatedFileTimeFormat, backups[i][len(f.path)+1:], time.Local)
+		if err == nil && rotated.Before(modTime) {
+			return rotated
+		}
+	}
+	return modTime
+}
+
+func (f *rotatingFile) write(line []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	if f.maxSize > 0 && f.size+int64(len(line)) > f.maxSize && f.size > 0 ||
+		f.maxAge > 0 && time.Since(f.opened) > f.maxAge {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.writer.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+func (f *rotatingFile) rotate() error {
+	f.writer.Flush()
+	f.file.Close()
+	f.file = nil
+	backup := f.path + "." + time.Now().Format(rotatedFileTimeFormat)
+	if err := os.Rename(f.path, backup); err != nil {
+		log.Printf("Could not rotate %s: %s", f.path, err)
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	if f.maxBackups > 0 {
+		f.removeOldBackups()
+	}
+	return nil
+}
+
+// Имена старых файлов отличаются временем ротации, поэтому сортируются по времени
+func (f *rotatingFile) removeOldBackups() {
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil || len(backups) <= f.maxBackups {
+		return
+	}
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-f.maxBackups] {
+		if err := os.Remove(backup); err != nil {
+			log.Printf("Could not remove old log %s: %s", backup, err)
+		}
+	}
+}
+
+func (f *rotatingFile) close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	f.writer.Flush()
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
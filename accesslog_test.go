@@ -0,0 +1,263 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAccessLogEntry() *accessLogEntry {
+	return &accessLogEntry{
+		start:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		clientIp: "127.0.0.1",
+		method:   "GET",
+		host:     "api.vk.com",
+		path:     `/method/users.get?q=a "b"`,
+		status:   200,
+		duration: 1500 * time.Microsecond,
+		rules:    []string{"a", "b"},
+	}
+}
+
+func readAccessLog(t *testing.T, l *accessLog) string {
+	t.Helper()
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(l.out.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	for _, c := range []struct {
+		format, fields, expected string
+	}{
+		{accessLogFormatJson, "time,method,path,status,duration_ms,rules,error",
+			`{"time":"2024-01-02T03:04:05.000Z","method":"GET","path":"/method/users.get?q=a \"b\"","status":200,` +
+				`"duration_ms":1.500,"rules":"a,b"}` + "\n"},
+		{accessLogFormatLogfmt, "time,method,path,status,duration_ms,rules,error",
+			`time=2024-01-02T03:04:05.000Z method=GET path="/method/users.get?q=a \"b\"" status=200 duration_ms=1.500 ` +
+				"rules=a,b\n"},
+		// Порядок полей задается списком
+		{accessLogFormatLogfmt, " status , host", "status=200 host=api.vk.com\n"},
+	} {
+		l, err := newAccessLog(AccessLogConfig{
+			File:   filepath.Join(t.TempDir(), "access.log"),
+			Format: c.format,
+			Fields: c.fields,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.write(testAccessLogEntry())
+		if got := readAccessLog(t, l); got != c.expected {
+			t.Errorf("%s %q:\ngot      %s\nexpected %s", c.format, c.fields, got, c.expected)
+		}
+	}
+
+	// Без списка пишутся все поля
+	l, err := newAccessLog(AccessLogConfig{File: filepath.Join(t.TempDir(), "access.log"), Format: accessLogFormatJson})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.write(testAccessLogEntry())
+	got := readAccessLog(t, l)
+	for _, field := range []string{"time", "client_ip", "method", "host", "path", "status", "bytes_before",
+		"bytes_after", "duration_ms", "upstream_ms", "gunzip_ms", "replace_ms", "rules"} {
+		if !strings.Contains(got, `"`+field+`":`) {
+			t.Errorf("no %s in %s", field, got)
+		}
+	}
+}
+
+func TestAccessLogConfigErrors(t *testing.T) {
+	for _, c := range []struct {
+		config AccessLogConfig
+		err    string
+	}{
+		{AccessLogConfig{Format: "xml"}, `unknown access log format "xml"`},
+		{AccessLogConfig{Format: accessLogFormatJson, Fields: "time,size"}, `unknown access log field "size"`},
+		{AccessLogConfig{Format: accessLogFormatJson, Fields: "time,"}, `unknown access log field ""`},
+		{AccessLogConfig{File: t.TempDir(), Format: accessLogFormatJson}, "is a directory"},
+	} {
+		if _, err := newAccessLog(c.config); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%+v: got error %v, expected %q", c.config, err, c.err)
+		}
+	}
+}
+
+func backupFiles(t *testing.T, path string) []string {
+	t.Helper()
+	backups, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backups
+}
+
+func TestRotatingFileSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, 10, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+	line := []byte("12345678\n")
+	for i := 0; i < 3; i++ {
+		if err = f.write(line); err != nil {
+			t.Fatal(err)
+		}
+		// Имена старых файлов различаются по миллисекундам
+		time.Sleep(2 * time.Millisecond)
+	}
+	f.close()
+	// Строка, которая не помещается в файл, начинает новый
+	if backups := backupFiles(t, path); len(backups) != 2 {
+		t.Errorf("backups %v, expected 2", backups)
+	}
+	for _, file := range append(backupFiles(t, path), path) {
+		if data, _ := os.ReadFile(file); string(data) != string(line) {
+			t.Errorf("%s contains %q", file, data)
+		}
+	}
+
+	// Строка больше maxSize пишется в пустой файл целиком
+	path = filepath.Join(t.TempDir(), "access.log")
+	f, err = openRotatingFile(path, 4, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.write(line)
+	f.close()
+	if backups := backupFiles(t, path); len(backups) != 0 {
+		t.Errorf("rotated empty file: %v", backups)
+	}
+}
+
+func TestRotatingFileAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, 0, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.write([]byte("first\n"))
+	f.write([]byte("second\n"))
+	if backups := backupFiles(t, path); len(backups) != 0 {
+		t.Errorf("rotated a new file: %v", backups)
+	}
+	f.opened = f.opened.Add(-2 * time.Hour)
+	f.write([]byte("third\n"))
+	f.close()
+	backups := backupFiles(t, path)
+	if len(backups) != 1 {
+		t.Fatalf("backups %v, expected 1", backups)
+	}
+	if data, _ := os.ReadFile(backups[0]); string(data) != "first\nsecond\n" {
+		t.Errorf("rotated file contains %q", data)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "third\n" {
+		t.Errorf("new file contains %q", data)
+	}
+}
+
+// После перезапуска возраст файла считается от последней ротации, а не от открытия
+func TestRotatingFileAgeAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rotated := time.Now().Add(-2 * time.Hour)
+	if err := os.WriteFile(path+"."+rotated.Format(rotatedFileTimeFormat), []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("before restart\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := openRotatingFile(path, 0, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := f.opened.Sub(rotated); d < -time.Millisecond || d > time.Millisecond {
+		t.Errorf("file started at %v, expected %v", f.opened, rotated)
+	}
+	f.write([]byte("after restart\n"))
+	f.close()
+	if data, _ := os.ReadFile(path); string(data) != "after restart\n" {
+		t.Errorf("file was not rotated on first write, contains %q", data)
+	}
+
+	// Без старых файлов возраст считается от последнего изменения
+	path = filepath.Join(t.TempDir(), "access.log")
+	if err = os.WriteFile(path, []byte("before restart\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(path, rotated, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = openRotatingFile(path, 0, time.Hour, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.close()
+	if !f.opened.Equal(rotated) {
+		t.Errorf("file started at %v, expected %v", f.opened, rotated)
+	}
+}
+
+func TestRotatingFileBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, 1, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"1\n", "2\n", "3\n", "4\n", "5\n"} {
+		f.write([]byte(line))
+		time.Sleep(2 * time.Millisecond)
+	}
+	f.close()
+	// Остаются самые новые
+	backups := backupFiles(t, path)
+	if len(backups) != 2 {
+		t.Fatalf("backups %v, expected 2", backups)
+	}
+	for i, expected := range []string{"3\n", "4\n"} {
+		if data, _ := os.ReadFile(backups[i]); string(data) != expected {
+			t.Errorf("%s contains %q, expected %q", backups[i], data, expected)
+		}
+	}
+}
+
+// Если новый файл не открылся при ротации, он открывается при следующей записи
+func TestRotatingFileReopen(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "access.log")
+	f, err := openRotatingFile(path, 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+	f.write([]byte("1\n"))
+	if err = os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.write([]byte("lost\n")); err == nil {
+		t.Fatal("write without directory succeeded")
+	}
+	if err = os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.write([]byte("2\n")); err != nil {
+		t.Fatal(err)
+	}
+	f.close()
+	if data, _ := os.ReadFile(path); string(data) != "2\n" {
+		t.Errorf("reopened file contains %q", data)
+	}
+	if err = f.write([]byte("3\n")); err != os.ErrClosed {
+		t.Errorf("write after close: %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/xtrafrancyz/vk-proxy/replacer"
+)
+
+const adminTokenHeader = "X-Admin-Token"
+
+// Открытые соединения клиентов для админки. Заполняется через ConnState сервера, см. Proxy.trackConnState.
+type connRegistry struct {
+	lock  sync.Mutex
+	conns map[net.Conn]*connInfo
+}
+
+type connInfo struct {
+	opened time.Time
+	state  fasthttp.ConnState
+}
+
+func (r *connRegistry) track(conn net.Conn, state fasthttp.ConnState) {
+	r.lock.Lock()
+	switch state {
+	case fasthttp.StateNew:
+		r.conns[conn] = &connInfo{opened: time.Now(), state: state}
+	case fasthttp.StateClosed, fasthttp.StateHijacked:
+		delete(r.conns, conn)
+	default:
+		if info := r.conns[conn]; info != nil {
+			info.state = state
+		}
+	}
+	r.lock.Unlock()
+}
+
+type adminConn struct {
+	Remote string `json:"remote"`
+	Local  string `json:"local"`
+	State  string `json:"state"`
+	Age    string `json:"age"`
+}
+
+func (r *connRegistry) list() []adminConn {
+	r.lock.Lock()
+	result := make([]adminConn, 0, len(r.conns))
+	for conn, info := range r.conns {
+		result = append(result, adminConn{
+			Remote: conn.RemoteAddr().String(),
+			Local:  conn.LocalAddr().String(),
+			State:  info.state.String(),
+			Age:    time.Since(info.opened).Round(time.Second).String(),
+		})
+	}
+	r.lock.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Remote < result[j].Remote
+	})
+	return result
+}
+
+// Закрывает соединения с адреса remote. Можно указать ip:port или только ip, тогда закрываются все соединения
+// с этого ip.
+func (r *connRegistry) kick(remote string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	kicked := 0
+	for conn := range r.conns {
+		addr := conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(addr); addr == remote || err == nil && host == remote {
+			conn.Close()
+			kicked++
+		}
+	}
+	return kicked
+}
+
+// EnableAdmin включает админку с доступом по токену, нужно вызвать до Listen
+func (p *Proxy) EnableAdmin(token string) {
+	p.adminToken = token
+	p.conns = &connRegistry{conns: make(map[net.Conn]*connInfo)}
+}
+
+// HandleAdmin отдает состояние прокси и позволяет менять часть настроек на лету, нужно предварительно вызвать
+// EnableAdmin. Токен передается в заголовке X-Admin-Token или Authorization: Bearer.
+func (p *Proxy) HandleAdmin(ctx *fasthttp.RequestCtx) {
+	token := ctx.Request.Header.Peek(adminTokenHeader)
+	if token == nil {
+		if auth := ctx.Request.Header.Peek(fasthttp.HeaderAuthorization); len(auth) > 7 && string(auth[:7]) == "Bearer " {
+			token = auth[7:]
+		}
+	}
+	if subtle.ConstantTimeCompare(token, []byte(p.adminToken)) != 1 {
+		ctx.Error("401 Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+
+	path := string(ctx.Path())
+	if ctx.IsGet() {
+		switch path {
+		case "/config":
+			p.writeJson(ctx, p.adminConfig())
+		case "/stats":
+			p.writeJson(ctx, p.adminStats())
+		case "/connections":
+			p.writeJson(ctx, p.conns.list())
+		default:
+			ctx.Error("404 Not Found", fasthttp.StatusNotFound)
+		}
+		return
+	}
+	if !ctx.IsPost() {
+		ctx.Error("405 Method Not Allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	args := ctx.QueryArgs()
+	switch path {
+	case "/feed":
+		config := p.getConfig()
+		if args.Has("filter") {
+			config.FilterFeed = args.GetBool("filter")
+		}
+		if args.Has("useless-proxy-message") {
+			config.AddUselessProxyMessage = args.GetBool("useless-proxy-message")
+		}
+		p.adminReconfigure(ctx, config)
+	case "/verbosity":
+		level, err := strconv.Atoi(string(args.Peek("level")))
+		if err != nil || level < 0 || level > 3 {
+			ctx.Error("400 Bad Request: level must be from 0 to 3", fasthttp.StatusBadRequest)
+			return
+		}
+		config := p.getConfig()
+		config.LogVerbosity = level
+		p.adminReconfigure(ctx, config)
+	case "/reload-newsfeed":
+		if err := replacer.ReloadAdPost(); err != nil {
+			ctx.Error("500 Internal Server Error: "+err.Error(), fasthttp.StatusInternalServerError)
+			return
+		}
+		p.writeJson(ctx, map[string]bool{"ok": true})
+	case "/kick":
+		remote := string(args.Peek("remote"))
+		if remote == "" {
+			ctx.Error("400 Bad Request: 'remote' argument is not set", fasthttp.StatusBadRequest)
+			return
+		}
+		p.writeJson(ctx, map[string]int{"kicked": p.conns.kick(remote)})
+	default:
+		ctx.Error("404 Not Found", fasthttp.StatusNotFound)
+	}
+}
+
+// Изменения через админку действуют до следующего перечитывания конфига по SIGHUP
+func (p *Proxy) adminReconfigure(ctx *fasthttp.RequestCtx, config ProxyConfig) {
+	if err := p.Reconfigure(config); err != nil {
+		ctx.Error("500 Internal Server Error: "+err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	p.writeJson(ctx, p.adminConfig())
+}
+
+func (p *Proxy) writeJson(ctx *fasthttp.RequestCtx, value interface{}) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		ctx.Error("500 Internal Server Error: "+err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.SetBody(append(data, '\n'))
+}
+
+// Настройки в том же виде, что и флаги запуска
+func (p *Proxy) adminConfig() map[string]interface{} {
+	state := p.state.Load()
+	config := state.config
+	return map[string]interface{}{
+		"domain":                config.BaseDomain,
+		"domain-static":         config.BaseStaticDomain,
+		"log-verbosity":         config.LogVerbosity,
+		"log-redact":            config.LogRedact,
+		"reduce-memory-usage":   config.ReduceMemoryUsage,
+		"filter-feed":           config.FilterFeed,
+		"useless-proxy-message": config.AddUselessProxyMessage,
+		"gzip-upstream":         config.GzipUpstream,
+		"routes":                state.routes.file,
+		"routes-count":          len(state.routes.routes),
+		"rewrite-rules":         state.rules.File,
+		"rate-limit-api":        config.ApiRateLimit.String(),
+		"rate-limit-media":      config.MediaRateLimit.String(),
+		"rate-limit-longpoll":   config.LongpollRateLimit.String(),
+		"trusted-proxies":       config.TrustedProxies.String(),
+		"access-keys":           state.keys.getFile(),
+		"cache":                 p.cache != nil,
+		"access-log":            p.accessLog != nil,
+		"record":                p.recorder != nil,
+		"replay":                p.replayer != nil,
+	}
+}
+
+func (p *Proxy) adminStats() map[string]interface{} {
+	requests, traffic, online := p.tracker.snapshot()
+	acquired, released := replacer.BufferPoolStats()
+	stats := map[string]interface{}{
+		// С последнего вывода статистики в лог, то есть за текущую минуту
+		"tracker": map[string]interface{}{
+			"requests": requests,
+			"bytes":    traffic,
+			"online":   online,
+		},
+		"concurrency":      p.server.GetCurrentConcurrency(),
+		"open-connections": p.server.GetOpenConnectionsCount(),
+		"replace-buffers": map[string]uint64{
+			"acquired": acquired,
+			"released": released,
+			"in-use":   acquired - released,
+		},
+		"circuits-open": p.breakers.openCount(),
+		"tunnels": map[string]uint64{
+			"active":         uint64(p.tunnels.active.Load()),
+			"total":          p.tunnels.total.Load(),
+			"received-bytes": p.tunnels.received.Load(),
+			"sent-bytes":     p.tunnels.sent.Load(),
+		},
+	}
+	limiters := map[string]int{}
+	for class, limiter := range p.limiters {
+		limiters[limitClassNames[class]] = limiter.size()
+	}
+	stats["rate-limited-clients"] = limiters
+	if p.cache != nil {
+		entries, size := p.cache.stats()
+		stats["cache"] = map[string]int{"entries": entries, "bytes": size}
+	}
+	if keys := p.state.Load().keys; keys != nil {
+		list := make([]map[string]interface{}, 0, len(keys.list))
+		for _, key := range keys.list {
+			list = append(list, map[string]interface{}{
+				"name":      key.name,
+				"requests":  key.requests.Load(),
+				"bytes":     key.bytes.Load(),
+				"last-used": key.lastUsed.Load(),
+			})
+		}
+		stats["access-keys"] = list
+	}
+	return stats
+}
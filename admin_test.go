@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func doAdminRequest(p *Proxy, method, uri string, prepare func(req *fasthttp.Request)) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI("http://admin.test" + uri)
+	if prepare != nil {
+		prepare(&ctx.Request)
+	}
+	p.HandleAdmin(ctx)
+	return ctx
+}
+
+func withAdminToken(token string) func(req *fasthttp.Request) {
+	return func(req *fasthttp.Request) {
+		req.Header.Set(adminTokenHeader, token)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	p, _ := newTestProxy(t, ProxyConfig{}, nil)
+	p.EnableAdmin("secret")
+	for _, c := range []struct {
+		name    string
+		prepare func(req *fasthttp.Request)
+		status  int
+	}{
+		{"no token", nil, 401},
+		{"empty token", withAdminToken(""), 401},
+		{"wrong token", withAdminToken("wrong"), 401},
+		{"token prefix", withAdminToken("secre"), 401},
+		{"wrong bearer", func(req *fasthttp.Request) {
+			req.Header.Set(fasthttp.HeaderAuthorization, "Bearer wrong")
+		}, 401},
+		{"not bearer", func(req *fasthttp.Request) {
+			req.Header.Set(fasthttp.HeaderAuthorization, "Basic secret")
+		}, 401},
+		{"header", withAdminToken("secret"), 200},
+		{"bearer", func(req *fasthttp.Request) {
+			req.Header.Set(fasthttp.HeaderAuthorization, "Bearer secret")
+		}, 200},
+	} {
+		ctx := doAdminRequest(p, fasthttp.MethodGet, "/config", c.prepare)
+		if ctx.Response.StatusCode() != c.status {
+			t.Errorf("%s: got %d %q, expected %d", c.name, ctx.Response.StatusCode(), ctx.Response.Body(), c.status)
+		}
+	}
+
+	// Без токена не отвечают и неизвестные пути, и изменение настроек
+	if ctx := doAdminRequest(p, fasthttp.MethodPost, "/verbosity?level=3", nil); ctx.Response.StatusCode() != 401 {
+		t.Errorf("/verbosity without token got %d", ctx.Response.StatusCode())
+	}
+	if p.getConfig().LogVerbosity != 0 {
+		t.Errorf("verbosity changed without token")
+	}
+}
+
+func TestAdminReconfigure(t *testing.T) {
+	p, _ := newTestProxy(t, ProxyConfig{BaseDomain: "proxy.test", LogVerbosity: 1}, nil)
+	p.EnableAdmin("secret")
+	auth := withAdminToken("secret")
+
+	ctx := doAdminRequest(p, fasthttp.MethodPost, "/feed?filter=1", auth)
+	if ctx.Response.StatusCode() != 200 {
+		t.Fatalf("/feed got %d %q", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(ctx.Response.Body(), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["filter-feed"] != true || config["useless-proxy-message"] != false {
+		t.Errorf("/feed answered %s", ctx.Response.Body())
+	}
+	// Остальные настройки не меняются
+	if c := p.getConfig(); !c.FilterFeed || c.AddUselessProxyMessage || c.BaseDomain != "proxy.test" || c.LogVerbosity != 1 {
+		t.Errorf("config after /feed: %+v", c)
+	}
+	if !p.state.Load().replacer.FilterFeed {
+		t.Error("replacer was not rebuilt after /feed")
+	}
+	doAdminRequest(p, fasthttp.MethodPost, "/feed?useless-proxy-message=1", auth)
+	if c := p.getConfig(); !c.FilterFeed || !c.AddUselessProxyMessage {
+		t.Errorf("config after second /feed: %+v", c)
+	}
+
+	for _, c := range []struct {
+		uri       string
+		status    int
+		verbosity int
+	}{
+		{"/verbosity?level=3", 200, 3},
+		{"/verbosity?level=0", 200, 0},
+		{"/verbosity?level=4", 400, 0},
+		{"/verbosity?level=-1", 400, 0},
+		{"/verbosity?level=high", 400, 0},
+		{"/verbosity", 400, 0},
+	} {
+		ctx = doAdminRequest(p, fasthttp.MethodPost, c.uri, auth)
+		if ctx.Response.StatusCode() != c.status || p.getConfig().LogVerbosity != c.verbosity {
+			t.Errorf("%s: got %d with verbosity %d, expected %d with %d", c.uri, ctx.Response.StatusCode(),
+				p.getConfig().LogVerbosity, c.status, c.verbosity)
+		}
+	}
+
+	// Настройки меняются только POST
+	if ctx = doAdminRequest(p, fasthttp.MethodGet, "/verbosity?level=2", auth); ctx.Response.StatusCode() != 404 {
+		t.Errorf("GET /verbosity got %d", ctx.Response.StatusCode())
+	}
+	if ctx = doAdminRequest(p, fasthttp.MethodPut, "/verbosity?level=2", auth); ctx.Response.StatusCode() != 405 {
+		t.Errorf("PUT /verbosity got %d", ctx.Response.StatusCode())
+	}
+	if p.getConfig().LogVerbosity != 0 {
+		t.Errorf("verbosity changed to %d not by POST", p.getConfig().LogVerbosity)
+	}
+}
+
+func TestAdminKick(t *testing.T) {
+	p, client := newTestProxy(t, ProxyConfig{}, func(ctx *fasthttp.RequestCtx) {})
+	p.EnableAdmin("secret")
+	auth := withAdminToken("secret")
+
+	if ctx := doAdminRequest(p, fasthttp.MethodPost, "/kick", auth); ctx.Response.StatusCode() != 400 {
+		t.Errorf("/kick without remote got %d", ctx.Response.StatusCode())
+	}
+
+	// Соединение клиента остается открытым после запроса
+	doTestRequest(t, client, "http://proxy.test/a.jpg", nil)
+	var conns []adminConn
+	ctx := doAdminRequest(p, fasthttp.MethodGet, "/connections", auth)
+	if err := json.Unmarshal(ctx.Response.Body(), &conns); err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 1 || conns[0].Remote != testClientAddr.String() {
+		t.Fatalf("/connections answered %s", ctx.Response.Body())
+	}
+
+	for _, c := range []struct {
+		remote string
+		kicked int
+	}{
+		{"203.0.113.8", 0},
+		{testClientAddr.IP.String() + ":1", 0},
+		{testClientAddr.IP.String(), 1},
+	} {
+		ctx = doAdminRequest(p, fasthttp.MethodPost, "/kick?remote="+c.remote, auth)
+		var result map[string]int
+		if err := json.Unmarshal(ctx.Response.Body(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result["kicked"] != c.kicked {
+			t.Errorf("/kick %s answered %s, expected %d kicked", c.remote, ctx.Response.Body(), c.kicked)
+		}
+	}
+	waitFor(t, "kicked connection to close", func() bool {
+		return len(p.conns.list()) == 0
+	})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/xtrafrancyz/vk-proxy/replacer"
+)
+
+// Тело ответа апстрима, которое отдается клиенту потоком. Считает прочитанные сервером байты и вызывает onClose,
+// когда сервер закончил запись или ответ был сброшен.
+type bodyStream struct {
+	upstream *fasthttp.Response
+	stream   io.Reader
+	// Соединение с апстримом, если оно открыто через dialIdleTimeout или newEgressDialer
+	conn *idleTimeoutConn
+	// Соединение с клиентом, см. serverConn
+	client  net.Conn
+	size    int
+	eof     bool
+	closed  bool
+	onClose func(size int)
+}
+
+// Тело отдается клиенту по мере получения: таймаут чтения апстрима дальше считается от последнего куска, а не
+// от начала ответа. fasthttp выставляет дедлайн записи клиенту один раз на весь ответ, поэтому он тоже
+// продлевается после каждого куска.
+func (s *bodyStream) forward(client net.Conn) {
+	if s.conn != nil {
+		s.conn.startIdle()
+	}
+	s.client = client
+}
+
+func (s *bodyStream) Read(b []byte) (int, error) {
+	n, err := s.stream.Read(b)
+	s.size += n
+	if err == io.EOF {
+		s.eof = true
+	}
+	if n > 0 && s.client != nil {
+		s.client.SetWriteDeadline(time.Now().Add(serverWriteTimeout))
+	}
+	return n, err
+}
+
+func (s *bodyStream) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	// Недочитанное тело останется в соединении, такое соединение нельзя вернуть в пул клиента
+	if !s.eof {
+		s.upstream.SetConnectionClose()
+	}
+	err := s.upstream.CloseBodyStream()
+	fasthttp.ReleaseResponse(s.upstream)
+	s.upstream, s.stream = nil, nil
+	if s.onClose != nil {
+		s.onClose(s.size)
+	}
+	return err
+}
+
+// Тело ответа апстрима с заменами, которые применяются по мере чтения. Прочитанное из source пишется в writer
+// замен, а тот дописывает результат в out.
+type rewriteReader struct {
+	source io.Reader
+	writer io.WriteCloser
+	out    bytes.Buffer
+	buf    []byte
+	eof    bool
+}
+
+func (r *rewriteReader) Read(b []byte) (int, error) {
+	if r.buf == nil {
+		r.buf = make([]byte, 32*1024)
+	}
+	// Замена может задержать весь прочитанный кусок, пока не увидит продолжение
+	for r.out.Len() == 0 && !r.eof {
+		n, err := r.source.Read(r.buf)
+		if n > 0 {
+			if _, werr := r.writer.Write(r.buf[:n]); werr != nil {
+				return 0, werr
+			}
+		}
+		if err == io.EOF {
+			r.eof = true
+			if err = r.writer.Close(); err != nil {
+				return 0, err
+			}
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if r.out.Len() == 0 {
+		return 0, io.EOF
+	}
+	return r.out.Read(b)
+}
+
+// Читает в память тело ответа, которое пришло потоком. Body и SwapBody при ошибке чтения подставляют вместо тела
+// текст ошибки, а ответ с оборванным телом нельзя отдавать клиенту.
+func readBody(res *fasthttp.Response) error {
+	stream := res.BodyStream()
+	if stream == nil {
+		return nil
+	}
+	buf := replacer.AcquireBuffer()
+	_, err := buf.ReadFrom(stream)
+	res.ResetBody()
+	if err == nil {
+		buf.B = res.SwapBody(buf.B)
+	}
+	replacer.ReleaseBuffer(buf)
+	return err
+}
+
+// Тело ответа с ошибкой такого размера дочитывается, чтобы соединение с апстримом вернулось в пул
+const maxDiscardedBody = 16 * 1024
+
+// Закрывает тело ответа, который не будет отправлен клиенту
+func discardBody(res *fasthttp.Response) {
+	if stream, ok := res.BodyStream().(*bodyStream); ok {
+		io.CopyN(io.Discard, stream, maxDiscardedBody)
+	}
+	res.ResetBody()
+}
+
+// Тело запроса, которое сервер отдает потоком. fasthttp выставляет дедлайн чтения от клиента один раз на весь
+// запрос, поэтому при загрузке большого файла он продлевается после каждого куска. С StreamRequestBody сервер не
+// проверяет MaxRequestBodySize, поэтому размер тела считается здесь же: после limit байт чтение завершается
+// ошибкой fasthttp.ErrBodyTooLarge.
+type requestBodyStream struct {
+	stream io.Reader
+	// Соединение клиента из serverConn или nil
+	client net.Conn
+	limit  int
+	size   int
+}
+
+func (s *requestBodyStream) Read(b []byte) (int, error) {
+	n, err := s.stream.Read(b)
+	s.size += n
+	if s.limit > 0 && s.size > s.limit {
+		return 0, fasthttp.ErrBodyTooLarge
+	}
+	if n > 0 && s.client != nil {
+		s.client.SetReadDeadline(time.Now().Add(serverReadTimeout))
+	}
+	return n, err
+}
+
+// Соединение клиента, в котором fasthttp.Server выставляет дедлайны. У запросов через net/http сервер (HTTP/2)
+// в ctx только адреса, таймауты там выставляет сам net/http.
+func serverConn(ctx *fasthttp.RequestCtx) net.Conn {
+	if ctx.UserValue(netHttpRequestKey) != nil {
+		return nil
+	}
+	return ctx.Conn()
+}
+
+// Выполняет запрос к апстриму и, если res.StreamBody, отдает тело ответа потоком через bodyStream. Обернуть поток
+// прямо в res нельзя: SetBodyStream закрывает прежний поток и вместе с ним отпускает соединение с апстримом,
+// поэтому ответ сначала читается в отдельный Response. По той же причине тело запроса, которое идет от клиента
+// потоком, передается апстриму через копию запроса. clientConn -- соединение клиента из serverConn или nil,
+// maxBody -- ограничение -max-body-size или 0.
+func doStreamed(client *fasthttp.Client, req *fasthttp.Request, res *fasthttp.Response, clientConn net.Conn,
+	maxBody int) error {
+	if req.IsBodyStream() && (clientConn != nil || maxBody > 0) {
+		upstreamReq := fasthttp.AcquireRequest()
+		defer fasthttp.ReleaseRequest(upstreamReq)
+		req.CopyTo(upstreamReq)
+		upstreamReq.SetBodyStream(&requestBodyStream{stream: req.BodyStream(), client: clientConn, limit: maxBody},
+			req.Header.ContentLength())
+		req = upstreamReq
+	}
+	if !res.StreamBody {
+		return client.Do(req, res)
+	}
+	upstream := fasthttp.AcquireResponse()
+	upstream.StreamBody = true
+	upstream.SkipBody = res.SkipBody
+	if err := client.Do(req, upstream); err != nil {
+		fasthttp.ReleaseResponse(upstream)
+		return err
+	}
+	upstream.Header.CopyTo(&res.Header)
+	stream := upstream.BodyStream()
+	if stream == nil {
+		// Ответ без тела: HEAD, 204, 304
+		res.ResetBody()
+		fasthttp.ReleaseResponse(upstream)
+		return nil
+	}
+	body := &bodyStream{upstream: upstream, stream: stream}
+	if addr, ok := upstream.LocalAddr().(*idleTimeoutAddr); ok {
+		body.conn = addr.conn
+	}
+	res.SetBodyStream(body, upstream.Header.ContentLength())
+	return nil
+}
+
+// Читает в память тело запроса, которое сервер отдал потоком: для повтора запроса и для записи через -record-dir.
+// Тело больше limit не читается, тогда возвращается fasthttp.ErrBodyTooLarge. Content-Length присылает клиент,
+// поэтому память выделяется по мере чтения, а не по нему.
+func bufferRequestBody(req *fasthttp.Request, limit int) error {
+	if !req.IsBodyStream() {
+		return nil
+	}
+	if req.Header.ContentLength() > limit {
+		return fasthttp.ErrBodyTooLarge
+	}
+	body, err := io.ReadAll(io.LimitReader(req.BodyStream(), int64(limit)+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > limit {
+		return fasthttp.ErrBodyTooLarge
+	}
+	req.SetBody(body)
+	return nil
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/xtrafrancyz/vk-proxy/bytefmt"
+	"github.com/xtrafrancyz/vk-proxy/replacer"
+)
+
+const (
+	cacheResultHit         = "hit"
+	cacheResultMiss        = "miss"
+	cacheResultRevalidated = "revalidated"
+
+	// Ответы больше этого размера не кешируются и отдаются потоком
+	cacheMaxEntrySize = 4 * bytefmt.MEGABYTE
+)
+
+var (
+	// Заголовки ответа, которые сохраняются в кеше
+	cachedHeaders = []string{
+		fasthttp.HeaderContentType,
+		fasthttp.HeaderCacheControl,
+		fasthttp.HeaderETag,
+		fasthttp.HeaderLastModified,
+		fasthttp.HeaderExpires,
+		fasthttp.HeaderAccessControlAllowOrigin,
+	}
+)
+
+type CacheConfig struct {
+	// Размер кеша в памяти, 0 - кеш выключен
+	Size byteSize
+	// Папка для кеша на диске, пустая строка - только память
+	Dir      string
+	DiskSize byteSize
+}
+
+// Размер в байтах для флагов, например 64M или 1G
+type byteSize uint64
+
+func (s *byteSize) Set(value string) error {
+	if value == "0" {
+		*s = 0
+		return nil
+	}
+	parsed, err := bytefmt.ToBytes(value)
+	if err != nil {
+		return err
+	}
+	*s = byteSize(parsed)
+	return nil
+}
+
+func (s *byteSize) String() string {
+	if *s == 0 {
+		return "0"
+	}
+	return bytefmt.ByteSize(uint64(*s))
+}
+
+// Ответ апстрима уже после замен, поэтому при попадании в кеш не нужны ни gunzip, ни реплейсер
+type cacheEntry struct {
+	Key     string
+	Headers [][2]string
+	Body    []byte `json:"-"`
+	Expires time.Time
+	// Для перепроверки устаревшей записи через If-None-Match и If-Modified-Since
+	ETag         string
+	LastModified string
+}
+
+func (e *cacheEntry) size() int {
+	return len(e.Body) + len(e.Key) + 256
+}
+
+func (e *cacheEntry) fresh() bool {
+	return time.Now().Before(e.Expires)
+}
+
+func (e *cacheEntry) writeTo(ctx *fasthttp.RequestCtx) {
+	res := &ctx.Response
+	res.Reset()
+	for _, header := range e.Headers {
+		res.Header.Set(header[0], header[1])
+	}
+	res.Header.SetBytesV(fasthttp.HeaderServer, vkProxyName)
+	if e.ETag != "" && bytes.Equal(ctx.Request.Header.Peek(fasthttp.HeaderIfNoneMatch), []byte(e.ETag)) {
+		res.SetStatusCode(fasthttp.StatusNotModified)
+		return
+	}
+	res.SetBodyRaw(e.Body)
+}
+
+type responseCache struct {
+	lock    sync.Mutex
+	maxSize int
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+
+	disk *diskCache
+}
+
+func newResponseCache(config CacheConfig) (*responseCache, error) {
+	c := &responseCache{
+		maxSize: int(config.Size),
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	if config.Dir != "" {
+		var err error
+		if c.disk, err = newDiskCache(config.Dir, int64(config.DiskSize)); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Ключ кеша для запроса или пустая строка, если запрос не кешируется. Запросы к oauth, с access_token и другими
+// секретами в query (см. isSensitiveKey), с куками или авторизацией относятся к конкретному пользователю и никогда
+// не берутся из общего кеша. Домены прокси входят в ключ, так как ссылки в теле ответа уже заменены на них.
+func (c *responseCache) requestKey(ctx *fasthttp.RequestCtx, rep *replacer.Replacer, rewrite string) string {
+	req := &ctx.Request
+	if !req.Header.IsGet() || rewrite == replacer.RewriteOauth ||
+		req.Header.Peek(fasthttp.HeaderCookie) != nil || req.Header.Peek(fasthttp.HeaderAuthorization) != nil {
+		return ""
+	}
+	if bytes.Contains(req.Header.Peek(fasthttp.HeaderCacheControl), []byte("no-cache")) {
+		return ""
+	}
+	sensitive := false
+	req.URI().QueryArgs().VisitAll(func(key, value []byte) {
+		sensitive = sensitive || isSensitiveKey(key)
+	})
+	if sensitive {
+		return ""
+	}
+	return rep.ProxyBaseDomain + "|" + rep.ProxyStaticDomain + "|" + string(req.Host()) + string(req.RequestURI())
+}
+
+func (c *responseCache) get(key string) *cacheEntry {
+	c.lock.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		c.lock.Unlock()
+		return el.Value.(*cacheEntry)
+	}
+	c.lock.Unlock()
+	if c.disk == nil {
+		return nil
+	}
+	entry := c.disk.get(key)
+	if entry != nil {
+		c.add(entry)
+	}
+	return entry
+}
+
+// Проверяет по заголовкам ответа, можно ли его сохранить. Вызывается до того, как прокси уберет Set-Cookie.
+func (c *responseCache) cacheable(res *fasthttp.Response) bool {
+	if res.StatusCode() != fasthttp.StatusOK || res.Header.Peek(fasthttp.HeaderSetCookie) != nil {
+		return false
+	}
+	if vary := res.Header.Peek(fasthttp.HeaderVary); vary != nil && !strings.EqualFold(string(vary), "Accept-Encoding") {
+		return false
+	}
+	ttl, ok := cacheTTL(res)
+	if !ok {
+		return false
+	}
+	// Без срока жизни ответ можно хранить только для перепроверки по ETag или Last-Modified
+	return ttl > 0 || res.Header.Peek(fasthttp.HeaderETag) != nil || res.Header.Peek(fasthttp.HeaderLastModified) != nil
+}
+
+// Поместится ли ответ, который иначе отдавался бы потоком
+func (c *responseCache) fits(contentLength int) bool {
+	return contentLength >= 0 && contentLength <= cacheMaxEntrySize && contentLength <= c.maxSize/8
+}
+
+func (c *responseCache) put(key string, res *fasthttp.Response) {
+	body := res.Body()
+	if len(body) > cacheMaxEntrySize || len(body) > c.maxSize/8 {
+		return
+	}
+	ttl, _ := cacheTTL(res)
+	entry := &cacheEntry{
+		Key:          key,
+		Body:         append([]byte(nil), body...),
+		Expires:      time.Now().Add(ttl),
+		ETag:         string(res.Header.Peek(fasthttp.HeaderETag)),
+		LastModified: string(res.Header.Peek(fasthttp.HeaderLastModified)),
+	}
+	for _, name := range cachedHeaders {
+		if value := res.Header.Peek(name); value != nil {
+			entry.Headers = append(entry.Headers, [2]string{name, string(value)})
+		}
+	}
+	c.add(entry)
+	if c.disk != nil {
+		go c.disk.put(entry)
+	}
+}
+
+// Апстрим ответил 304 на перепроверку, запись продолжает жить с новым сроком
+func (c *responseCache) refresh(entry *cacheEntry, res *fasthttp.Response) {
+	ttl, _ := cacheTTL(res)
+	refreshed := *entry
+	refreshed.Expires = time.Now().Add(ttl)
+	c.add(&refreshed)
+	if c.disk != nil {
+		go c.disk.put(&refreshed)
+	}
+}
+
+// Добавляет условные заголовки для перепроверки устаревшей записи, если клиент не прислал свои
+func (c *responseCache) addValidators(entry *cacheEntry, req *fasthttp.Request) bool {
+	if req.Header.Peek(fasthttp.HeaderIfNoneMatch) != nil || req.Header.Peek(fasthttp.HeaderIfModifiedSince) != nil {
+		return false
+	}
+	if entry.ETag != "" {
+		req.Header.Set(fasthttp.HeaderIfNoneMatch, entry.ETag)
+	} else if entry.LastModified != "" {
+		req.Header.Set(fasthttp.HeaderIfModifiedSince, entry.LastModified)
+	} else {
+		return false
+	}
+	return true
+}
+
+func (c *responseCache) add(entry *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.entries[entry.Key]; ok {
+		c.size -= el.Value.(*cacheEntry).size()
+		c.lru.Remove(el)
+	}
+	c.entries[entry.Key] = c.lru.PushFront(entry)
+	c.size += entry.size()
+	for c.size > c.maxSize {
+		el := c.lru.Back()
+		evicted := c.lru.Remove(el).(*cacheEntry)
+		delete(c.entries, evicted.Key)
+		c.size -= evicted.size()
+	}
+}
+
+func (c *responseCache) stats() (entries, size int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries), c.size
+}
+
+// Срок жизни из Cache-Control. ok == false, если ответ нельзя хранить в общем кеше.
+func cacheTTL(res *fasthttp.Response) (ttl time.Duration, ok bool) {
+	ok = true
+	for _, directive := range strings.Split(string(res.Header.Peek(fasthttp.HeaderCacheControl)), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(strings.ToLower(directive)), "=")
+		switch name {
+		case "no-store", "private":
+			return 0, false
+		case "no-cache":
+			return 0, true
+		case "max-age", "s-maxage":
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && seconds > 0 {
+				// s-maxage для общих кешей важнее max-age
+				if name == "s-maxage" || ttl == 0 {
+					ttl = time.Duration(seconds) * time.Second
+				}
+			}
+		}
+	}
+	return ttl, ok
+}
+
+// Кеш на диске: каждый ответ в отдельном файле, при превышении размера удаляются давно не использованные
+type diskCache struct {
+	dir     string
+	maxSize int64
+
+	lock  sync.Mutex
+	size  int64
+	files map[string]*list.Element
+	lru   *list.List
+}
+
+type diskFile struct {
+	name string
+	size int64
+}
+
+func newDiskCache(dir string, maxSize int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	d := &diskCache{dir: dir, maxSize: maxSize, files: make(map[string]*list.Element), lru: list.New()}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Файлы от прошлого запуска в порядке последнего использования
+	type fileInfo struct {
+		diskFile
+		modTime time.Time
+	}
+	var existing []fileInfo
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		existing = append(existing, fileInfo{diskFile{entry.Name(), info.Size()}, info.ModTime()})
+	}
+	sort.Slice(existing, func(i, j int) bool {
+		return existing[i].modTime.Before(existing[j].modTime)
+	})
+	for _, f := range existing {
+		d.files[f.name] = d.lru.PushFront(&diskFile{f.name, f.size})
+		d.size += f.size
+	}
+	d.evict()
+	log.Printf("Disk cache in %s: %d files, %s", dir, len(d.files), bytefmt.ByteSize(uint64(d.size)))
+	return d, nil
+}
+
+func diskCacheName(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *diskCache) get(key string) *cacheEntry {
+	name := diskCacheName(key)
+	d.lock.Lock()
+	el, ok := d.files[name]
+	if ok {
+		d.lru.MoveToFront(el)
+	}
+	d.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	entry, err := readCacheFile(filepath.Join(d.dir, name))
+	// Совпадение sha1 от разных ключей практически невозможно, но проверить ничего не стоит
+	if err != nil || entry.Key != key {
+		return nil
+	}
+	now := time.Now()
+	os.Chtimes(filepath.Join(d.dir, name), now, now)
+	return entry
+}
+
+func (d *diskCache) put(entry *cacheEntry) {
+	name := diskCacheName(entry.Key)
+	size, err := writeCacheFile(d.dir, name, entry)
+	if err != nil {
+		log.Printf("Could not write cache file: %s", err)
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if el, ok := d.files[name]; ok {
+		d.size -= el.Value.(*diskFile).size
+		d.lru.Remove(el)
+	}
+	d.files[name] = d.lru.PushFront(&diskFile{name, size})
+	d.size += size
+	d.evict()
+}
+
+func (d *diskCache) evict() {
+	for d.size > d.maxSize && d.lru.Len() > 0 {
+		f := d.lru.Remove(d.lru.Back()).(*diskFile)
+		delete(d.files, f.name)
+		d.size -= f.size
+		os.Remove(filepath.Join(d.dir, f.name))
+	}
+}
+
+// Формат файла: заголовок записи в JSON, перевод строки и тело ответа
+func writeCacheFile(dir, name string, entry *cacheEntry) (int64, error) {
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(tmp)
+	w.Write(meta)
+	w.WriteByte('\n')
+	w.Write(entry.Body)
+	if err = w.Flush(); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return int64(len(meta) + 1 + len(entry.Body)), nil
+}
+
+func readCacheFile(path string) (*cacheEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	meta, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	entry := &cacheEntry{}
+	if err = json.Unmarshal(meta, entry); err != nil {
+		return nil, fmt.Errorf("invalid cache file %s: %w", path, err)
+	}
+	if entry.Body, err = io.ReadAll(r); err != nil {
+		return nil, err
+	}
+	if entry.Key == "" {
+		return nil, errors.New("invalid cache file " + path)
+	}
+	return entry, nil
+}
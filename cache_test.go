@@ -0,0 +1,169 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"github.com/xtrafrancyz/vk-proxy/replacer"
+)
+
+func TestCacheRequestKey(t *testing.T) {
+	c := &responseCache{}
+	rep := &replacer.Replacer{ProxyBaseDomain: "proxy.test", ProxyStaticDomain: "static.test"}
+	for _, r := range []struct {
+		name    string
+		uri     string
+		rewrite string
+		prepare func(req *fasthttp.Request)
+		cached  bool
+	}{
+		{"plain get", "/method/users.get?v=5.131", "", nil, true},
+		{"access_token", "/method/users.get?access_token=abc&v=5.131", "", nil, false},
+		{"access_token not first", "/method/users.get?v=5.131&access_token=abc", "", nil, false},
+		{"empty access_token", "/method/users.get?access_token=", "", nil, false},
+		{"password", "/token?grant_type=password&username=a&password=b", "", nil, false},
+		{"code", "/access_token?client_id=1&code=abc", "", nil, false},
+		{"uppercase key", "/a.jpg?Sig=abc", "", nil, false},
+		{"key suffix", "/a.jpg?client_secret=abc", "", nil, false},
+		{"not sensitive", "/a.jpg?size=1&type=small", "", nil, true},
+		// Ответы oauth не кешируются даже без секретов в query
+		{"oauth", "/authorize?client_id=1&display=page", replacer.RewriteOauth, nil, false},
+		{"api", "/method/users.get?v=5.131", replacer.RewriteApi, nil, true},
+		{"cookie", "/a.jpg", "", func(req *fasthttp.Request) {
+			req.Header.Set(fasthttp.HeaderCookie, "remixsid=abc")
+		}, false},
+		{"authorization", "/a.jpg", "", func(req *fasthttp.Request) {
+			req.Header.Set(fasthttp.HeaderAuthorization, "Bearer abc")
+		}, false},
+		{"post", "/method/users.get", "", func(req *fasthttp.Request) {
+			req.Header.SetMethod(fasthttp.MethodPost)
+		}, false},
+		{"head", "/a.jpg", "", func(req *fasthttp.Request) {
+			req.Header.SetMethod(fasthttp.MethodHead)
+		}, false},
+		{"no-cache", "/a.jpg", "", func(req *fasthttp.Request) {
+			req.Header.Set(fasthttp.HeaderCacheControl, "no-cache")
+		}, false},
+	} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI("http://files.test" + r.uri)
+		if r.prepare != nil {
+			r.prepare(&ctx.Request)
+		}
+		if key := c.requestKey(ctx, rep, r.rewrite); (key != "") != r.cached {
+			t.Errorf("%s: key %q, expected cached = %v", r.name, key, r.cached)
+		}
+	}
+
+	// Ссылки в теле ответа заменены на домены прокси, поэтому ответы для разных доменов не смешиваются
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("http://files.test/a.jpg")
+	other := &replacer.Replacer{ProxyBaseDomain: "other.test", ProxyStaticDomain: "static.test"}
+	if c.requestKey(ctx, rep, "") == c.requestKey(ctx, other, "") {
+		t.Error("key must depend on proxy domains")
+	}
+}
+
+func TestCacheable(t *testing.T) {
+	c := &responseCache{}
+	for _, r := range []struct {
+		name      string
+		status    int
+		headers   map[string]string
+		cookie    bool
+		cacheable bool
+	}{
+		{"max-age", 200, map[string]string{"Cache-Control": "public, max-age=60"}, false, true},
+		{"etag only", 200, map[string]string{"ETag": `"v1"`}, false, true},
+		{"last-modified only", 200, map[string]string{"Last-Modified": "Mon, 02 Jan 2006 15:04:05 GMT"}, false, true},
+		{"no lifetime", 200, nil, false, false},
+		{"set-cookie", 200, map[string]string{"Cache-Control": "max-age=60"}, true, false},
+		{"private", 200, map[string]string{"Cache-Control": "private, max-age=60"}, false, false},
+		{"private uppercase", 200, map[string]string{"Cache-Control": "max-age=60, Private"}, false, false},
+		{"private fields", 200, map[string]string{"Cache-Control": `private="Set-Cookie", max-age=60`}, false, false},
+		{"no-store", 200, map[string]string{"Cache-Control": "no-store", "ETag": `"v1"`}, false, false},
+		{"no-store with max-age", 200, map[string]string{"Cache-Control": "max-age=60,no-store"}, false, false},
+		{"vary cookie", 200, map[string]string{"Cache-Control": "max-age=60", "Vary": "Cookie"}, false, false},
+		{"vary accept-encoding", 200, map[string]string{"Cache-Control": "max-age=60", "Vary": "accept-encoding"}, false, true},
+		{"not found", 404, map[string]string{"Cache-Control": "max-age=60"}, false, false},
+	} {
+		res := &fasthttp.Response{}
+		res.SetStatusCode(r.status)
+		for name, value := range r.headers {
+			res.Header.Set(name, value)
+		}
+		if r.cookie {
+			cookie := fasthttp.AcquireCookie()
+			cookie.SetKey("remixsid")
+			cookie.SetValue("abc")
+			res.Header.SetCookie(cookie)
+			fasthttp.ReleaseCookie(cookie)
+		}
+		if got := c.cacheable(res); got != r.cacheable {
+			t.Errorf("%s: cacheable = %v, expected %v", r.name, got, r.cacheable)
+		}
+	}
+}
+
+// Ответы, относящиеся к конкретному пользователю, через прокси каждый раз должны приходить от апстрима
+func TestCachePrivateExchanges(t *testing.T) {
+	var served atomic.Int32
+	p, client := newTestProxy(t, ProxyConfig{}, func(ctx *fasthttp.RequestCtx) {
+		switch string(ctx.Path()) {
+		case "/private":
+			ctx.Response.Header.Set(fasthttp.HeaderCacheControl, "private, max-age=60")
+		case "/no-store":
+			ctx.Response.Header.Set(fasthttp.HeaderCacheControl, "no-store")
+		case "/cookie":
+			ctx.Response.Header.Set(fasthttp.HeaderCacheControl, "max-age=60")
+			ctx.Response.Header.Set(fasthttp.HeaderSetCookie, "remixsid=abc")
+		default:
+			ctx.Response.Header.Set(fasthttp.HeaderCacheControl, "max-age=60")
+		}
+		ctx.SetBodyString(string(ctx.RequestURI()) + " #" + strconv.Itoa(int(served.Add(1))))
+	})
+	if err := p.EnableCache(CacheConfig{Size: 1024 * 1024}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []struct {
+		uri     string
+		prepare func(req *fasthttp.Request)
+		cached  bool
+	}{
+		{"/public", nil, true},
+		{"/private", nil, false},
+		{"/no-store", nil, false},
+		{"/cookie", nil, false},
+		{"/public?access_token=abc", nil, false},
+		{"/public-cookie", func(req *fasthttp.Request) {
+			req.Header.Set(fasthttp.HeaderCookie, "remixsid=abc")
+		}, false},
+		{"/public-auth", func(req *fasthttp.Request) {
+			req.Header.Set(fasthttp.HeaderAuthorization, "Bearer abc")
+		}, false},
+	} {
+		first := doTestRequest(t, client, "http://proxy.test"+r.uri, r.prepare)
+		second := doTestRequest(t, client, "http://proxy.test"+r.uri, r.prepare)
+		if cached := string(first.Body()) == string(second.Body()); cached != r.cached {
+			t.Errorf("%s: got %q then %q, expected cached = %v", r.uri, first.Body(), second.Body(), r.cached)
+		}
+		if second.Header.Peek(fasthttp.HeaderSetCookie) != nil {
+			t.Errorf("%s: Set-Cookie reached the client", r.uri)
+		}
+	}
+
+	// Запрос с куками не должен получить ответ, закешированный для запроса без них
+	public := doTestRequest(t, client, "http://proxy.test/shared", nil)
+	private := doTestRequest(t, client, "http://proxy.test/shared", func(req *fasthttp.Request) {
+		req.Header.Set(fasthttp.HeaderCookie, "remixsid=abc")
+	})
+	if string(public.Body()) == string(private.Body()) {
+		t.Errorf("request with cookie got cached response %q", private.Body())
+	}
+	if entries, _ := p.cache.stats(); entries != 2 {
+		t.Errorf("%d cache entries, expected only /public and /shared", entries)
+	}
+}
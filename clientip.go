@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+const defaultTrustedProxies = "loopback"
+
+// Готовые наборы адресов для -trusted-proxies
+var trustedProxyPresets = map[string][]string{
+	"loopback": {"127.0.0.0/8", "::1/128"},
+	"private":  {"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"},
+	// https://www.cloudflare.com/ips/
+	"cloudflare": {
+		"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22", "103.31.4.0/22", "141.101.64.0/18",
+		"108.162.192.0/18", "190.93.240.0/20", "188.114.96.0/20", "197.234.240.0/22", "198.41.128.0/17",
+		"162.158.0.0/15", "104.16.0.0/13", "104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+		"2400:cb00::/32", "2606:4700::/32", "2803:f800::/32", "2405:b500::/32", "2405:8100::/32",
+		"2a06:98c0::/29", "2c0f:f248::/32",
+	},
+}
+
+var cloudflareProxies = mustTrustedProxies("cloudflare")
+
+// Адреса прокси перед vk-proxy (nginx, Cloudflare), которым можно верить в заголовках с ip клиента. Задается
+// флагом через запятую: подсети, отдельные адреса или названия наборов из trustedProxyPresets.
+type trustedProxies struct {
+	spec string
+	nets []*net.IPNet
+}
+
+func (t *trustedProxies) Set(value string) error {
+	var nets []*net.IPNet
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		cidrs, ok := trustedProxyPresets[part]
+		if !ok {
+			cidrs = []string{part}
+		}
+		for _, cidr := range cidrs {
+			if !strings.Contains(cidr, "/") {
+				if strings.Contains(cidr, ":") {
+					cidr += "/128"
+				} else {
+					cidr += "/32"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("invalid trusted proxy %q", part)
+			}
+			nets = append(nets, ipNet)
+		}
+	}
+	t.spec = value
+	t.nets = nets
+	return nil
+}
+
+func (t *trustedProxies) String() string {
+	return t.spec
+}
+
+func (t *trustedProxies) contains(ip net.IP) bool {
+	for _, ipNet := range t.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Определяет ip клиента. Заголовкам верится только если соединение пришло от доверенного прокси (или через unix
+// сокет), цепочка X-Forwarded-For разбирается справа налево до первого недоверенного адреса. X-Real-IP не
+// принимается напрямую от Cloudflare.
+func (t *trustedProxies) resolve(ctx *fasthttp.RequestCtx) net.IP {
+	addr, ok := ctx.RemoteAddr().(*net.TCPAddr)
+	if ok && !t.contains(addr.IP) {
+		return addr.IP
+	}
+	ip := net.IPv4zero
+	if ok {
+		ip = addr.IP
+	}
+
+	// Cloudflare сам выставляет CF-Connecting-IP, а X-Real-IP от клиента передает как есть
+	if ok && cloudflareProxies.contains(ip) {
+		if cfIp := parseIP(ctx.Request.Header.Peek("CF-Connecting-IP")); cfIp != nil {
+			return cfIp
+		}
+	} else if realIp := parseIP(ctx.Request.Header.Peek("X-Real-IP")); realIp != nil {
+		// nginx из conf/nginx.conf выставляет X-Real-IP
+		if ip = realIp; !t.contains(ip) {
+			return ip
+		}
+	}
+
+	forwarded := ctx.Request.Header.Peek(fasthttp.HeaderXForwardedFor)
+	for len(forwarded) > 0 {
+		var hop []byte
+		if idx := bytes.LastIndexByte(forwarded, ','); idx != -1 {
+			hop, forwarded = forwarded[idx+1:], forwarded[:idx]
+		} else {
+			hop, forwarded = forwarded, nil
+		}
+		forwardedIp := parseIP(hop)
+		if forwardedIp == nil {
+			break
+		}
+		if ip = forwardedIp; !t.contains(ip) {
+			return ip
+		}
+	}
+
+	// Последний известный адрес - Cloudflare, он передает ip клиента отдельным заголовком
+	if cloudflareProxies.contains(ip) {
+		if cfIp := parseIP(ctx.Request.Header.Peek("CF-Connecting-IP")); cfIp != nil {
+			return cfIp
+		}
+	}
+	return ip
+}
+
+func parseIP(b []byte) net.IP {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil
+	}
+	return net.ParseIP(string(b))
+}
+
+func mustTrustedProxies(spec string) *trustedProxies {
+	t := &trustedProxies{}
+	if err := t.Set(spec); err != nil {
+		panic(err)
+	}
+	return t
+}
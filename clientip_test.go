@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestTrustedProxiesResolve(t *testing.T) {
+	trusted := mustTrustedProxies("loopback,10.0.0.0/8,cloudflare")
+	tcp := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+	}
+	unix := &net.UnixAddr{Name: "/run/vk-proxy.sock", Net: "unix"}
+
+	for _, test := range []struct {
+		name    string
+		peer    net.Addr
+		headers map[string]string
+		ip      string
+	}{
+		{"direct", tcp("1.2.3.4"), nil, "1.2.3.4"},
+		{"direct ignores headers", tcp("1.2.3.4"), map[string]string{
+			"X-Real-IP": "5.5.5.5", "X-Forwarded-For": "5.5.5.5", "CF-Connecting-IP": "5.5.5.5",
+		}, "1.2.3.4"},
+		{"trusted without headers", tcp("127.0.0.1"), nil, "127.0.0.1"},
+		{"nginx real ip", tcp("127.0.0.1"), map[string]string{"X-Real-IP": "1.2.3.4"}, "1.2.3.4"},
+		{"invalid real ip", tcp("127.0.0.1"), map[string]string{"X-Real-IP": "garbage"}, "127.0.0.1"},
+		{"trusted xff chain", tcp("127.0.0.1"), map[string]string{
+			"X-Forwarded-For": "1.2.3.4, 10.0.0.2, 10.0.0.1",
+		}, "1.2.3.4"},
+		{"untrusted hop in xff chain", tcp("127.0.0.1"), map[string]string{
+			"X-Forwarded-For": "5.5.5.5, 1.2.3.4, 10.0.0.1",
+		}, "1.2.3.4"},
+		{"invalid hop in xff chain", tcp("127.0.0.1"), map[string]string{
+			"X-Forwarded-For": "1.2.3.4, garbage, 10.0.0.1",
+		}, "10.0.0.1"},
+		{"real ip then xff", tcp("127.0.0.1"), map[string]string{
+			"X-Real-IP": "10.0.0.1", "X-Forwarded-For": "1.2.3.4",
+		}, "1.2.3.4"},
+		{"cloudflare", tcp("173.245.48.1"), map[string]string{"CF-Connecting-IP": "1.2.3.4"}, "1.2.3.4"},
+		{"spoofed real ip through cloudflare", tcp("173.245.48.1"), map[string]string{
+			"X-Real-IP": "5.5.5.5", "CF-Connecting-IP": "1.2.3.4",
+		}, "1.2.3.4"},
+		{"spoofed real ip through cloudflare without cf header", tcp("173.245.48.1"), map[string]string{
+			"X-Real-IP": "5.5.5.5", "X-Forwarded-For": "5.5.5.5, 1.2.3.4",
+		}, "1.2.3.4"},
+		{"nginx behind cloudflare", tcp("127.0.0.1"), map[string]string{
+			"X-Real-IP": "173.245.48.1", "CF-Connecting-IP": "1.2.3.4",
+		}, "1.2.3.4"},
+		{"cf header from untrusted hop", tcp("127.0.0.1"), map[string]string{
+			"X-Real-IP": "5.5.5.5", "CF-Connecting-IP": "1.2.3.4",
+		}, "5.5.5.5"},
+		{"unix socket", unix, map[string]string{"X-Real-IP": "1.2.3.4"}, "1.2.3.4"},
+		{"unix socket xff", unix, map[string]string{"X-Forwarded-For": "1.2.3.4, 127.0.0.1"}, "1.2.3.4"},
+		{"unix socket without headers", unix, nil, "0.0.0.0"},
+	} {
+		var req fasthttp.Request
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+		var ctx fasthttp.RequestCtx
+		ctx.Init(&req, test.peer, nil)
+		if ip := trusted.resolve(&ctx); !ip.Equal(net.ParseIP(test.ip)) {
+			t.Errorf("%s: resolved %s, expected %s", test.name, ip, test.ip)
+		}
+	}
+}
+
+func TestTrustedProxiesSet(t *testing.T) {
+	var trusted trustedProxies
+	if err := trusted.Set("loopback, 192.168.1.1, ::2"); err != nil {
+		t.Fatal(err)
+	}
+	for ip, expected := range map[string]bool{
+		"127.0.0.5": true, "::1": true, "192.168.1.1": true, "192.168.1.2": false, "::2": true, "8.8.8.8": false,
+	} {
+		if trusted.contains(net.ParseIP(ip)) != expected {
+			t.Errorf("contains(%s) must be %t", ip, expected)
+		}
+	}
+	if err := trusted.Set("nonsense"); err == nil {
+		t.Error("invalid trusted proxy must fail")
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func listenTest(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// Апстрим, до которого подключаются через внешний прокси
+func startTestTarget(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("target " + string(ctx.Host()))
+	})
+	return ln.Addr().String()
+}
+
+func pipeConns(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+	}()
+	io.Copy(b, a)
+	b.Close()
+}
+
+// Минимальный SOCKS5 сервер (RFC 1928, RFC 1929) с авторизацией по логину и паролю, если user не пустой
+type testSocks5 struct {
+	user, password string
+
+	lock      sync.Mutex
+	requested []string
+}
+
+func (s *testSocks5) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || header[0] != 5 {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return
+	}
+	method := byte(0)
+	if s.user != "" {
+		method = 2
+	}
+	if !strings.ContainsRune(string(methods), rune(method)) {
+		conn.Write([]byte{5, 0xff})
+		return
+	}
+	conn.Write([]byte{5, method})
+	if method == 2 {
+		readString := func() string {
+			length, _ := r.ReadByte()
+			b := make([]byte, length)
+			io.ReadFull(r, b)
+			return string(b)
+		}
+		r.ReadByte()
+		user, password := readString(), readString()
+		if user != s.user || password != s.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	var request [4]byte
+	if _, err := io.ReadFull(r, request[:]); err != nil || request[1] != 1 {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case 3:
+		length, _ := r.ReadByte()
+		name := make([]byte, length)
+		io.ReadFull(r, name)
+		host = string(name)
+	default:
+		return
+	}
+	var port [2]byte
+	io.ReadFull(r, port[:])
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	s.lock.Lock()
+	s.requested = append(s.requested, addr)
+	s.lock.Unlock()
+
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	pipeConns(&bufferedConn{Conn: conn, r: r}, target)
+}
+
+// HTTP прокси, который понимает только CONNECT. Если status не 200, то отвечает им на любой запрос.
+type testHttpConnect struct {
+	auth   string
+	status int
+
+	lock      sync.Mutex
+	requested []string
+}
+
+func (s *testHttpConnect) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	s.lock.Lock()
+	s.requested = append(s.requested, req.Host)
+	s.lock.Unlock()
+	if s.auth != "" && req.Header.Get("Proxy-Authorization") != "Basic "+s.auth {
+		conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+		return
+	}
+	if s.status != 0 && s.status != 200 {
+		conn.Write([]byte("HTTP/1.1 " + strconv.Itoa(s.status) + " Rejected\r\nContent-Length: 0\r\n\r\n"))
+		return
+	}
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	pipeConns(&bufferedConn{Conn: conn, r: r}, target)
+}
+
+func getThrough(dial fasthttp.DialFunc, addr string) (string, error) {
+	client := &fasthttp.Client{Dial: dial}
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(res)
+	req.SetRequestURI("http://" + addr + "/")
+	if err := client.DoTimeout(req, res, 5*time.Second); err != nil {
+		return "", err
+	}
+	return string(res.Body()), nil
+}
+
+func TestSocks5Egress(t *testing.T) {
+	target := startTestTarget(t)
+	server := &testSocks5{user: "user", password: "p@ss"}
+	proxyAddr := listenTest(t, server.serve)
+
+	dial, err := newEgressDialer("socks5://user:p%40ss@" + proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := getThrough(dial, target); err != nil || body != "target "+target {
+		t.Fatalf("request through socks5 got %q, %v", body, err)
+	}
+	if len(server.requested) != 1 || server.requested[0] != target {
+		t.Errorf("socks5 server was asked for %v, expected %s", server.requested, target)
+	}
+
+	dial, err = newEgressDialer("socks5://user:wrong@" + proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = getThrough(dial, target); err == nil {
+		t.Error("wrong socks5 password must fail")
+	}
+}
+
+func TestHttpConnectEgress(t *testing.T) {
+	target := startTestTarget(t)
+	server := &testHttpConnect{auth: base64.StdEncoding.EncodeToString([]byte("user:p@ss"))}
+	proxyAddr := listenTest(t, server.serve)
+
+	dial, err := newEgressDialer("http://user:p%40ss@" + proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := getThrough(dial, target); err != nil || body != "target "+target {
+		t.Fatalf("request through http proxy got %q, %v", body, err)
+	}
+	if len(server.requested) != 1 || server.requested[0] != target {
+		t.Errorf("http proxy was asked for %v, expected %s", server.requested, target)
+	}
+
+	dial, _ = newEgressDialer("http://" + proxyAddr)
+	if _, err = dial(target); err == nil || !strings.Contains(err.Error(), "CONNECT status code 407") {
+		t.Errorf("request without credentials must fail with 407, got %v", err)
+	}
+
+	rejecting := &testHttpConnect{status: fasthttp.StatusForbidden}
+	dial, _ = newEgressDialer("http://" + listenTest(t, rejecting.serve))
+	if _, err = dial(target); err == nil || !strings.Contains(err.Error(), "CONNECT status code 403") {
+		t.Errorf("rejected CONNECT must fail with 403, got %v", err)
+	}
+}
+
+func TestEgressDialerErrors(t *testing.T) {
+	for _, egress := range []string{"ftp://host:21", "socks5://", "http://user:secret@[::1", "host:8080"} {
+		_, err := newEgressDialer(egress)
+		if err == nil {
+			t.Errorf("egress %q must be invalid", egress)
+		} else if strings.Contains(err.Error(), "secret") {
+			t.Errorf("error for egress %q contains password: %s", egress, err)
+		}
+	}
+}
+
+// Пока тело не отдается клиенту потоком, дедлайн на чтение общий для всего ответа. После startIdle он
+// продлевается после каждого прочитанного куска, так что медленная, но живая передача не обрывается, а зависшая
+// обрывается.
+func TestIdleTimeoutConn(t *testing.T) {
+	const timeout, chunks = 100 * time.Millisecond, 5
+	target := listenTest(t, func(conn net.Conn) {
+		for i := 0; i < chunks; i++ {
+			time.Sleep(timeout * 2 / 3)
+			conn.Write([]byte{'x'})
+		}
+		time.Sleep(timeout * 3)
+	})
+	server := &testHttpConnect{}
+	proxyAddr := listenTest(t, server.serve)
+	egress, err := newEgressDialer("http://" + proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, dial := range map[string]fasthttp.DialFunc{"direct": dialIdleTimeout, "egress": egress} {
+		for _, idle := range []bool{false, true} {
+			conn, err := dial(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			conn.SetReadDeadline(start.Add(timeout))
+			if idle {
+				conn.LocalAddr().(*idleTimeoutAddr).conn.startIdle()
+			}
+			buf := make([]byte, 1)
+			read := 0
+			for ; read < chunks; read++ {
+				if _, err = conn.Read(buf); err != nil {
+					break
+				}
+			}
+			if idle && read != chunks {
+				t.Errorf("%s: idle read of chunk %d after %s: %s", name, read, time.Since(start), err)
+			} else if !idle && read == chunks {
+				t.Errorf("%s: read without idle mode must time out after %s", name, timeout)
+			}
+			if idle {
+				_, err = conn.Read(buf)
+			}
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				t.Errorf("%s: stalled read must time out, got %v", name, err)
+			}
+			conn.Close()
+		}
+	}
+}
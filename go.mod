@@ -1,18 +1,21 @@
 module github.com/xtrafrancyz/vk-proxy
 
-go 1.17
+go 1.20
 
 require (
 	github.com/json-iterator/go v1.1.12
 	github.com/phuslu/iploc v1.0.20211029
 	github.com/valyala/bytebufferpool v1.0.0
-	github.com/valyala/fasthttp v1.34.0
+	github.com/valyala/fasthttp v1.51.0
 	github.com/vharitonsky/iniflags v0.0.0-20180513140207-a33cd0b5f3de
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.21.0
 )
 
 require (
-	github.com/andybalholm/brotli v1.0.4 // indirect
-	github.com/klauspost/compress v1.15.0 // indirect
+	github.com/andybalholm/brotli v1.0.5 // indirect
+	github.com/klauspost/compress v1.17.0 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180228061459-e0a39a4cb421 // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
+	golang.org/x/text v0.21.0 // indirect
 )
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Сокеты, полученные от systemd (socket activation) или от предыдущего процесса при обновлении по SIGUSR2
+type inheritedListeners struct {
+	names     []string
+	listeners []net.Listener
+	// Сокеты переданы предыдущим процессом, которому нужно сообщить о запуске
+	fromUpgrade bool
+	parentPid   int
+}
+
+func (l *inheritedListeners) take(lc listenerConfig) net.Listener {
+	if l == nil {
+		return nil
+	}
+	for i, ln := range l.listeners {
+		if ln != nil && (l.names[i] == lc.address || lc.matches(ln)) {
+			l.listeners[i] = nil
+			// Сокетами от systemd управляет systemd, а файл от предыдущего процесса теперь наш
+			if ul, ok := ln.(*net.UnixListener); ok && l.fromUpgrade {
+				ul.SetUnlinkOnClose(true)
+			}
+			return ln
+		}
+	}
+	return nil
+}
+
+// Закрывает сокеты, которые не нужны по текущему конфигу, и сообщает предыдущему процессу, что можно завершаться
+func (l *inheritedListeners) release() {
+	if l == nil {
+		return
+	}
+	for i, ln := range l.listeners {
+		if ln != nil {
+			ln.Close()
+			l.listeners[i] = nil
+		}
+	}
+	if l.fromUpgrade {
+		notifyUpgradeParent(l.parentPid)
+	}
+}
+
+// Shutdown перестает принимать новые соединения и ждет завершения активных запросов, но не дольше timeout.
+// Перед этим /readyz в течение drainDelay отвечает ошибкой, чтобы балансировщик успел убрать прокси.
+func (p *Proxy) Shutdown(drainDelay, timeout time.Duration) error {
+	p.draining.Store(true)
+	time.Sleep(drainDelay)
+	// Служебные серверы не дожидаются своих запросов, их сокеты после обновления принимает новый процесс
+	p.listenersLock.Lock()
+	for _, l := range p.serviceListeners {
+		l.ln.Close()
+	}
+	p.listenersLock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := p.server.ShutdownWithContext(ctx)
+	if h2err := p.shutdownHttp2(ctx); err == nil {
+		err = h2err
+	}
+	if p.getConfig().LogVerbosity > 0 {
+		p.tracker.flush()
+	}
+	if p.accessLog != nil {
+		p.accessLog.close()
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	healthPath = "/healthz"
+	readyPath  = "/readyz"
+
+	// Доля успешных запросов к апстриму считается за последнюю минуту по 10 секунд
+	upstreamStatsBucket  = 10 * time.Second
+	upstreamStatsBuckets = 6
+)
+
+type upstreamCounts struct {
+	ok     uint64
+	failed uint64
+}
+
+// Успешные и неудачные запросы к апстримам в скользящем окне для /readyz
+type upstreamStats struct {
+	lock  sync.Mutex
+	hosts map[string]*[upstreamStatsBuckets]upstreamCounts
+	// Номер текущего интервала с начала эпохи, по нему устаревшие интервалы обнуляются
+	epochs map[string]*[upstreamStatsBuckets]int64
+}
+
+func newUpstreamStats() *upstreamStats {
+	return &upstreamStats{
+		hosts:  make(map[string]*[upstreamStatsBuckets]upstreamCounts),
+		epochs: make(map[string]*[upstreamStatsBuckets]int64),
+	}
+}
+
+func (s *upstreamStats) report(host string, failed bool) {
+	epoch := time.Now().UnixNano() / int64(upstreamStatsBucket)
+	i := epoch % upstreamStatsBuckets
+	s.lock.Lock()
+	counts := s.hosts[host]
+	if counts == nil {
+		counts = &[upstreamStatsBuckets]upstreamCounts{}
+		s.hosts[host] = counts
+		s.epochs[host] = &[upstreamStatsBuckets]int64{}
+	}
+	if epochs := s.epochs[host]; epochs[i] != epoch {
+		epochs[i] = epoch
+		counts[i] = upstreamCounts{}
+	}
+	if failed {
+		counts[i].failed++
+	} else {
+		counts[i].ok++
+	}
+	s.lock.Unlock()
+}
+
+type upstreamHealth struct {
+	Host        string  `json:"host"`
+	Requests    uint64  `json:"requests"`
+	SuccessRate float64 `json:"success_rate"`
+}
+
+func (s *upstreamStats) snapshot() []upstreamHealth {
+	oldest := time.Now().UnixNano()/int64(upstreamStatsBucket) - upstreamStatsBuckets + 1
+	s.lock.Lock()
+	result := make([]upstreamHealth, 0, len(s.hosts))
+	for host, counts := range s.hosts {
+		var total upstreamCounts
+		for i, epoch := range s.epochs[host] {
+			if epoch >= oldest {
+				total.ok += counts[i].ok
+				total.failed += counts[i].failed
+			}
+		}
+		if requests := total.ok + total.failed; requests > 0 {
+			result = append(result, upstreamHealth{
+				Host:        host,
+				Requests:    requests,
+				SuccessRate: float64(total.ok) / float64(requests),
+			})
+		}
+	}
+	s.lock.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Host < result[j].Host
+	})
+	return result
+}
+
+// Отвечает на /healthz и /readyz. Эти запросы не уходят в вк, не проверяют ключ доступа и не попадают
+// в статистику.
+func (p *Proxy) handleHealth(ctx *fasthttp.RequestCtx) bool {
+	isHealth := string(ctx.Path()) == healthPath
+	if !isHealth && string(ctx.Path()) != readyPath {
+		return false
+	}
+	ctx.Response.Header.Set(fasthttp.HeaderCacheControl, "no-store")
+	if isHealth {
+		p.writeJson(ctx, map[string]string{"status": "ok"})
+		return true
+	}
+
+	status := "ok"
+	listeners := make(map[string]string)
+	listening := 0
+	p.listenersLock.Lock()
+	for _, l := range p.listeners {
+		if l.stopped.Load() {
+			listeners[l.config.String()] = "stopped"
+		} else {
+			listeners[l.config.String()] = "listening"
+			listening++
+		}
+	}
+	p.listenersLock.Unlock()
+	if p.draining.Load() {
+		status = "draining"
+	} else if listening == 0 {
+		status = "not listening"
+	}
+	if status != "ok" {
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+	}
+	p.writeJson(ctx, map[string]interface{}{
+		"status":    status,
+		"listeners": listeners,
+		"upstreams": p.upstreamStats.snapshot(),
+	})
+	return true
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func proxyMetricsText(p *Proxy) string {
+	ctx := &fasthttp.RequestCtx{}
+	p.HandleMetrics(ctx)
+	return string(ctx.Response.Body())
+}
+
+type readyStatus struct {
+	Status    string            `json:"status"`
+	Listeners map[string]string `json:"listeners"`
+	Upstreams []upstreamHealth  `json:"upstreams"`
+}
+
+func getReady(t *testing.T, client *fasthttp.Client) (int, readyStatus) {
+	t.Helper()
+	res := doTestRequest(t, client, "http://proxy.test"+readyPath, nil)
+	var status readyStatus
+	if err := json.Unmarshal(res.Body(), &status); err != nil {
+		t.Fatalf("%s: %s", res.Body(), err)
+	}
+	return res.StatusCode(), status
+}
+
+// На /healthz и /readyz отвечает сам прокси: они не уходят в вк и не считаются ни в статистике, ни в метриках,
+// ни в логе запросов
+func TestHealthLocal(t *testing.T) {
+	var served atomic.Int32
+	p, client := newTestProxy(t, ProxyConfig{LogVerbosity: 1}, func(ctx *fasthttp.RequestCtx) {
+		served.Add(1)
+	})
+	p.EnableMetrics()
+	accessLogFile := filepath.Join(t.TempDir(), "access.log")
+	if err := p.EnableAccessLog(AccessLogConfig{File: accessLogFile, Format: accessLogFormatLogfmt}); err != nil {
+		t.Fatal(err)
+	}
+
+	res := doTestRequest(t, client, "http://proxy.test"+healthPath, nil)
+	if res.StatusCode() != 200 || strings.TrimSpace(string(res.Body())) != "{\n  \"status\": \"ok\"\n}" {
+		t.Errorf("%s got %d %q", healthPath, res.StatusCode(), res.Body())
+	}
+	if string(res.Header.Peek(fasthttp.HeaderCacheControl)) != "no-store" {
+		t.Errorf("%s is cacheable", healthPath)
+	}
+	getReady(t, client)
+	// Путь проверяется целиком
+	doTestRequest(t, client, "http://proxy.test"+healthPath+"/x", nil)
+
+	if served.Load() != 1 {
+		t.Errorf("%d requests reached upstream, expected only %s/x", served.Load(), healthPath)
+	}
+	p.accessLog.out.close()
+	data, err := os.ReadFile(accessLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 ||
+		!strings.Contains(lines[0], "path="+healthPath+"/x") {
+		t.Errorf("access log contains %q", data)
+	}
+	waitFor(t, "request stats", func() bool {
+		requests, _, _ := p.tracker.snapshot()
+		return requests == 1
+	})
+	if metrics := proxyMetricsText(p); strings.Count(metrics, "vkproxy_requests_total{") != 1 ||
+		!strings.Contains(metrics, `vkproxy_requests_total{host="files.test",code="200"} 1`) {
+		t.Errorf("health requests in metrics:\n%s", metrics)
+	}
+	if upstreams := p.upstreamStats.snapshot(); len(upstreams) != 1 || upstreams[0].Requests != 1 {
+		t.Errorf("upstream stats %+v", upstreams)
+	}
+}
+
+func TestReadyDraining(t *testing.T) {
+	p, client := newTestProxy(t, ProxyConfig{}, func(ctx *fasthttp.RequestCtx) {})
+
+	if status, ready := getReady(t, client); status != 503 || ready.Status != "not listening" {
+		t.Errorf("without listeners got %d %+v", status, ready)
+	}
+
+	listener := &proxyListener{config: listenerConfig{address: "127.0.0.1:8881"}}
+	p.listenersLock.Lock()
+	p.listeners = append(p.listeners, listener)
+	p.listenersLock.Unlock()
+	doTestRequest(t, client, "http://proxy.test/a.jpg", nil)
+	status, ready := getReady(t, client)
+	if status != 200 || ready.Status != "ok" || ready.Listeners[listener.config.String()] != "listening" {
+		t.Errorf("got %d %+v", status, ready)
+	}
+	if len(ready.Upstreams) != 1 || ready.Upstreams[0].Host != "files.test" || ready.Upstreams[0].SuccessRate != 1 {
+		t.Errorf("upstreams %+v", ready.Upstreams)
+	}
+
+	listener.stopped.Store(true)
+	if status, ready = getReady(t, client); status != 503 || ready.Listeners[listener.config.String()] != "stopped" {
+		t.Errorf("with stopped listener got %d %+v", status, ready)
+	}
+	listener.stopped.Store(false)
+
+	// Пока идет drainDelay, сервер еще отвечает, но /readyz уже сообщает балансировщику об остановке
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- p.Shutdown(time.Second, time.Second)
+	}()
+	waitFor(t, "draining", p.draining.Load)
+	if status, ready = getReady(t, client); status != 503 || ready.Status != "draining" {
+		t.Errorf("while draining got %d %+v", status, ready)
+	}
+	if res := doTestRequest(t, client, "http://proxy.test"+healthPath, nil); res.StatusCode() != 200 {
+		t.Errorf("%s while draining got %d", healthPath, res.StatusCode())
+	}
+	if err := <-shutdown; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	// Тела запросов больше этого размера или без Content-Length передаются в апстрим потоком, так же как
+	// с StreamRequestBody у fasthttp сервера
+	maxBufferedRequestBody = 1 << 20
+
+	// Ключ в UserValue, под которым openTunnel оставляет pendingTunnel для net/http сервера
+	tunnelHandlerKey = "vk-proxy.tunnel"
+	// Ключ в UserValue, которым отмечены запросы от net/http сервера, см. serverConn
+	netHttpRequestKey = "vk-proxy.net-http"
+)
+
+// Заголовки ответа, которые net/http выставляет сам
+var http2SkipResponseHeaders = map[string]bool{
+	fasthttp.HeaderContentLength:    true,
+	fasthttp.HeaderConnection:       true,
+	fasthttp.HeaderTransferEncoding: true,
+	fasthttp.HeaderDate:             true,
+}
+
+var netHttpConnStates = map[http.ConnState]fasthttp.ConnState{
+	http.StateNew:      fasthttp.StateNew,
+	http.StateActive:   fasthttp.StateActive,
+	http.StateIdle:     fasthttp.StateIdle,
+	http.StateHijacked: fasthttp.StateHijacked,
+	http.StateClosed:   fasthttp.StateClosed,
+}
+
+// fasthttp не умеет HTTP/2, поэтому адреса с +h2 обслуживает net/http сервер. На TLS адресе протокол выбирается
+// через ALPN, без TLS принимается h2c (prior knowledge и Upgrade: h2c). HTTP/1.1 на таком адресе тоже работает.
+// Каждый запрос перекладывается в fasthttp.RequestCtx и обрабатывается тем же handleProxy.
+func (p *Proxy) newHttp2Server(lc listenerConfig) (*http.Server, error) {
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.serveHttp(lc, w, r)
+	}))
+	h2 := &http2.Server{}
+	if !lc.tls {
+		handler = h2c.NewHandler(handler, h2)
+	}
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       1 * time.Minute,
+		// Ошибки рукопожатия и битые запросы от клиентов не нужны в логе
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	if p.conns != nil {
+		srv.ConnState = func(conn net.Conn, state http.ConnState) {
+			p.conns.track(conn, netHttpConnStates[state])
+		}
+	}
+	if lc.tls {
+		srv.TLSConfig = p.listenerTLSConfig(true)
+		if err := http2.ConfigureServer(srv, h2); err != nil {
+			return nil, err
+		}
+	}
+	return srv, nil
+}
+
+// TLS конфиг листенера с протоколами для ALPN. autocert по умолчанию предлагает h2, но fasthttp его не понимает.
+func (p *Proxy) listenerTLSConfig(h2 bool) *tls.Config {
+	config := p.tlsConfig.Clone()
+	protos := make([]string, 0, len(config.NextProtos)+2)
+	if h2 {
+		protos = append(protos, http2.NextProtoTLS)
+	}
+	for _, proto := range config.NextProtos {
+		if proto != http2.NextProtoTLS && proto != "http/1.1" {
+			protos = append(protos, proto)
+		}
+	}
+	config.NextProtos = append(protos, "http/1.1")
+	return config
+}
+
+func (p *Proxy) serveHttp(lc listenerConfig, w http.ResponseWriter, r *http.Request) {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&fasthttp.Request{}, remoteAddr(lc, r.RemoteAddr), nil)
+	ctx.SetUserValue(netHttpRequestKey, true)
+	req := &ctx.Request
+	req.Header.SetMethod(r.Method)
+	req.SetRequestURI(r.RequestURI)
+	req.Header.SetHost(r.Host)
+	for name, values := range r.Header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if r.ContentLength > 0 && r.ContentLength <= maxBufferedRequestBody {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		req.SetBody(body)
+	} else if r.ContentLength != 0 {
+		req.SetBodyStream(r.Body, int(r.ContentLength))
+	}
+
+	p.handleProxy(ctx)
+
+	res := &ctx.Response
+	if ctx.Hijacked() {
+		p.hijackHttp(ctx, w)
+		return
+	}
+	res.Header.VisitAll(func(key, value []byte) {
+		if name := string(key); !http2SkipResponseHeaders[name] {
+			w.Header().Add(name, string(value))
+		}
+	})
+	if len(res.Header.Server()) == 0 {
+		w.Header().Set(fasthttp.HeaderServer, string(vkProxyName))
+	}
+	if !res.IsBodyStream() {
+		w.Header().Set(fasthttp.HeaderContentLength, strconv.Itoa(len(res.Body())))
+	} else if size := res.Header.ContentLength(); size >= 0 {
+		w.Header().Set(fasthttp.HeaderContentLength, strconv.Itoa(size))
+	}
+	w.WriteHeader(res.StatusCode())
+	// Закрывает тело потока, даже если клиент уже отключился
+	res.BodyWriteTo(w)
+}
+
+// Апстрим принял Upgrade (WebSocket по HTTP/1.1): ответ 101 пишется в соединение клиента, дальше работает
+// обработчик туннеля из openTunnel
+func (p *Proxy) hijackHttp(ctx *fasthttp.RequestCtx, w http.ResponseWriter) {
+	tunnel := ctx.UserValue(tunnelHandlerKey).(*pendingTunnel)
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		// В HTTP/2 апгрейда нет, сюда можно попасть только по ошибке
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		tunnel.abort()
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		if _, err = ctx.Response.Header.WriteTo(rw); err == nil {
+			err = rw.Flush()
+		}
+		if err != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		tunnel.abort()
+		return
+	}
+	tunnel.run(&bufferedConn{Conn: conn, r: rw.Reader})
+}
+
+// Соединение, из которого net/http мог уже прочитать часть данных в свой буфер
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Адрес клиента для RequestCtx. Для unix сокета нужен не *net.TCPAddr, чтобы заголовкам с ip доверялось так же,
+// как на fasthttp сервере.
+func remoteAddr(lc listenerConfig, addr string) net.Addr {
+	if lc.unix {
+		return &net.UnixAddr{Name: addr, Net: "unix"}
+	}
+	if addrPort, err := netip.ParseAddrPort(addr); err == nil {
+		return net.TCPAddrFromAddrPort(addrPort)
+	}
+	return nil
+}
+
+// Останавливает net/http серверы адресов с +h2
+func (p *Proxy) shutdownHttp2(ctx context.Context) error {
+	p.listenersLock.Lock()
+	servers := p.http2Servers
+	p.listenersLock.Unlock()
+	var result error
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			result = err
+		}
+	}
+	return result
+}
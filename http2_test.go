@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/http2"
+)
+
+// net/http сервер адреса с +h2 перед прокси, который отправляет запросы в upstream
+func newTestHttp2Server(t *testing.T, config ProxyConfig, upstream fasthttp.RequestHandler) (*Proxy, *httptest.Server) {
+	t.Helper()
+	p, _ := newTestProxy(t, config, upstream)
+	lc, _ := parseListenerConfig("127.0.0.1:0+h2")
+	srv, err := p.newHttp2Server(lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv.Handler)
+	t.Cleanup(ts.Close)
+	return p, ts
+}
+
+// HTTP/2 без TLS сразу с preface, без Upgrade: h2c
+func h2cPriorKnowledgeClient() *http.Client {
+	return &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+}
+
+func TestHttp2PriorKnowledge(t *testing.T) {
+	_, ts := newTestHttp2Server(t, ProxyConfig{}, func(ctx *fasthttp.RequestCtx) {
+		ctx.Response.Header.Set("X-Upstream", "yes")
+		ctx.SetBodyString(string(ctx.Method()) + " " + string(ctx.Path()) + " " + string(ctx.PostBody()))
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/file", strings.NewReader("x=1"))
+	req.Host = "proxy.test"
+	res, err := h2cPriorKnowledgeClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ProtoMajor != 2 {
+		t.Errorf("response over %s, expected HTTP/2", res.Proto)
+	}
+	if string(body) != "POST /file x=1" {
+		t.Errorf("unexpected body %q", body)
+	}
+	if res.Header.Get("X-Upstream") != "yes" {
+		t.Error("upstream header is lost")
+	}
+	if res.Header.Get(fasthttp.HeaderContentLength) != strconv.Itoa(len(body)) {
+		t.Errorf("Content-Length %q for body of %d bytes", res.Header.Get(fasthttp.HeaderContentLength), len(body))
+	}
+}
+
+// Тело запроса без длины уходит в апстрим потоком, ответ без длины приходит клиенту потоком
+func TestHttp2StreamedBody(t *testing.T) {
+	body := strings.Repeat("0123456789", 50000)
+	p, ts := newTestHttp2Server(t, ProxyConfig{LogVerbosity: 1}, func(ctx *fasthttp.RequestCtx) {
+		received := strconv.Itoa(len(ctx.PostBody()))
+		ctx.Response.Header.Set("X-Received", received)
+		ctx.SetBodyStream(strings.NewReader(body), -1)
+	})
+
+	reader, writer := io.Pipe()
+	go func() {
+		for i := 0; i < 100; i++ {
+			writer.Write([]byte("0123456789"))
+		}
+		writer.Close()
+	}()
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/big", reader)
+	req.Host = "proxy.test"
+	res, err := h2cPriorKnowledgeClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Header.Get("X-Received") != "1000" {
+		t.Errorf("upstream received %s bytes, expected 1000", res.Header.Get("X-Received"))
+	}
+	if string(got) != body {
+		t.Fatalf("unexpected body of %d bytes", len(got))
+	}
+	waitFor(t, "request stats", func() bool {
+		requests, _, _ := p.tracker.snapshot()
+		return requests == 1
+	})
+	if _, bytes, _ := p.tracker.snapshot(); bytes != uint64(len(body)) {
+		t.Errorf("tracked %d bytes, expected %d", bytes, len(body))
+	}
+}
+
+// Апстрим принимает Upgrade, после 101 данные идут через туннель в обе стороны
+func TestHttp2ServerUpgrade(t *testing.T) {
+	p, ts := newTestHttp2Server(t, ProxyConfig{}, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusSwitchingProtocols)
+		ctx.Response.Header.Set(fasthttp.HeaderConnection, "Upgrade")
+		ctx.Response.Header.Set(fasthttp.HeaderUpgrade, "echo")
+		ctx.Hijack(func(conn net.Conn) {
+			io.Copy(conn, conn)
+		})
+	})
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET /echo HTTP/1.1\r\nHost: proxy.test\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get(fasthttp.HeaderUpgrade) != "echo" {
+		t.Fatalf("unexpected response %s, Upgrade: %q", res.Status, res.Header.Get(fasthttp.HeaderUpgrade))
+	}
+
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, 4)
+	if _, err = io.ReadFull(r, echo); err != nil || string(echo) != "ping" {
+		t.Fatalf("tunnel echoed %q, %v", echo, err)
+	}
+	if p.tunnels.active.Load() != 1 {
+		t.Errorf("%d active tunnels, expected 1", p.tunnels.active.Load())
+	}
+	conn.Close()
+	waitFor(t, "tunnel close", func() bool {
+		return p.tunnels.active.Load() == 0
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Описание одного адреса из -bind в формате address[+option...], например:
+//   - :8881
+//   - /var/run/vk-proxy.sock
+//   - :443+tls
+//   - :443+tls+h2
+type listenerConfig struct {
+	address string
+	unix    bool
+	tls     bool
+	// HTTP/2 через net/http сервер вместо fasthttp, см. http2.go
+	h2 bool
+}
+
+type proxyListener struct {
+	config listenerConfig
+	ln     net.Listener
+	// Serve завершился, для /readyz
+	stopped atomic.Bool
+}
+
+func parseListenerConfig(spec string) (listenerConfig, error) {
+	parts := strings.Split(strings.TrimSpace(spec), "+")
+	lc := listenerConfig{
+		address: parts[0],
+		unix:    strings.HasPrefix(parts[0], "/"),
+	}
+	if lc.address == "" {
+		return lc, fmt.Errorf("empty address in bind '%s'", spec)
+	}
+	for _, option := range parts[1:] {
+		switch option {
+		case "tls":
+			lc.tls = true
+		case "h2":
+			lc.h2 = true
+		default:
+			return lc, fmt.Errorf("unknown option '%s' in bind '%s'", option, spec)
+		}
+	}
+	return lc, nil
+}
+
+func parseListenerConfigs(bind string) ([]listenerConfig, error) {
+	var result []listenerConfig
+	for _, spec := range strings.Split(bind, ",") {
+		lc, err := parseListenerConfig(spec)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, lc)
+	}
+	return result, nil
+}
+
+// Проверяет, что уже открытый сокет (например, полученный от systemd) слушает адрес из конфига
+func (lc listenerConfig) matches(ln net.Listener) bool {
+	if lc.unix {
+		addr, ok := ln.Addr().(*net.UnixAddr)
+		return ok && addr.Name == lc.address
+	}
+	addr, ok := ln.Addr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	want, err := net.ResolveTCPAddr("tcp", lc.address)
+	if err != nil || want.Port != addr.Port {
+		return false
+	}
+	return want.IP == nil || want.IP.IsUnspecified() || want.IP.Equal(addr.IP)
+}
+
+func (lc listenerConfig) listen() (net.Listener, error) {
+	if !lc.unix {
+		return net.Listen("tcp4", lc.address)
+	}
+	// Так же, как в fasthttp.Server.ListenAndServeUNIX
+	if err := os.Remove(lc.address); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unexpected error when trying to remove unix socket file %q: %w", lc.address, err)
+	}
+	ln, err := net.Listen("unix", lc.address)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(lc.address, 0777); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("cannot chmod %#o for %q: %w", 0777, lc.address, err)
+	}
+	return ln, nil
+}
+
+func (lc listenerConfig) String() string {
+	scheme := "http"
+	if lc.tls {
+		scheme = "https"
+	}
+	address := lc.address
+	if lc.unix {
+		address = "unix:" + address
+	}
+	if lc.h2 {
+		address += " (h2)"
+	}
+	return scheme + "://" + address
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestParseListenerConfig(t *testing.T) {
+	for _, c := range []struct {
+		spec     string
+		expected listenerConfig
+	}{
+		{":8881", listenerConfig{address: ":8881"}},
+		{" 127.0.0.1:8881 ", listenerConfig{address: "127.0.0.1:8881"}},
+		{":443+tls", listenerConfig{address: ":443", tls: true}},
+		{":443+tls+h2", listenerConfig{address: ":443", tls: true, h2: true}},
+		{":8882+h2", listenerConfig{address: ":8882", h2: true}},
+		{"/var/run/vk-proxy.sock", listenerConfig{address: "/var/run/vk-proxy.sock", unix: true}},
+		{"/var/run/vk-proxy.sock+h2", listenerConfig{address: "/var/run/vk-proxy.sock", unix: true, h2: true}},
+	} {
+		lc, err := parseListenerConfig(c.spec)
+		if err != nil {
+			t.Errorf("parseListenerConfig(%q): %s", c.spec, err)
+		} else if lc != c.expected {
+			t.Errorf("parseListenerConfig(%q) = %+v, expected %+v", c.spec, lc, c.expected)
+		}
+	}
+
+	for _, spec := range []string{"", "+tls", ":443+", ":443+ssl", ":443+TLS"} {
+		if _, err := parseListenerConfig(spec); err == nil {
+			t.Errorf("parseListenerConfig(%q) must fail", spec)
+		}
+	}
+}
+
+func TestParseListenerConfigs(t *testing.T) {
+	listeners, err := parseListenerConfigs(":8881,:443+tls+h2,/tmp/vk-proxy.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []listenerConfig{
+		{address: ":8881"},
+		{address: ":443", tls: true, h2: true},
+		{address: "/tmp/vk-proxy.sock", unix: true},
+	}
+	if len(listeners) != len(expected) {
+		t.Fatalf("got %d listeners, expected %d", len(listeners), len(expected))
+	}
+	for i := range expected {
+		if listeners[i] != expected[i] {
+			t.Errorf("listener %d = %+v, expected %+v", i, listeners[i], expected[i])
+		}
+	}
+
+	if _, err = parseListenerConfigs(":8881,,:8882"); err == nil {
+		t.Error("empty address in the list must fail")
+	}
+}
+
+func TestListenerConfigMatches(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	socket := filepath.Join(t.TempDir(), "vk-proxy.sock")
+	unixLn, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixLn.Close()
+
+	for _, c := range []struct {
+		spec     string
+		ln       net.Listener
+		expected bool
+	}{
+		{":" + port, ln, true},
+		{"127.0.0.1:" + port, ln, true},
+		{"0.0.0.0:" + port, ln, true},
+		{"127.0.0.2:" + port, ln, false},
+		{"127.0.0.1:1", ln, false},
+		{"127.0.0.1:" + port + "+tls", ln, true},
+		{"invalid:address", ln, false},
+		{socket, ln, false},
+		{socket, unixLn, true},
+		{socket + ".other", unixLn, false},
+		{":" + port, unixLn, false},
+	} {
+		lc, err := parseListenerConfig(c.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := lc.matches(c.ln); got != c.expected {
+			t.Errorf("%q matches %s = %v, expected %v", c.spec, c.ln.Addr(), got, c.expected)
+		}
+	}
+}
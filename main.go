@@ -3,57 +3,175 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"os/signal"
 	"runtime"
-	"strings"
+	"syscall"
+	"time"
 
-	"github.com/valyala/fasthttp"
 	"github.com/valyala/fasthttp/pprofhandler"
 	"github.com/vharitonsky/iniflags"
+	"github.com/xtrafrancyz/vk-proxy/bytefmt"
 )
 
 func main() {
 	config := ProxyConfig{}
+	tlsConfig := TLSConfig{}
+	cacheConfig := CacheConfig{DiskSize: bytefmt.GIGABYTE}
+	accessLogConfig := AccessLogConfig{}
 
-	bind := flag.String("bind", ":8881", "address to bind proxy (can be a unix domain socket: /var/run/vk-proxy.sock)")
+	bind := flag.String("bind", ":8881", "comma separated addresses to bind proxy (can be a unix domain socket: /var/run/vk-proxy.sock), add +tls to enable TLS on the address: :443+tls, add +h2 to serve HTTP/2 (h2 over TLS, h2c without it): :443+tls+h2")
 	flag.StringVar(&config.BaseDomain, "domain", "vk-api-proxy.example.com", "domain for the replaces")
 	flag.StringVar(&config.BaseStaticDomain, "domain-static", "vk-static-proxy.example.com", "replacement of the static.vk.com")
 	flag.IntVar(&config.LogVerbosity, "log-verbosity", 1, "0 - only errors, 1 - stats every minute, 2 - all requests, 3 - requests with body")
+	flag.StringVar(&config.LogRedact, "log-redact", logRedactSecrets, "masking of logged paths, errors and bodies: secrets - tokens, passwords, phones and signatures, all - every value, keeping only the JSON structure, none - log everything as is")
 	flag.BoolVar(&config.ReduceMemoryUsage, "reduce-memory-usage", false, "reduces memory usage at the cost of higher CPU usage")
 	flag.BoolVar(&config.FilterFeed, "filter-feed", true, "when enabled, ads from feed will be removed")
 	flag.BoolVar(&config.AddUselessProxyMessage, "useless-proxy-message", false, "add message to feed when proxy is not needed")
 	flag.BoolVar(&config.GzipUpstream, "gzip-upstream", true, "use gzip for requests to api.vk.com")
+	flag.Var(&config.ApiRateLimit, "rate-limit-api", "per client limit for API requests, like rate=20,burst=40,concurrency=8 (no limit by default)")
+	flag.Var(&config.MediaRateLimit, "rate-limit-media", "per client limit for /@, /_/ and VKUI requests, like rate=50,burst=100,concurrency=16")
+	flag.Var(&config.LongpollRateLimit, "rate-limit-longpoll", "per client limit for longpoll requests, like rate=1,burst=5,concurrency=2")
+	config.TrustedProxies.Set(defaultTrustedProxies)
+	flag.Var(&config.TrustedProxies, "trusted-proxies", "comma separated addresses and subnets of proxies in front of vk-proxy, whose client ip headers are trusted; presets: loopback, private, cloudflare")
+	config.MaxBodySize.Set("128M")
+	flag.Var(&config.MaxBodySize, "max-body-size", "largest allowed request body, larger uploads get 413, 0 to disable")
+	flag.StringVar(&config.AccessKeysFile, "access-keys", "", "path to the file with access keys, one per line; when set, clients must pass a key in the /~<key>/ path prefix or X-Proxy-Key header")
+	flag.Var(&cacheConfig.Size, "cache-size", "memory budget for the response cache, like 64M (disabled by default)")
+	flag.StringVar(&cacheConfig.Dir, "cache-dir", "", "directory for the on-disk cache tier, used together with cache-size")
+	flag.Var(&cacheConfig.DiskSize, "cache-disk-size", "size limit of the on-disk cache")
+	flag.StringVar(&config.RoutesFile, "routes", "", "path to the routes file (see routes.json), the built-in routes are used by default")
+	flag.StringVar(&config.RewriteRulesFile, "rewrite-rules", "", "path to the response rewrite rules file (see replacer/rules.json), the built-in rules are used by default")
+	flag.StringVar(&accessLogConfig.File, "access-log", "", "path to the structured access log file (disabled by default)")
+	flag.StringVar(&accessLogConfig.Format, "access-log-format", accessLogFormatJson, "access log format: json or logfmt")
+	flag.StringVar(&accessLogConfig.Fields, "access-log-fields", "", "comma separated access log fields (all by default): "+accessLogFieldNames())
+	accessLogConfig.MaxSize.Set("100M")
+	flag.Var(&accessLogConfig.MaxSize, "access-log-max-size", "rotate the access log when it grows over this size, 0 to disable")
+	flag.DurationVar(&accessLogConfig.MaxAge, "access-log-max-age", 0, "rotate the access log after this time, like 24h (disabled by default)")
+	flag.IntVar(&accessLogConfig.MaxBackups, "access-log-backups", 7, "how many rotated access logs to keep, 0 to keep all")
+	recordDir := flag.String("record-dir", "", "save every upstream exchange with secrets masked to this directory, for debugging replaces")
+	replayDir := flag.String("replay-dir", "", "serve upstream responses recorded with record-dir from this directory instead of calling VK")
+	adminHost := flag.String("admin-bind", "", "address to bind admin API (like 127.0.0.1:7779), requires admin-token")
+	adminToken := flag.String("admin-token", "", "token for the admin API, passed in X-Admin-Token or Authorization: Bearer header")
 	pprofHost := flag.String("pprof-bind", "", "address to bind pprof handler (like 127.0.0.1:7777)")
+	metricsHost := flag.String("metrics-bind", "", "address to bind prometheus metrics handler (like 127.0.0.1:7778)")
+	drainDelay := flag.Duration("drain-delay", 0, "how long /readyz reports draining before shutdown starts, like 5s")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for active requests on shutdown")
+	flag.StringVar(&tlsConfig.CertFile, "tls-cert", "", "path to the TLS certificate file for +tls binds")
+	flag.StringVar(&tlsConfig.KeyFile, "tls-key", "", "path to the TLS private key file for +tls binds")
+	flag.BoolVar(&tlsConfig.ACME, "acme", false, "obtain TLS certificates for domain and domain-static through ACME")
+	flag.StringVar(&tlsConfig.ACMEDirectory, "acme-directory", "https://acme-v02.api.letsencrypt.org/directory", "ACME directory url")
+	flag.StringVar(&tlsConfig.ACMEEmail, "acme-email", "", "contact email for the ACME account")
+	flag.StringVar(&tlsConfig.ACMECacheDir, "acme-cache", "acme-cache", "directory to store ACME account and certificates")
+	flag.StringVar(&tlsConfig.ACMERootCA, "acme-root-ca", "", "additional root CA to trust when connecting to the ACME directory (like pebble.minica.pem)")
 
 	iniflags.Parse()
 
-	if *pprofHost != "" {
-		go func() {
-			log.Printf("Starting pprof server on http://%s", *pprofHost)
-			err := fasthttp.ListenAndServe(*pprofHost, pprofhandler.PprofHandler)
-			if err != nil {
-				log.Fatalf("Could not start pprof server: %s", err)
-			}
-		}()
-	} else {
+	if *pprofHost == "" {
 		runtime.MemProfileRate = 0
 	}
 
-	p := NewProxy(config)
+	listeners, err := parseListenerConfigs(*bind)
+	if err != nil {
+		log.Fatalf("Invalid bind: %s", err)
+	}
 
-	for _, host := range strings.Split(*bind, ",") {
-		go func(host string) {
-			var err error
-			if strings.HasPrefix(host, "/") {
-				err = p.ListenUnix(host)
-			} else {
-				err = p.ListenTCP(host)
-			}
-			if err != nil {
-				log.Printf("Failed to bind listener on %s with %s", host, err.Error())
+	p, err := NewProxy(config)
+	if err != nil {
+		log.Fatalf("Could not create proxy: %s", err)
+	}
+	if *metricsHost != "" {
+		p.EnableMetrics()
+	}
+	if err = p.EnableAccessLog(accessLogConfig); err != nil {
+		log.Fatalf("Could not open access log: %s", err)
+	}
+	if *adminHost != "" {
+		if *adminToken == "" {
+			log.Fatalf("admin-token is required for admin-bind")
+		}
+		p.EnableAdmin(*adminToken)
+	}
+	if *recordDir != "" && *replayDir != "" {
+		log.Fatalf("record-dir and replay-dir can not be used together")
+	}
+	if *recordDir != "" {
+		if err = p.EnableRecording(*recordDir); err != nil {
+			log.Fatalf("Could not setup recording: %s", err)
+		}
+	}
+	if *replayDir != "" {
+		if err = p.EnableReplay(*replayDir); err != nil {
+			log.Fatalf("Could not load recorded exchanges: %s", err)
+		}
+	}
+	if err = p.EnableCache(cacheConfig); err != nil {
+		log.Fatalf("Could not setup cache: %s", err)
+	}
+	if err = p.SetupTLS(tlsConfig); err != nil {
+		log.Fatalf("Could not setup TLS: %s", err)
+	}
+
+	// iniflags перечитывает конфиг по SIGHUP и вызывает колбек для каждого измененного флага
+	configGeneration := iniflags.Generation
+	for _, name := range []string{"domain", "domain-static", "log-verbosity", "log-redact", "filter-feed", "useless-proxy-message", "gzip-upstream", "routes", "rewrite-rules",
+		"rate-limit-api", "rate-limit-media", "rate-limit-longpoll", "trusted-proxies", "access-keys", "max-body-size"} {
+		iniflags.OnFlagChange(name, func() {
+			if configGeneration != iniflags.Generation {
+				configGeneration = iniflags.Generation
+				if err := p.Reconfigure(config); err != nil {
+					log.Printf("Could not apply new configuration: %s", err)
+				}
 			}
-		}(strings.TrimSpace(host))
+		})
+	}
+
+	inherited, err := loadInheritedListeners()
+	if err != nil {
+		log.Fatalf("Could not load inherited sockets: %s", err)
+	}
+	// Пока предыдущий процесс не получил release, его сокеты заняты, поэтому служебные серверы тоже берут их от него
+	if *pprofHost != "" {
+		p.ListenService("pprof", *pprofHost, pprofhandler.PprofHandler, inherited)
+	}
+	if *metricsHost != "" {
+		p.ListenService("metrics", *metricsHost, p.HandleMetrics, inherited)
 	}
+	if *adminHost != "" {
+		p.ListenService("admin", *adminHost, p.HandleAdmin, inherited)
+	}
+	for _, lc := range listeners {
+		if err := p.Listen(lc, inherited); err != nil {
+			log.Printf("Failed to bind listener on %s with %s", lc.address, err.Error())
+		}
+	}
+	// systemd должен узнать новый главный процесс раньше, чем завершится предыдущий
+	notifyReady()
+	inherited.release()
 
-	// Sleep forever
-	select {}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	if upgradeSignal != nil {
+		signal.Notify(signals, upgradeSignal)
+	}
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			if err := p.ReloadFiles(); err != nil {
+				log.Printf("Could not reload files: %s", err)
+			}
+			continue
+		}
+		if sig == upgradeSignal {
+			log.Printf("Received %s, starting new process", sig)
+			if err := p.Upgrade(); err != nil {
+				log.Printf("Could not start new process: %s", err)
+			}
+			continue
+		}
+		log.Printf("Received %s, shutting down", sig)
+		if err := p.Shutdown(*drainDelay, *shutdownTimeout); err != nil {
+			log.Printf("Shutdown finished with %s", err)
+		}
+		return
+	}
 }
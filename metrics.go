@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/xtrafrancyz/vk-proxy/metrics"
+	"github.com/xtrafrancyz/vk-proxy/replacer"
+)
+
+const (
+	errorClassBadRequest   = "bad_request"
+	errorClassForbidden    = "forbidden"
+	errorClassTimeout      = "timeout"
+	errorClassNoConns      = "no_free_conns"
+	errorClassConnection   = "connection"
+	errorClassGunzip       = "gunzip"
+	errorClassPanic        = "panic"
+	errorClassCircuit      = "circuit_open"
+	errorClassRateLimit    = "rate_limited"
+	errorClassAccessDenied = "access_denied"
+	errorClassBodyTooLarge = "body_too_large"
+	errorClassOther        = "other"
+)
+
+var (
+	sizeBuckets = []float64{1 << 10, 8 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+	fastBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1}
+)
+
+type proxyMetrics struct {
+	registry *metrics.Registry
+
+	requests        *metrics.CounterVec
+	requestDuration *metrics.HistogramVec
+	apiRequests     *metrics.CounterVec
+	apiDuration     *metrics.HistogramVec
+	receivedBytes   *metrics.Counter
+	sentBytes       *metrics.CounterVec
+	responseSize    *metrics.HistogramVec
+	gunzipDuration  *metrics.Histogram
+	replaceDuration *metrics.HistogramVec
+	errors          *metrics.CounterVec
+	upstreamRetries *metrics.CounterVec
+	cacheRequests   *metrics.CounterVec
+	keyRequests     *metrics.CounterVec
+	keySentBytes    *metrics.CounterVec
+}
+
+func newProxyMetrics(p *Proxy) *proxyMetrics {
+	server := p.server
+	r := metrics.NewRegistry()
+	m := &proxyMetrics{
+		registry: r,
+
+		requests: r.NewCounterVec("vkproxy_requests_total",
+			"Proxied requests by upstream host and response code.", "host", "code"),
+		requestDuration: r.NewHistogramVec("vkproxy_request_duration_seconds",
+			"Time to proxy a request by upstream host, without streaming the body to the client.",
+			metrics.DefBuckets, "host"),
+		apiRequests: r.NewCounterVec("vkproxy_api_requests_total",
+			"Requests to api.vk.com by API method.", "method"),
+		apiDuration: r.NewHistogramVec("vkproxy_api_request_duration_seconds",
+			"Time to proxy a request to api.vk.com by API method.", metrics.DefBuckets, "method"),
+		receivedBytes: r.NewCounter("vkproxy_received_bytes_total",
+			"Request body bytes received from clients."),
+		sentBytes: r.NewCounterVec("vkproxy_sent_bytes_total",
+			"Response body bytes sent to clients by upstream host.", "host"),
+		responseSize: r.NewHistogramVec("vkproxy_response_size_bytes",
+			"Response body size by upstream host.", sizeBuckets, "host"),
+		gunzipDuration: r.NewHistogram("vkproxy_gunzip_duration_seconds",
+			"Time to gunzip upstream responses before replacing.", fastBuckets),
+		replaceDuration: r.NewHistogramVec("vkproxy_replace_duration_seconds",
+			"Time to apply replaces to responses by upstream host.", fastBuckets, "host"),
+		errors: r.NewCounterVec("vkproxy_errors_total",
+			"Failed requests by error class.", "class"),
+		upstreamRetries: r.NewCounterVec("vkproxy_upstream_retries_total",
+			"Repeated requests to upstream hosts after a failure.", "host"),
+		cacheRequests: r.NewCounterVec("vkproxy_cache_requests_total",
+			"Cacheable requests by result: hit, miss or revalidated.", "result"),
+		keyRequests: r.NewCounterVec("vkproxy_access_key_requests_total",
+			"Requests by access key name.", "key"),
+		keySentBytes: r.NewCounterVec("vkproxy_access_key_sent_bytes_total",
+			"Response body bytes sent to clients by access key name.", "key"),
+	}
+
+	r.NewGaugeFunc("vkproxy_concurrency", "Requests being processed right now.", func() float64 {
+		return float64(server.GetCurrentConcurrency())
+	})
+	r.NewGaugeFunc("vkproxy_open_connections", "Open client connections.", func() float64 {
+		return float64(server.GetOpenConnectionsCount())
+	})
+	r.NewGaugeFunc("vkproxy_upstream_circuits_open", "Upstream hosts that are considered unavailable.", func() float64 {
+		return float64(p.breakers.openCount())
+	})
+	r.NewGaugeFunc("vkproxy_tunnels_active", "Open WebSocket and other upgraded connections.", func() float64 {
+		return float64(p.tunnels.active.Load())
+	})
+	r.NewCounterFunc("vkproxy_tunnels_total", "Upgraded connections opened.", func() float64 {
+		return float64(p.tunnels.total.Load())
+	})
+	r.NewCounterFunc("vkproxy_tunnel_received_bytes_total", "Bytes received from clients through tunnels.", func() float64 {
+		return float64(p.tunnels.received.Load())
+	})
+	r.NewCounterFunc("vkproxy_tunnel_sent_bytes_total", "Bytes sent to clients through tunnels.", func() float64 {
+		return float64(p.tunnels.sent.Load())
+	})
+	r.NewGaugeFunc("vkproxy_cache_entries", "Responses in the memory cache.", func() float64 {
+		if p.cache == nil {
+			return 0
+		}
+		entries, _ := p.cache.stats()
+		return float64(entries)
+	})
+	r.NewGaugeFunc("vkproxy_cache_size_bytes", "Size of the memory cache.", func() float64 {
+		if p.cache == nil {
+			return 0
+		}
+		_, size := p.cache.stats()
+		return float64(size)
+	})
+	r.NewCounterFunc("vkproxy_replace_buffers_acquired_total", "Buffers taken from the replacer buffer pool.", func() float64 {
+		acquired, _ := replacer.BufferPoolStats()
+		return float64(acquired)
+	})
+	r.NewCounterFunc("vkproxy_replace_buffers_released_total", "Buffers returned to the replacer buffer pool.", func() float64 {
+		_, released := replacer.BufferPoolStats()
+		return float64(released)
+	})
+	r.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	r.NewGaugeFunc("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", func() float64 {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return float64(stats.HeapInuse)
+	})
+	return m
+}
+
+func (m *proxyMetrics) trackRequest(s *requestSummary, elapsed time.Duration, size int) {
+	host := hostLabel(s.host)
+	m.requests.With(host, strconv.Itoa(s.status)).Inc()
+	m.requestDuration.With(host).Observe(elapsed.Seconds())
+	// Тело запроса может быть уже отправлено в вк потоком, поэтому считается по заголовку
+	if s.received > 0 {
+		m.receivedBytes.Add(uint64(s.received))
+	}
+	m.sentBytes.With(host).Add(uint64(size))
+	m.responseSize.With(host).Observe(float64(size))
+
+	if host == "api.vk.com" {
+		if method := apiMethodLabel(s.path); method != "" {
+			m.apiRequests.With(method).Inc()
+			m.apiDuration.With(method).Observe(elapsed.Seconds())
+		}
+	}
+}
+
+func (m *proxyMetrics) trackAccessKey(name string, size int) {
+	m.keyRequests.With(name).Inc()
+	m.keySentBytes.With(name).Add(uint64(size))
+}
+
+func (p *Proxy) trackCache(result string) {
+	if p.metrics != nil {
+		p.metrics.cacheRequests.With(result).Inc()
+	}
+}
+
+func (m *proxyMetrics) trackError(class string) {
+	m.errors.With(class).Inc()
+}
+
+// HandleMetrics отдает метрики в формате Prometheus, нужно предварительно вызвать EnableMetrics
+func (p *Proxy) HandleMetrics(ctx *fasthttp.RequestCtx) {
+	ctx.SetContentType("text/plain; version=0.0.4; charset=utf-8")
+	p.metrics.registry.WriteTo(ctx)
+}
+
+func errorClass(err error) string {
+	if err == errCircuitOpen {
+		return errorClassCircuit
+	} else if errors.Is(err, fasthttp.ErrBodyTooLarge) {
+		return errorClassBodyTooLarge
+	} else if errors.Is(err, fasthttp.ErrNoFreeConns) {
+		return errorClassNoConns
+	} else if isTimeoutError(err) {
+		return errorClassTimeout
+	} else if errors.Is(err, fasthttp.ErrConnectionClosed) || strings.Contains(err.Error(), "dial") ||
+		strings.Contains(err.Error(), "connection reset") {
+		return errorClassConnection
+	}
+	return errorClassOther
+}
+
+func isTimeoutError(err error) bool {
+	return strings.Contains(err.Error(), "timed out") || strings.Contains(err.Error(), "timeout")
+}
+
+// Домены CDN сворачиваются до *.domain.tld, иначе у метрик будут тысячи разных меток
+func hostLabel(host string) string {
+	switch host {
+	case "api.vk.com", "oauth.vk.com", "static.vk.com", "vk.com", "api.ok.ru", "api.vk.me":
+		return host
+	}
+	idx := strings.LastIndexByte(host, '.')
+	if idx <= 0 {
+		return host
+	}
+	if idx = strings.LastIndexByte(host[:idx], '.'); idx == -1 {
+		return host
+	}
+	return "*" + host[idx:]
+}
+
+func apiMethodLabel(path string) string {
+	if !strings.HasPrefix(path, "/method/") {
+		return ""
+	}
+	method := path[len("/method/"):]
+	if len(method) == 0 || len(method) > 64 {
+		return "other"
+	}
+	for i := 0; i < len(method); i++ {
+		c := method[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_') {
+			return "other"
+		}
+	}
+	return method
+}
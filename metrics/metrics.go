@@ -0,0 +1,326 @@
+// Package metrics содержит минимальный набор метрик (счетчики, гистограммы, gauge) с выводом в текстовом
+// формате Prometheus. Полноценный клиент Prometheus для прокси избыточен.
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Ограничение на количество наборов меток в одной метрике. Метки часто берутся из запроса клиента,
+// после превышения лимита все новые значения меток записываются как "other".
+const maxSeries = 1000
+
+const otherLabelValue = "other"
+
+// В HELP экранируются только обратный слеш и перевод строки, кавычки остаются как есть
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+type metric interface {
+	write(buf *bytes.Buffer)
+}
+
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.lock.Lock()
+	r.metrics = append(r.metrics, m)
+	r.lock.Unlock()
+}
+
+// WriteTo пишет все метрики в текстовом формате Prometheus
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.lock.Unlock()
+
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		m.write(&buf)
+	}
+	return buf.WriteTo(w)
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(buf *bytes.Buffer) {
+	buf.WriteString("# HELP ")
+	buf.WriteString(d.name)
+	buf.WriteByte(' ')
+	buf.WriteString(helpReplacer.Replace(d.help))
+	buf.WriteString("\n# TYPE ")
+	buf.WriteString(d.name)
+	buf.WriteByte(' ')
+	buf.WriteString(d.typ)
+	buf.WriteByte('\n')
+}
+
+func (d *desc) writeSample(buf *bytes.Buffer, suffix string, labels, values []string, extraLabel, extraValue string, value string) {
+	buf.WriteString(d.name)
+	buf.WriteString(suffix)
+	if len(labels) > 0 || extraLabel != "" {
+		buf.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeLabel(buf, label, values[i])
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				buf.WriteByte(',')
+			}
+			writeLabel(buf, extraLabel, extraValue)
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+func writeLabel(buf *bytes.Buffer, label, value string) {
+	buf.WriteString(label)
+	buf.WriteString(`="`)
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\':
+			buf.WriteString(`\\`)
+		case '"':
+			buf.WriteString(`\"`)
+		case '\n':
+			buf.WriteString(`\n`)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('"')
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type series[T any] struct {
+	values []string
+	metric *T
+}
+
+// Набор метрик одного типа, различающихся значениями меток
+type vec[T any] struct {
+	desc
+	create func() *T
+	lock   sync.RWMutex
+	series map[string]*series[T]
+}
+
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic("metrics: wrong number of label values for " + v.name)
+	}
+	key := strings.Join(values, "\xff")
+	v.lock.RLock()
+	s, ok := v.series[key]
+	v.lock.RUnlock()
+	if ok {
+		return s.metric
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if len(v.series) >= maxSeries {
+		values = make([]string, len(v.labels))
+		for i := range values {
+			values[i] = otherLabelValue
+		}
+		key = strings.Join(values, "\xff")
+	}
+	if s, ok = v.series[key]; !ok {
+		s = &series[T]{
+			values: append([]string(nil), values...),
+			metric: v.create(),
+		}
+		v.series[key] = s
+	}
+	return s.metric
+}
+
+func (v *vec[T]) sorted() []*series[T] {
+	v.lock.RLock()
+	result := make([]*series[T], 0, len(v.series))
+	for _, s := range v.series {
+		result = append(result, s)
+	}
+	v.lock.RUnlock()
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i].values, result[j].values
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+	return result
+}
+
+type Counter struct {
+	value uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+type CounterVec struct {
+	vec[Counter]
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{vec[Counter]{
+		desc:   desc{name: name, help: help, typ: "counter", labels: labels},
+		create: func() *Counter { return &Counter{} },
+		series: make(map[string]*series[Counter]),
+	}}
+	r.register(v)
+	return v
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.with(values)
+}
+
+func (v *CounterVec) write(buf *bytes.Buffer) {
+	v.writeHeader(buf)
+	for _, s := range v.sorted() {
+		v.writeSample(buf, "", v.labels, s.values, "", "", strconv.FormatUint(s.metric.Value(), 10))
+	}
+}
+
+// DefBuckets подходят для измерения времени запросов в секундах
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+type Histogram struct {
+	buckets []float64
+	// Последний элемент - бакет +Inf
+	counts  []uint64
+	sumBits uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	atomic.AddUint64(&h.counts[sort.SearchFloat64s(h.buckets, v)], 1)
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			return
+		}
+	}
+}
+
+type HistogramVec struct {
+	vec[Histogram]
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	v := &HistogramVec{vec[Histogram]{
+		desc: desc{name: name, help: help, typ: "histogram", labels: labels},
+		create: func() *Histogram {
+			return &Histogram{
+				buckets: buckets,
+				counts:  make([]uint64, len(buckets)+1),
+			}
+		},
+		series: make(map[string]*series[Histogram]),
+	}}
+	r.register(v)
+	return v
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	return r.NewHistogramVec(name, help, buckets).With()
+}
+
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.with(values)
+}
+
+func (v *HistogramVec) write(buf *bytes.Buffer) {
+	v.writeHeader(buf)
+	for _, s := range v.sorted() {
+		h := s.metric
+		var cumulative uint64
+		for i := range h.counts {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			v.writeSample(buf, "_bucket", v.labels, s.values, "le", formatFloat(le), strconv.FormatUint(cumulative, 10))
+		}
+		sum := math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+		v.writeSample(buf, "_sum", v.labels, s.values, "", "", formatFloat(sum))
+		v.writeSample(buf, "_count", v.labels, s.values, "", "", strconv.FormatUint(cumulative, 10))
+	}
+}
+
+type valueFunc struct {
+	desc
+	f func() float64
+}
+
+// NewGaugeFunc регистрирует метрику, значение которой вычисляется в момент запроса метрик
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(&valueFunc{
+		desc: desc{name: name, help: help, typ: "gauge"},
+		f:    f,
+	})
+}
+
+// NewCounterFunc то же, что и NewGaugeFunc, но для постоянно растущих значений, посчитанных в другом месте
+func (r *Registry) NewCounterFunc(name, help string, f func() float64) {
+	r.register(&valueFunc{
+		desc: desc{name: name, help: help, typ: "counter"},
+		f:    f,
+	})
+}
+
+func (g *valueFunc) write(buf *bytes.Buffer) {
+	g.writeHeader(buf)
+	g.writeSample(buf, "", nil, nil, "", "", formatFloat(g.f()))
+}
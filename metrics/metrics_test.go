@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func writeMetrics(t *testing.T, r *Registry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestGoldenOutput(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("requests_total", "Requests by \"host\"\nand status, C:\\path", "host", "status")
+	requests.With("api.vk.com", "200").Add(3)
+	requests.With(`quote"back\slash`+"\nnewline", "500").Inc()
+	requests.With("a.vk.com", "200").Inc()
+
+	duration := r.NewHistogramVec("duration_seconds", "Duration", []float64{1, 0.1, 0.5}, "host")
+	h := duration.With("api.vk.com")
+	for _, v := range []float64{0.05, 0.1, 0.3, 1, 7} {
+		h.Observe(v)
+	}
+	// Серия без наблюдений тоже выводится со всеми бакетами
+	duration.With("empty")
+
+	r.NewCounter("plain_total", "Without labels").Add(42)
+	r.NewGaugeFunc("gauge", "Gauge", func() float64 { return 1.5 })
+	r.NewCounterFunc("counter_func_total", "Counter func", func() float64 { return 1e21 })
+
+	expected, err := os.ReadFile("test/golden.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := writeMetrics(t, r); got != string(expected) {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	r := NewRegistry()
+	v := r.NewCounterVec("capped_total", "Capped", "a", "b")
+	for i := 0; i < maxSeries+10; i++ {
+		v.With(strconv.Itoa(i), "x").Inc()
+	}
+	// Уже существующая серия продолжает считаться отдельно
+	v.With("0", "x").Inc()
+
+	if len(v.series) != maxSeries+1 {
+		t.Fatalf("got %d series, expected %d", len(v.series), maxSeries+1)
+	}
+	out := writeMetrics(t, r)
+	if !strings.Contains(out, "\ncapped_total{a=\"other\",b=\"other\"} 10\n") {
+		t.Error("series over the limit must be counted as other")
+	}
+	if !strings.Contains(out, "\ncapped_total{a=\"0\",b=\"x\"} 2\n") {
+		t.Error("existing series must not be merged into other")
+	}
+	if lines := strings.Count(out, "\n"); lines != maxSeries+1+2 {
+		t.Errorf("got %d lines, expected %d", lines, maxSeries+1+2)
+	}
+}
+
+func TestWrongLabelCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("wrong number of label values must panic")
+		}
+	}()
+	NewRegistry().NewCounterVec("labels_total", "Labels", "a", "b").With("x")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"github.com/xtrafrancyz/vk-proxy/replacer"
+)
+
+const passThroughPrefix = "/_/"
+
+var passThroughPrefixBytes = []byte(passThroughPrefix)
+
+// Путь /_/<host>/... проксируется без какой-либо обработки тела, ссылки на него вставляет hardcode реплейсер.
+// Список разрешенных доменов берется оттуда же, вместе с hosts из правил замен и доменами, на которые ссылки /_/
+// вставляют сами правила (hls, m3u8), чтобы прокси не пропускал через себя что попало. На остальные домены, как и
+// раньше в nginx, отдается 403.
+func (p *Proxy) preparePassThroughRequest(ctx *fasthttp.RequestCtx, rules *replacer.RuleSet, clientIp net.IP) (string, bool) {
+	req := &ctx.Request
+	uri := string(req.RequestURI())[len(passThroughPrefix):]
+	slashIndex := strings.IndexByte(uri, '/')
+	if slashIndex <= 0 {
+		return "", false
+	}
+	host := uri[:slashIndex]
+	if !rules.IsProxiedHost([]byte(host)) {
+		return "", false
+	}
+	req.SetRequestURI(uri[slashIndex:])
+	req.SetHost(host)
+	req.URI().SetScheme("https")
+	req.Header.Del(fasthttp.HeaderConnection)
+	// Так же, как proxy_set_header X-Real-IP и X-Forwarded-For $proxy_add_x_forwarded_for в nginx
+	req.Header.Set("X-Real-IP", clientIp.String())
+	remoteIp := ctx.RemoteIP().String()
+	if forwarded := req.Header.Peek(fasthttp.HeaderXForwardedFor); len(forwarded) > 0 {
+		req.Header.Set(fasthttp.HeaderXForwardedFor, string(forwarded)+", "+remoteIp)
+	} else {
+		req.Header.Set(fasthttp.HeaderXForwardedFor, remoteIp)
+	}
+	return host, true
+}
+
+func (p *Proxy) processPassThroughResponse(ctx *fasthttp.RequestCtx, rules *replacer.RuleSet, host, pathPrefix string) {
+	res := &ctx.Response
+	res.Header.Del(fasthttp.HeaderSetCookie)
+	res.Header.Del(fasthttp.HeaderConnection)
+	res.Header.SetBytesV(fasthttp.HeaderServer, vkProxyName)
+
+	if location := res.Header.Peek(fasthttp.HeaderLocation); location != nil {
+		res.Header.Set(fasthttp.HeaderLocation, rewritePassThroughLocation(rules, string(location), host, pathPrefix))
+	}
+}
+
+// Работает так же, как proxy_redirect в nginx:
+//   - относительный редирект /path -> /_/host/path
+//   - абсолютный редирект https://other/path -> /_/other/path, если other тоже можно проксировать
+//
+// pathPrefix - ключ доступа, с которым пришел запрос.
+func rewritePassThroughLocation(rules *replacer.RuleSet, location, host, pathPrefix string) string {
+	if strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+		return pathPrefix + passThroughPrefix + host + location
+	}
+	rest := ""
+	if strings.HasPrefix(location, "https://") {
+		rest = location[8:]
+	} else if strings.HasPrefix(location, "http://") {
+		rest = location[7:]
+	} else if strings.HasPrefix(location, "//") {
+		rest = location[2:]
+	} else {
+		return location
+	}
+	target := rest
+	if slashIndex := strings.IndexByte(rest, '/'); slashIndex != -1 {
+		target = rest[:slashIndex]
+	} else {
+		rest += "/"
+	}
+	if !rules.IsProxiedHost([]byte(target)) {
+		return location
+	}
+	return pathPrefix + passThroughPrefix + rest
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+	"github.com/xtrafrancyz/vk-proxy/replacer"
+)
+
+// /_/ всегда ходит в апстрим по https, поэтому клиент прокси подключается к отдельному апстриму с TLS
+func setPassThroughUpstream(t *testing.T, p *Proxy, upstream fasthttp.RequestHandler) {
+	t.Helper()
+	certFile, keyFile, _ := writeTestCertificate(t)
+	ln := fasthttputil.NewInmemoryListener()
+	go (&fasthttp.Server{Handler: upstream}).ServeTLS(ln, certFile, keyFile)
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	p.client.Dial = func(string) (net.Conn, error) {
+		return ln.Dial()
+	}
+}
+
+func TestPassThroughRequest(t *testing.T) {
+	p, client := newTestProxy(t, ProxyConfig{}, nil)
+	setPassThroughUpstream(t, p, func(ctx *fasthttp.RequestCtx) {
+		ctx.Response.Header.Set("X-Host", string(ctx.Host()))
+		ctx.Response.Header.Set("X-Uri", string(ctx.RequestURI()))
+		ctx.Response.Header.Set("X-Scheme", string(ctx.Request.URI().Scheme()))
+		ctx.Response.Header.Set("X-Got-Real-IP", string(ctx.Request.Header.Peek("X-Real-IP")))
+		ctx.Response.Header.Set("X-Got-Forwarded-For", string(ctx.Request.Header.Peek(fasthttp.HeaderXForwardedFor)))
+		ctx.SetBodyString("ok")
+	})
+
+	res := doTestRequest(t, client, "http://proxy.test/_/sun9-1.userapi.com/c123/a.jpg?size=1", func(req *fasthttp.Request) {
+		req.Header.Set("X-Real-IP", "5.6.7.8")
+		req.Header.Set(fasthttp.HeaderXForwardedFor, "1.2.3.4")
+	})
+	if res.StatusCode() != 200 || string(res.Body()) != "ok" {
+		t.Fatalf("unexpected response %d %q", res.StatusCode(), res.Body())
+	}
+	for header, expected := range map[string]string{
+		"X-Host":   "sun9-1.userapi.com",
+		"X-Uri":    "/c123/a.jpg?size=1",
+		"X-Scheme": "https",
+	} {
+		if got := string(res.Header.Peek(header)); got != expected {
+			t.Errorf("%s = %q, expected %q", header, got, expected)
+		}
+	}
+	// Клиент не за доверенным прокси: X-Real-IP -- адрес соединения, а к его цепочке X-Forwarded-For адрес
+	// добавляется, как $proxy_add_x_forwarded_for в nginx
+	if got := string(res.Header.Peek("X-Got-Real-IP")); got != "203.0.113.7" {
+		t.Errorf("X-Real-IP = %q, expected address of the connection", got)
+	}
+	if got := string(res.Header.Peek("X-Got-Forwarded-For")); got != "1.2.3.4, 203.0.113.7" {
+		t.Errorf("X-Forwarded-For = %q, expected client chain with address of the connection", got)
+	}
+
+	res = doTestRequest(t, client, "http://proxy.test/_/sun9-1.userapi.com/a", nil)
+	if got := string(res.Header.Peek("X-Got-Forwarded-For")); got != "203.0.113.7" {
+		t.Errorf("X-Forwarded-For without client chain = %q", got)
+	}
+}
+
+func TestPassThroughForbidden(t *testing.T) {
+	p, client := newTestProxy(t, ProxyConfig{}, nil)
+	setPassThroughUpstream(t, p, func(ctx *fasthttp.RequestCtx) {
+		t.Errorf("request to %s must not reach upstream", ctx.Host())
+	})
+	for _, uri := range []string{
+		"/_/evil.com/a",
+		"/_/vk.com.evil.com/a",
+		"/_/evil.com/sun9-1.userapi.com/a",
+		"/_/m.vk.com/a",
+		"/_/sun9-1.userapi.com",
+		"/_//a",
+	} {
+		if res := doTestRequest(t, client, "http://proxy.test"+uri, nil); res.StatusCode() != fasthttp.StatusForbidden {
+			t.Errorf("%s got %d, expected 403", uri, res.StatusCode())
+		}
+	}
+}
+
+// Ссылки /_/, которые прокси сам вставляет в плейлисты, должны через него открываться
+func TestPassThroughRewrittenLinks(t *testing.T) {
+	routes := writeTestFile(t, "routes.json", `[
+  {"host": "vk.test", "via": ["default"], "upstream_scheme": "http", "rewrite": "vk"},
+  {"host": "audio.test", "via": ["endpoint"], "upstream_scheme": "http", "rewrite": "mycdn"}
+]`)
+	p, client := newTestProxy(t, ProxyConfig{RoutesFile: routes}, func(ctx *fasthttp.RequestCtx) {
+		// Узлы с длинными именами и на vk.me, как в настоящих ответах
+		ctx.SetBodyString("#EXTM3U\n" +
+			"https://sun9-1.vk.me/video/360.m3u8\n" +
+			"https://vkvd123-long-video-node.mycdn.me/video/720.m3u8\n" +
+			"https://psv4-very-long-subdomain.userapi.com/c1/seg.ts\n")
+	})
+	setPassThroughUpstream(t, p, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("segment from " + string(ctx.Host()))
+	})
+
+	links := regexp.MustCompile(`/_/([^/]+)/\S*`)
+	for _, uri := range []string{"http://proxy.test/video_hls.php", "http://proxy.test/@audio.test/index.m3u8"} {
+		body := string(doTestRequest(t, client, uri, nil).Body())
+		found := links.FindAllStringSubmatch(body, -1)
+		if len(found) != 3 {
+			t.Fatalf("%s: expected 3 rewritten links, got %q", uri, body)
+		}
+		for _, link := range found {
+			res := doTestRequest(t, client, "http://proxy.test"+link[0], nil)
+			if res.StatusCode() != 200 || string(res.Body()) != "segment from "+link[1] {
+				t.Errorf("%s from %s got %d %q", link[0], uri, res.StatusCode(), res.Body())
+			}
+		}
+	}
+}
+
+func TestPassThroughLocation(t *testing.T) {
+	p, client := newTestProxy(t, ProxyConfig{
+		AccessKeysFile: writeTestFile(t, "keys.txt", "secret-key test\n"),
+	}, nil)
+	setPassThroughUpstream(t, p, func(ctx *fasthttp.RequestCtx) {
+		ctx.Redirect(string(ctx.QueryArgs().Peek("to")), fasthttp.StatusFound)
+	})
+
+	// Редирект ведет на адрес с ключом, даже если ключ был в заголовке: по редиректу заголовок не передается
+	for _, c := range []struct {
+		prefix, to, expected string
+	}{
+		{"", "/next", "/~secret-key/_/sun9-1.userapi.com/next"},
+		{"/~secret-key", "/next", "/~secret-key/_/sun9-1.userapi.com/next"},
+		{"/~secret-key", "https://sun1-2.userapi.com/x", "/~secret-key/_/sun1-2.userapi.com/x"},
+		{"/~secret-key", "https://evil.com/x", "https://evil.com/x"},
+	} {
+		res := doTestRequest(t, client, "http://proxy.test"+c.prefix+"/_/sun9-1.userapi.com/a?to="+c.to,
+			func(req *fasthttp.Request) {
+				if c.prefix == "" {
+					req.Header.Set(accessKeyHeader, "secret-key")
+				}
+			})
+		if got := string(res.Header.Peek(fasthttp.HeaderLocation)); got != c.expected {
+			t.Errorf("%q redirect to %s rewritten to %q, expected %q", c.prefix, c.to, got, c.expected)
+		}
+	}
+}
+
+func TestRewritePassThroughLocation(t *testing.T) {
+	rules, _ := replacer.LoadRules("")
+	for _, c := range []struct {
+		location, expected string
+	}{
+		{"/path?a=1", "/_/sun9-1.userapi.com/path?a=1"},
+		{"https://sun1-2.userapi.com/x", "/_/sun1-2.userapi.com/x"},
+		{"http://sun1-2.userapi.com/x", "/_/sun1-2.userapi.com/x"},
+		{"//sun1-2.userapi.com/x", "/_/sun1-2.userapi.com/x"},
+		{"https://sun1-2.userapi.com", "/_/sun1-2.userapi.com/"},
+		{"https://evil.com/x", "https://evil.com/x"},
+		{"//evil.com/x", "//evil.com/x"},
+		{"relative/path", "relative/path"},
+		{"ftp://sun1-2.userapi.com/x", "ftp://sun1-2.userapi.com/x"},
+	} {
+		if got := rewritePassThroughLocation(rules, c.location, "sun9-1.userapi.com", ""); got != c.expected {
+			t.Errorf("%q rewritten to %q, expected %q", c.location, got, c.expected)
+		}
+	}
+	if got := rewritePassThroughLocation(rules, "/path", "sun9-1.userapi.com", "/~key"); got != "/~key/_/sun9-1.userapi.com/path" {
+		t.Errorf("location with key prefix rewritten to %q", got)
+	}
+}
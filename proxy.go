@@ -3,17 +3,22 @@ package main
 import (
 	"bytes"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/valyala/bytebufferpool"
 	"github.com/valyala/fasthttp"
 	"github.com/xtrafrancyz/vk-proxy/bytefmt"
 	"github.com/xtrafrancyz/vk-proxy/replacer"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 const (
@@ -21,22 +26,15 @@ const (
 
 	byteBufferPoolSetupRounds = 42000   // == bytebufferpool.calibrateCallsThreshold
 	byteBufferPoolSetupSize   = 2097152 // 2**21
+
+	// Ответы с заменами больше этого размера или без Content-Length меняются потоком. Меньшие выгоднее
+	// менять целиком: у них остается известная длина.
+	minStreamedRewrite = 256 * 1024
 )
 
 func init() {
-	// Настройка размера буфера для ответа
-	r := fasthttp.Response{}
-	for i := 0; i <= byteBufferPoolSetupRounds; i++ {
-		r.SetBodyString("")
-		if b := r.Body(); cap(b) != byteBufferPoolSetupSize {
-			r.SwapBody(make([]byte, byteBufferPoolSetupSize))
-		} else {
-			r.SwapBody(b[:cap(b)])
-		}
-		r.ResetBody()
-	}
-
-	// Настройка размера реплейсера
+	// Настройка размера буфера реплейсера. Буфер ответа fasthttp не настраивается, так как большие ответы,
+	// которые не нужно менять, отдаются потоком и в него не попадают.
 	for i := 0; i <= byteBufferPoolSetupRounds; i++ {
 		b := replacer.AcquireBuffer()
 		if cap(b.B) != byteBufferPoolSetupSize {
@@ -52,6 +50,11 @@ var (
 	gzip        = []byte("gzip")
 	vkProxyName = []byte("vk-proxy")
 
+	// Таймауты соединения с клиентом. Для тел, которые передаются потоком, это максимальная пауза между кусками,
+	// см. bodyStream и requestBodyStream.
+	serverReadTimeout  = 10 * time.Second
+	serverWriteTimeout = 20 * time.Second
+
 	replaceContextPool = sync.Pool{New: func() interface{} {
 		return &replacer.ReplaceContext{}
 	}}
@@ -62,135 +65,708 @@ type ProxyConfig struct {
 	BaseDomain             string
 	BaseStaticDomain       string
 	LogVerbosity           int
+	LogRedact              string
 	GzipUpstream           bool
 	FilterFeed             bool
 	AddUselessProxyMessage bool
+	RoutesFile             string
+	RewriteRulesFile       string
+	ApiRateLimit           rateLimit
+	MediaRateLimit         rateLimit
+	LongpollRateLimit      rateLimit
+	TrustedProxies         trustedProxies
+	AccessKeysFile         string
+	// Ограничение размера тела запроса, 0 - без ограничения
+	MaxBodySize byteSize
 }
 
 type Proxy struct {
 	client   *fasthttp.Client
 	server   *fasthttp.Server
-	replacer *replacer.Replacer
+	state    atomic.Pointer[proxyState]
 	tracker  *tracker
+	breakers *circuitBreakers
+	// Успешность запросов к апстримам для /readyz
+	upstreamStats *upstreamStats
+	// Прокси завершается, /readyz отвечает ошибкой
+	draining atomic.Bool
+	tunnels  tunnelStats
+	limiters *rateLimiters
+	cache    *responseCache
+	// Лог запросов, nil если выключен
+	accessLog *accessLog
+	// Запись ответов апстрима и их воспроизведение вместо запросов в вк, см. record.go
+	recorder *recorder
+	replayer *replayer
+	// Админка, см. admin.go
+	adminToken string
+	conns      *connRegistry
+	// Замена состояния из SIGHUP и из колбеков iniflags не должна терять изменения друг друга
+	stateLock sync.Mutex
+	metrics   *proxyMetrics
+
+	tlsConfig   *tls.Config
+	acme        *autocert.Manager
+	acmeHandler fasthttp.RequestHandler
+
+	listenersLock sync.Mutex
+	listeners     []*proxyListener
+	http2Servers  []*http.Server
+	// Сокеты pprof, метрик и админки, при обновлении передаются новому процессу вместе с listeners
+	serviceListeners []*proxyListener
+}
+
+// Настройки и реплейсер, которые можно заменить на лету через Reconfigure. Запрос берет текущее состояние
+// один раз в начале обработки и использует его до конца.
+type proxyState struct {
 	config   ProxyConfig
+	routes   *routeTable
+	keys     *accessKeys
+	rules    *replacer.RuleSet
+	replacer *replacer.Replacer
+	// Ссылки на прокси в ответах для запросов с ключом доступа должны содержать этот ключ
+	keyReplacers map[*accessKey]*replacer.Replacer
 }
 
-func NewProxy(config ProxyConfig) *Proxy {
+func newProxyState(config ProxyConfig, routes *routeTable, keys *accessKeys, rules *replacer.RuleSet) *proxyState {
+	state := &proxyState{
+		config:   config,
+		routes:   routes,
+		keys:     keys,
+		rules:    rules,
+		replacer: newReplacer(config, rules, ""),
+	}
+	if keys != nil {
+		state.keyReplacers = make(map[*accessKey]*replacer.Replacer, len(keys.list))
+		for _, key := range keys.list {
+			state.keyReplacers[key] = newReplacer(config, rules, key.pathPrefix())
+		}
+	}
+	return state
+}
+
+func newReplacer(config ProxyConfig, rules *replacer.RuleSet, pathPrefix string) *replacer.Replacer {
+	return &replacer.Replacer{
+		ProxyBaseDomain:        config.BaseDomain + pathPrefix,
+		ProxyStaticDomain:      config.BaseStaticDomain,
+		FilterFeed:             config.FilterFeed,
+		AddUselessProxyMessage: config.AddUselessProxyMessage,
+		Rules:                  rules,
+	}
+}
+
+func (s *proxyState) replacerFor(key *accessKey) *replacer.Replacer {
+	if key == nil {
+		return s.replacer
+	}
+	return s.keyReplacers[key]
+}
+
+func NewProxy(config ProxyConfig) (*Proxy, error) {
+	if err := validateLogRedact(config.LogRedact); err != nil {
+		return nil, err
+	}
+	routes, err := loadRouteTable(config.RoutesFile)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := loadAccessKeys(config.AccessKeysFile, nil)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := replacer.LoadRules(config.RewriteRulesFile)
+	if err != nil {
+		return nil, err
+	}
 	p := &Proxy{
-		client: &fasthttp.Client{
-			Name:                      "vk-proxy",
-			ReadBufferSize:            readBufferSize,
-			TLSConfig:                 &tls.Config{InsecureSkipVerify: true},
-			ReadTimeout:               30 * time.Second,
-			WriteTimeout:              10 * time.Second,
-			DisablePathNormalizing:    true,
-			NoDefaultUserAgentHeader:  true,
-			MaxIdemponentCallAttempts: 0,
-			RetryIf: func(request *fasthttp.Request) bool {
-				return false
-			},
-		},
-		replacer: &replacer.Replacer{
-			ProxyBaseDomain:        config.BaseDomain,
-			ProxyStaticDomain:      config.BaseStaticDomain,
-			FilterFeed:             config.FilterFeed,
-			AddUselessProxyMessage: config.AddUselessProxyMessage,
-		},
+		// Клиент для /_/ на домены без маршрута, у маршрутов свои клиенты со своими таймаутами
+		client:        newUpstreamClient(defaultUpstreamReadTimeout, defaultUpstreamWriteTimeout, dialIdleTimeout),
+		breakers:      newCircuitBreakers(),
+		upstreamStats: newUpstreamStats(),
+		limiters:      newRateLimiters(),
 		tracker: &tracker{
 			uniqueUsers: make(map[string]bool),
 		},
-		config: config,
 	}
+	p.state.Store(newProxyState(config, routes, keys, rules))
 	p.server = &fasthttp.Server{
 		Handler:                      p.handleProxy,
 		ReduceMemoryUsage:            config.ReduceMemoryUsage,
 		ReadBufferSize:               readBufferSize,
-		ReadTimeout:                  10 * time.Second,
-		WriteTimeout:                 20 * time.Second,
+		ReadTimeout:                  serverReadTimeout,
+		WriteTimeout:                 serverWriteTimeout,
 		IdleTimeout:                  1 * time.Minute,
 		NoDefaultContentType:         true,
 		DisablePreParseMultipartForm: true,
-		Name:                         "vk-proxy",
+		// Большие тела запросов (загрузка файлов через /_/) не буферизуются целиком
+		StreamRequestBody: true,
+		Name:              "vk-proxy",
 	}
+	p.server.ConnState = p.trackConnState
 	p.tracker.server = p.server
-	if p.config.LogVerbosity > 0 {
-		p.tracker.start()
+	p.tracker.tunnels = &p.tunnels
+	p.startTracker()
+	p.startRateLimitCleanup()
+	return p, nil
+}
+
+// Reconfigure применяет новые настройки, не прерывая обработку запросов. ReduceMemoryUsage относится к серверу
+// и меняется только после перезапуска.
+func (p *Proxy) Reconfigure(config ProxyConfig) error {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	old := p.state.Load()
+	config.ReduceMemoryUsage = old.config.ReduceMemoryUsage
+	if err := validateLogRedact(config.LogRedact); err != nil {
+		return err
+	}
+	var err error
+	routes := old.routes
+	if config.RoutesFile != routes.file {
+		if routes, err = loadRouteTable(config.RoutesFile); err != nil {
+			return err
+		}
+	}
+	keys := old.keys
+	if config.AccessKeysFile != keys.getFile() {
+		if keys, err = loadAccessKeys(config.AccessKeysFile, old.keys); err != nil {
+			return err
+		}
+	}
+	rules := old.rules
+	if config.RewriteRulesFile != rules.File {
+		if rules, err = replacer.LoadRules(config.RewriteRulesFile); err != nil {
+			return err
+		}
 	}
-	return p
+	p.state.Store(newProxyState(config, routes, keys, rules))
+	log.Printf("Configuration reloaded")
+	return nil
 }
 
-func (p *Proxy) ListenTCP(host string) error {
-	log.Printf("Starting server on http://%s", host)
-	return p.server.ListenAndServe(host)
+// ReloadFiles перечитывает newsfeed.json, файл маршрутов, правила замен и ключи доступа
+func (p *Proxy) ReloadFiles() error {
+	if err := replacer.ReloadAdPost(); err != nil {
+		return err
+	}
+	log.Printf("Newsfeed post reloaded")
+
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	old := p.state.Load()
+	if old.routes.file == "" && old.rules.File == "" && old.keys == nil {
+		return nil
+	}
+	var err error
+	routes := old.routes
+	if routes.file != "" {
+		if routes, err = loadRouteTable(routes.file); err != nil {
+			return err
+		}
+	}
+	rules := old.rules
+	if rules.File != "" {
+		if rules, err = replacer.LoadRules(rules.File); err != nil {
+			return err
+		}
+	}
+	keys := old.keys
+	if keys != nil {
+		if keys, err = loadAccessKeys(keys.file, old.keys); err != nil {
+			return err
+		}
+	}
+	p.state.Store(newProxyState(old.config, routes, keys, rules))
+	if routes.file != "" {
+		log.Printf("Routes reloaded from %s", routes.file)
+	}
+	if rules.File != "" {
+		log.Printf("Rewrite rules reloaded from %s", rules.File)
+	}
+	if keys != nil {
+		log.Printf("Access keys reloaded from %s", keys.file)
+	}
+	return nil
+}
+
+func (p *Proxy) getConfig() ProxyConfig {
+	return p.state.Load().config
+}
+
+// Listen открывает сокет (или берет унаследованный от предыдущего процесса) и запускает на нем сервер в фоне
+func (p *Proxy) Listen(lc listenerConfig, inherited *inheritedListeners) error {
+	if lc.tls && p.tlsConfig == nil {
+		return errors.New("tls is not configured, set tls-cert and tls-key or enable acme")
+	}
+	ln := inherited.take(lc)
+	if ln == nil {
+		var err error
+		if ln, err = lc.listen(); err != nil {
+			return err
+		}
+		log.Printf("Starting server on %s", lc)
+	} else {
+		log.Printf("Starting server on %s (inherited socket)", lc)
+	}
+
+	pl := &proxyListener{config: lc, ln: ln}
+	var srv *http.Server
+	if lc.h2 {
+		var err error
+		if srv, err = p.newHttp2Server(lc); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+	p.listenersLock.Lock()
+	p.listeners = append(p.listeners, pl)
+	if srv != nil {
+		p.http2Servers = append(p.http2Servers, srv)
+	}
+	p.listenersLock.Unlock()
+
+	if lc.tls {
+		ln = tls.NewListener(ln, p.listenerTLSConfig(lc.h2))
+	}
+	go func() {
+		var err error
+		if srv != nil {
+			err = srv.Serve(ln)
+		} else {
+			err = p.server.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("Server on %s stopped with %s", lc, err.Error())
+		}
+		pl.stopped.Store(true)
+	}()
+	return nil
+}
+
+// ListenService запускает служебный сервер (pprof, метрики, админку) на address. Сокет, как и адреса из -bind,
+// может быть получен от предыдущего процесса и передается следующему при обновлении. Ошибка только пишется в лог:
+// прокси работает и без служебного сервера.
+func (p *Proxy) ListenService(name, address string, handler fasthttp.RequestHandler, inherited *inheritedListeners) {
+	lc := listenerConfig{address: address}
+	ln := inherited.take(lc)
+	if ln == nil {
+		var err error
+		if ln, err = lc.listen(); err != nil {
+			log.Printf("Could not start %s server on %s: %s", name, lc, err)
+			return
+		}
+		log.Printf("Starting %s server on %s", name, lc)
+	} else {
+		log.Printf("Starting %s server on %s (inherited socket)", name, lc)
+	}
+
+	pl := &proxyListener{config: lc, ln: ln}
+	p.listenersLock.Lock()
+	p.serviceListeners = append(p.serviceListeners, pl)
+	p.listenersLock.Unlock()
+	go func() {
+		if err := fasthttp.Serve(ln, handler); err != nil {
+			log.Printf("The %s server on %s stopped with %s", name, lc, err.Error())
+		}
+		pl.stopped.Store(true)
+	}()
+}
+
+// EnableMetrics включает сбор метрик для отдачи в Prometheus через HandleMetrics
+func (p *Proxy) EnableMetrics() {
+	p.metrics = newProxyMetrics(p)
 }
 
-func (p *Proxy) ListenUnix(path string) error {
-	log.Printf("Starting server on http://unix:%s", path)
-	return p.server.ListenAndServeUNIX(path, 0777)
+// EnableAccessLog включает структурированный лог запросов в файл
+func (p *Proxy) EnableAccessLog(config AccessLogConfig) error {
+	if config.File == "" {
+		return nil
+	}
+	l, err := newAccessLog(config)
+	if err != nil {
+		return err
+	}
+	p.accessLog = l
+	return nil
+}
+
+// EnableRecording сохраняет все запросы к апстриму и ответы на них в папку dir
+func (p *Proxy) EnableRecording(dir string) error {
+	r, err := newRecorder(dir)
+	if err != nil {
+		return err
+	}
+	p.recorder = r
+	return nil
+}
+
+// EnableReplay отдает ответы апстрима, записанные через EnableRecording, вместо запросов в вк
+func (p *Proxy) EnableReplay(dir string) error {
+	r, err := newReplayer(dir)
+	if err != nil {
+		return err
+	}
+	p.replayer = r
+	return nil
+}
+
+// EnableCache включает кеш ответов, если задан его размер
+func (p *Proxy) EnableCache(config CacheConfig) error {
+	if config.Size == 0 {
+		return nil
+	}
+	cache, err := newResponseCache(config)
+	if err != nil {
+		return err
+	}
+	p.cache = cache
+	return nil
 }
 
 func (p *Proxy) handleProxy(ctx *fasthttp.RequestCtx) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic when proxying the request: %s%s", r, debug.Stack())
+			log.Printf("panic when proxying the request: %s%s",
+				redactString(p.getConfig().LogRedact, fmt.Sprint(r)), debug.Stack())
 			ctx.Error("500 Internal Server Error", 500)
+			if p.metrics != nil {
+				p.metrics.trackError(errorClassPanic)
+			}
 		}
 	}()
 	start := time.Now()
+	state := p.state.Load()
 
-	replaceContext := replaceContextPool.Get().(*replacer.ReplaceContext)
-	replaceContext.RequestCtx = ctx
-	replaceContext.Method = ctx.Method()
-	replaceContext.OriginHost = string(ctx.Request.Host())
-
-	if !p.prepareProxyRequest(ctx, replaceContext) {
-		ctx.Error("400 Bad Request", 400)
+	if p.isAcmeChallenge(ctx) {
+		p.acmeHandler(ctx)
 		return
 	}
-
-	if replaceContext.Host == "api.vk.com" &&
-		(replaceContext.Path == "/away" || replaceContext.Path == "/away.php") {
-		p.handleAway(ctx)
+	if p.handleHealth(ctx) {
 		return
 	}
 
-	err := p.client.Do(&ctx.Request, &ctx.Response)
-	if err == nil {
-		err = p.processProxyResponse(ctx, replaceContext)
+	clientIp := state.config.TrustedProxies.resolve(ctx)
+	client := clientIp.String()
+	redact := state.config.LogRedact
+
+	entry := accessLogEntryPool.Get().(*accessLogEntry)
+	entry.start = start
+	entry.clientIp = client
+	entry.method = string(ctx.Method())
+	entry.host = string(ctx.Host())
+	entry.redact = redact
+	// Лог ответа потоком пишется после отправки тела, см. конец функции
+	streamed := false
+	defer func() {
+		if !streamed {
+			p.finishAccessLog(entry, ctx.Response.StatusCode())
+		}
+	}()
+
+	var key *accessKey
+	if state.keys != nil && !isStaticAssetRequest(ctx, state) {
+		if key = state.keys.authenticate(ctx); key == nil {
+			accessDenied(ctx)
+			if p.metrics != nil {
+				p.metrics.trackError(errorClassAccessDenied)
+			}
+			entry.err = errorClassAccessDenied
+			if state.config.LogVerbosity >= 2 {
+				log.Printf("%s %s %s%s access denied", client, ctx.Method(), ctx.Host(), redactPath(redact, ctx.Path()))
+			}
+			return
+		}
+	}
+
+	// Путь пишется в лог уже без ключа доступа
+	entry.path = string(ctx.Path())
+	if key != nil {
+		entry.key = key.name
 	}
 
-	replaceContext.Reset()
-	replaceContextPool.Put(replaceContext)
+	class := limitClassOf(ctx, &state.config)
+	entry.limitClass = limitClassNames[class]
+	var limiter *rateLimiter
+	if limit := state.config.rateLimit(class); limit.enabled() {
+		if !p.limiters[class].acquire(client, limit) {
+			tooManyRequests(ctx, class)
+			if p.metrics != nil {
+				p.metrics.trackError(errorClassRateLimit)
+			}
+			entry.err = errorClassRateLimit
+			if state.config.LogVerbosity >= 2 {
+				log.Printf("%s %s %s%s rate limited (%s)", client, ctx.Method(), ctx.Host(), redactPath(redact, ctx.Path()),
+					limitClassNames[class])
+			}
+			return
+		}
+		// Ответ потоком занимает место, пока тело не отправлено, см. конец функции
+		limiter = p.limiters[class]
+		defer func() {
+			if !streamed {
+				limiter.release(client)
+			}
+		}()
+	}
+
+	// Тело без Content-Length считается по мере чтения, см. requestBodyStream
+	maxBody := int(state.config.MaxBodySize)
+	if maxBody > 0 && ctx.Request.Header.ContentLength() > maxBody {
+		p.requestTooLarge(ctx)
+		entry.err = errorClassBodyTooLarge
+		return
+	}
+
+	var err error
+	if bytes.HasPrefix(ctx.RequestURI(), passThroughPrefixBytes) {
+		host, ok := p.preparePassThroughRequest(ctx, state.rules, clientIp)
+		if !ok {
+			p.forbidden(ctx)
+			entry.err = errorClassForbidden
+			return
+		}
+		entry.upstream = host
+		ctx.Response.StreamBody = true
+		// Домен может быть описан в маршрутах, тогда используются его таймауты и внешний прокси
+		upstream := p.client
+		if r := state.routes.lookup(host); r != nil {
+			upstream = r.client
+		}
+		upstreamStart := time.Now()
+		err = doStreamed(upstream, &ctx.Request, &ctx.Response, serverConn(ctx), maxBody)
+		entry.upstreamTime = time.Since(upstreamStart)
+		if err == nil {
+			p.processPassThroughResponse(ctx, state.rules, host, key.pathPrefix())
+		}
+	} else {
+		replaceContext := replaceContextPool.Get().(*replacer.ReplaceContext)
+		// Возвращается в пул и при выходе раньше ответа апстрима: badRequest, /away
+		defer func() {
+			replaceContext.Reset()
+			replaceContextPool.Put(replaceContext)
+		}()
+		replaceContext.RequestCtx = ctx
+		replaceContext.Method = ctx.Method()
+		replaceContext.OriginHost = string(ctx.Request.Host())
+		replaceContext.ClientIP = clientIp
+		acceptGzip := ctx.Request.Header.HasAcceptEncodingBytes(gzip)
+		// prepareProxyRequest убирает заголовок Connection
+		upgrade := ctx.Request.Header.ConnectionUpgrade()
+
+		rep := state.replacerFor(key)
+		route := p.prepareProxyRequest(ctx, replaceContext, state, rep)
+		if route == nil {
+			p.badRequest(ctx)
+			entry.err = errorClassBadRequest
+			return
+		}
+		entry.upstream = replaceContext.Host
+		if replaceContext.Rewrite == replacer.RewriteApi {
+			entry.apiMethod = apiMethodLabel(replaceContext.Path)
+		}
+
+		if replaceContext.Rewrite == replacer.RewriteApi &&
+			(replaceContext.Path == "/away" || replaceContext.Path == "/away.php") {
+			p.handleAway(ctx)
+			return
+		}
+
+		var cacheKey string
+		var cached *cacheEntry
+		revalidating := false
+		if p.cache != nil && !upgrade {
+			if cacheKey = p.cache.requestKey(ctx, rep, replaceContext.Rewrite); cacheKey != "" {
+				if cached = p.cache.get(cacheKey); cached != nil && !cached.fresh() {
+					revalidating = p.cache.addValidators(cached, &ctx.Request)
+				}
+			}
+		}
+
+		if cached != nil && cached.fresh() {
+			cached.writeTo(ctx)
+			p.trackCache(cacheResultHit)
+			entry.cache = cacheResultHit
+		} else {
+			// Тело ответа читается в память только если его нужно менять, см. processProxyResponse
+			ctx.Response.StreamBody = true
+			// Большие загрузки проксируются без записи
+			if p.recorder != nil && !upgrade && ctx.Request.Header.ContentLength() <= maxRecordedBody {
+				entry.exchange, err = newExchange(&ctx.Request, maxBody)
+			}
+			tunneled := false
+			upstreamStart := time.Now()
+			if err != nil {
+				// Тело запроса для записи не удалось прочитать
+			} else if upgrade {
+				tunneled, err = p.openTunnel(route, ctx)
+			} else if p.replayer != nil {
+				err = p.replayer.serve(&ctx.Request, &ctx.Response, maxBody)
+			} else {
+				err = p.doUpstream(route, ctx, replaceContext, maxBody)
+			}
+			entry.upstreamTime = time.Since(upstreamStart)
+			if err == nil && entry.exchange != nil {
+				entry.exchange.setUpstream(&ctx.Response)
+			}
+			if err == nil && revalidating && ctx.Response.StatusCode() == fasthttp.StatusNotModified {
+				p.cache.refresh(cached, &ctx.Response)
+				cached.writeTo(ctx)
+				p.trackCache(cacheResultRevalidated)
+				entry.cache = cacheResultRevalidated
+			} else if err == nil && !tunneled {
+				err = p.processProxyResponse(ctx, replaceContext, rep, acceptGzip, cacheKey, entry)
+				if cacheKey != "" {
+					p.trackCache(cacheResultMiss)
+					entry.cache = cacheResultMiss
+				}
+			}
+			if err == nil && entry.exchange != nil {
+				p.recorder.save(entry.exchange, &ctx.Response)
+			}
+		}
+		entry.rules = append(entry.rules, replaceContext.Rules...)
+	}
 
 	elapsed := time.Since(start).Round(100 * time.Microsecond)
 
 	if err != nil {
-		log.Printf("%s %s %s%s error: %s", elapsed, ctx.Request.Header.Method(), ctx.Host(), ctx.Path(), err)
-		if strings.Contains(err.Error(), "timed out") || strings.Contains(err.Error(), "timeout") {
+		log.Printf("%s %s %s %s%s error: %s", client, elapsed, ctx.Request.Header.Method(), ctx.Host(),
+			redactPath(redact, ctx.Path()), redactString(redact, err.Error()))
+		if err == errCircuitOpen {
+			ctx.Error("503 Service Unavailable: "+err.Error(), 503)
+		} else if err == errNotRecorded {
+			ctx.Error("502 Bad Gateway: "+err.Error(), 502)
+		} else if errors.Is(err, fasthttp.ErrBodyTooLarge) {
+			ctx.Error("413 Request Entity Too Large", fasthttp.StatusRequestEntityTooLarge)
+			// Остаток тела не прочитан
+			ctx.SetConnectionClose()
+		} else if isTimeoutError(err) {
 			ctx.Error("408 Request Timeout", 408)
 		} else {
 			ctx.Error("500 Internal Server Error", 500)
 		}
+		if p.metrics != nil {
+			if _, ok := err.(gunzipError); ok {
+				p.metrics.trackError(errorClassGunzip)
+			} else {
+				p.metrics.trackError(errorClass(err))
+			}
+		}
+		entry.err = redactString(redact, err.Error())
+		return
+	}
+
+	summary := &requestSummary{
+		start:     start,
+		client:    client,
+		method:    string(ctx.Request.Header.Method()),
+		host:      string(ctx.Host()),
+		path:      string(ctx.Path()),
+		status:    ctx.Response.StatusCode(),
+		received:  ctx.Request.Header.ContentLength(),
+		key:       key,
+		limiter:   limiter,
+		verbosity: state.config.LogVerbosity,
+		redact:    redact,
+	}
+	// Тело потока еще не отправлено, его размер станет известен после записи. К этому времени ctx может уже
+	// обрабатывать следующий запрос, поэтому для статистики все скопировано в summary.
+	if stream, ok := ctx.Response.BodyStream().(*bodyStream); ok {
+		streamed = true
+		summary.stream = true
+		stream.forward(serverConn(ctx))
+		stream.onClose = func(size int) {
+			if summary.limiter != nil {
+				summary.limiter.release(summary.client)
+			}
+			entry.bytesAfter = size
+			p.trackResponse(summary, size)
+			p.finishAccessLog(entry, summary.status)
+		}
 		return
 	}
 
-	if p.config.LogVerbosity > 0 {
-		ip := ctx.Request.Header.Peek("CF-Connecting-IP") // Cloudflare
-		if ip == nil {
-			ip = ctx.Request.Header.Peek(fasthttp.HeaderXForwardedFor) // nginx
+	// Тело чужого стрима нельзя читать, иначе оно целиком окажется в памяти
+	var size int
+	if ctx.Response.IsBodyStream() {
+		summary.stream = true
+		if size = ctx.Response.Header.ContentLength(); size < 0 {
+			size = 0
 		}
-		if ip == nil {
-			ip = []byte(ctx.RemoteIP().String()) // real
+	} else {
+		size = len(ctx.Response.Body())
+	}
+	entry.bytesAfter = size
+	p.trackResponse(summary, size)
+
+	if state.config.LogVerbosity == 3 && !summary.stream {
+		log.Printf("%s %s %s %s%s %s\n%s", client, elapsed, summary.method, summary.host,
+			redactPath(redact, ctx.Path()), bytefmt.ByteSize(uint64(size)),
+			redactBody(redact, ctx.Response.Header.ContentType(), ctx.Response.Body()))
+	}
+}
+
+// Запрос, для которого осталось записать статистику и освободить место в лимите
+type requestSummary struct {
+	start    time.Time
+	client   string
+	method   string
+	host     string
+	path     string
+	status   int
+	received int
+	key      *accessKey
+	// Лимит, место в котором занимает запрос, или nil
+	limiter   *rateLimiter
+	verbosity int
+	redact    string
+	// Тело отдавалось потоком и в лог не пишется
+	stream bool
+}
+
+func (p *Proxy) trackResponse(s *requestSummary, size int) {
+	elapsed := time.Since(s.start).Round(100 * time.Microsecond)
+	if p.metrics != nil {
+		p.metrics.trackRequest(s, elapsed, size)
+	}
+
+	if s.key != nil {
+		s.key.track(size)
+		if p.metrics != nil {
+			p.metrics.trackAccessKey(s.key.name, size)
 		}
-		p.tracker.trackRequest(string(ip), len(ctx.Response.Body()))
 	}
 
-	if p.config.LogVerbosity == 2 {
-		log.Printf("%s %s %s%s %s", elapsed, ctx.Request.Header.Method(), ctx.Host(), ctx.Path(),
-			bytefmt.ByteSize(uint64(len(ctx.Response.Body()))))
-	} else if p.config.LogVerbosity == 3 {
-		log.Printf("%s %s %s%s %s\n%s", elapsed, ctx.Request.Header.Method(), ctx.Host(), ctx.Path(),
-			bytefmt.ByteSize(uint64(len(ctx.Response.Body()))), ctx.Response.Body())
+	if s.verbosity > 0 {
+		p.tracker.trackRequest(s.client, size)
+	}
+
+	if s.verbosity == 2 || s.verbosity == 3 && s.stream {
+		log.Printf("%s %s %s %s%s %s", s.client, elapsed, s.method, s.host, redactPath(s.redact, []byte(s.path)),
+			bytefmt.ByteSize(uint64(size)))
+	}
+}
+
+func (p *Proxy) badRequest(ctx *fasthttp.RequestCtx) {
+	ctx.Error("400 Bad Request", 400)
+	if p.metrics != nil {
+		p.metrics.trackError(errorClassBadRequest)
+	}
+}
+
+// Тело запроса не читается, поэтому соединение дальше использовать нельзя
+func (p *Proxy) requestTooLarge(ctx *fasthttp.RequestCtx) {
+	ctx.Error("413 Request Entity Too Large", fasthttp.StatusRequestEntityTooLarge)
+	ctx.SetConnectionClose()
+	if p.metrics != nil {
+		p.metrics.trackError(errorClassBodyTooLarge)
+	}
+}
+
+func (p *Proxy) forbidden(ctx *fasthttp.RequestCtx) {
+	ctx.Error("403 Forbidden", fasthttp.StatusForbidden)
+	if p.metrics != nil {
+		p.metrics.trackError(errorClassForbidden)
 	}
 }
 
@@ -208,74 +784,110 @@ func (p *Proxy) handleAway(ctx *fasthttp.RequestCtx) {
 	ctx.Redirect(to, fasthttp.StatusMovedPermanently)
 }
 
-func (p *Proxy) prepareProxyRequest(ctx *fasthttp.RequestCtx, replaceContext *replacer.ReplaceContext) bool {
-	// Routing
+// Выбирает маршрут по таблице и готовит запрос к апстриму. Возвращает nil, если подходящего маршрута нет.
+func (p *Proxy) prepareProxyRequest(ctx *fasthttp.RequestCtx, replaceContext *replacer.ReplaceContext, state *proxyState,
+	rep *replacer.Replacer) *route {
 	req := &ctx.Request
 	uri := string(req.RequestURI())
-	host := ""
+	var r *route
+	var host string
 	if strings.HasPrefix(uri, "/@") {
 		slashIndex := strings.IndexByte(uri[2:], '/')
 		if slashIndex == -1 {
-			return false
-		}
-		endpoint := uri[2 : slashIndex+2]
-		if endpoint != "vk.com" &&
-			!strings.HasSuffix(endpoint, ".vk.com") &&
-			!strings.HasSuffix(endpoint, ".vkuseraudio.net") &&
-			!strings.HasSuffix(endpoint, ".vkuseraudio.com") &&
-			!strings.HasSuffix(endpoint, ".mycdn.me") &&
-			endpoint != "api.ok.ru" {
-			return false
-		}
-		host = endpoint
+			return nil
+		}
+		if r, host = state.routes.find(routeViaEndpoint, uri[2:slashIndex+2]); r == nil {
+			return nil
+		}
 		uri = uri[2+slashIndex:]
 		req.SetRequestURI(uri)
 	} else if altHost := req.Header.Peek("Proxy-Host"); altHost != nil {
-		host = string(altHost)
-		switch host {
-		case "static.vk.com":
-		case "oauth.vk.com":
-		default:
-			return false
+		if r, host = state.routes.find(routeViaProxyHost, string(altHost)); r == nil {
+			return nil
 		}
 		req.Header.Del("Proxy-Host")
+	} else if replaceContext.OriginHost == state.config.BaseStaticDomain && state.routes.staticRoute != nil {
+		// Без nginx перед прокси запросы на статик домен приходят напрямую
+		r, host = state.routes.find(routeViaStatic, "")
 	} else {
-		host = "api.vk.com"
+		r, host = state.routes.find(routeViaDefault, "")
 	}
-	req.SetHost(host)
+	req.SetHost(r.upstreamHost(host))
 
 	// Replace some request data
 	replaceContext.Host = host
 	replaceContext.Path = string(ctx.Path())
-	p.replacer.DoReplaceRequest(req, replaceContext)
+	replaceContext.Rewrite = r.Rewrite
+	rep.DoReplaceRequest(req, replaceContext)
 
 	// After req.URI() call it is impossible to modify URI
-	req.URI().SetScheme("https")
-	if p.config.GzipUpstream {
+	req.URI().SetScheme(r.UpstreamScheme)
+	if r.gzipUpstream(state.config) {
 		req.Header.SetBytesV(fasthttp.HeaderAcceptEncoding, gzip)
 	} else {
 		req.Header.Del(fasthttp.HeaderAcceptEncoding)
 	}
 
 	req.Header.Del(fasthttp.HeaderConnection)
-	return true
+	return r
 }
 
-func (p *Proxy) processProxyResponse(ctx *fasthttp.RequestCtx, replaceContext *replacer.ReplaceContext) error {
+// Если задан cacheKey, то подходящий по заголовкам ответ после замен сохраняется в кеш. Размеры и время этапов
+// записываются в entry для лога запросов.
+func (p *Proxy) processProxyResponse(ctx *fasthttp.RequestCtx, replaceContext *replacer.ReplaceContext,
+	rep *replacer.Replacer, acceptGzip bool, cacheKey string, entry *accessLogEntry) error {
 	res := &ctx.Response
+	store := cacheKey != "" && p.cache.cacheable(res)
 	res.Header.Del(fasthttp.HeaderSetCookie)
 	res.Header.Del(fasthttp.HeaderConnection)
 	res.Header.SetBytesV(fasthttp.HeaderServer, vkProxyName)
 
+	gzipped := bytes.Contains(res.Header.Peek(fasthttp.HeaderContentEncoding), gzip)
+
+	// Ответ, который не нужно менять, отдается клиенту потоком по мере получения от вк. Если клиент не понимает
+	// gzip, то тело все равно придется распаковать целиком. При записи через -record-dir тело нужно целиком.
+	if res.IsBodyStream() && !rep.NeedsResponseBody(res, replaceContext) && (!gzipped || acceptGzip) &&
+		!(store && p.cache.fits(res.Header.ContentLength())) && entry.exchange == nil {
+		rep.DoReplaceResponseHeaders(res, replaceContext)
+		if entry.bytesBefore = res.Header.ContentLength(); entry.bytesBefore < 0 {
+			entry.bytesBefore = 0
+		}
+		return nil
+	}
+
+	// Большой ответ меняется по мере получения, если все его замены это умеют
+	if stream, ok := res.BodyStream().(*bodyStream); ok && !gzipped && entry.exchange == nil &&
+		(res.Header.ContentLength() < 0 || res.Header.ContentLength() > minStreamedRewrite) &&
+		!(store && p.cache.fits(res.Header.ContentLength())) {
+		rewritten := &rewriteReader{source: stream.stream}
+		if rewritten.writer = rep.NewResponseWriter(res, &rewritten.out, replaceContext); rewritten.writer != nil {
+			if entry.bytesBefore = res.Header.ContentLength(); entry.bytesBefore < 0 {
+				entry.bytesBefore = 0
+			}
+			// bodyStream считает байты уже после замен, а длина тела после них неизвестна
+			stream.stream = rewritten
+			res.Header.SetContentLength(-1)
+			return nil
+		}
+	}
+
+	if err := readBody(res); err != nil {
+		return err
+	}
 	var buf *bytebufferpool.ByteBuffer
 	// Gunzip body if needed
-	if bytes.Contains(res.Header.Peek(fasthttp.HeaderContentEncoding), gzip) {
+	if gzipped {
 		res.Header.Del(fasthttp.HeaderContentEncoding)
 		buf = replacer.AcquireBuffer()
+		gunzipStart := time.Now()
 		_, err := fasthttp.WriteGunzip(buf, res.Body())
 		if err != nil {
 			replacer.ReleaseBuffer(buf)
-			return err
+			return gunzipError{err}
+		}
+		entry.gunzipTime = time.Since(gunzipStart)
+		if p.metrics != nil {
+			p.metrics.gunzipDuration.Observe(entry.gunzipTime.Seconds())
 		}
 		replacer.ReleaseBuffer(&bytebufferpool.ByteBuffer{
 			B: res.SwapBody(nil),
@@ -286,40 +898,72 @@ func (p *Proxy) processProxyResponse(ctx *fasthttp.RequestCtx, replaceContext *r
 		}
 	}
 
-	buf = p.replacer.DoReplaceResponse(res, buf, replaceContext)
+	entry.bytesBefore = buf.Len()
+	if entry.exchange != nil {
+		entry.exchange.setUpstreamBody(res.Header.ContentType(), buf.B)
+	}
+	replaceStart := time.Now()
+	buf = rep.DoReplaceResponse(res, buf, replaceContext)
+	entry.replaceTime = time.Since(replaceStart)
+	if p.metrics != nil {
+		p.metrics.replaceDuration.With(hostLabel(replaceContext.Host)).Observe(entry.replaceTime.Seconds())
+	}
 
 	// avoid copying and save old buffer
 	buf.B = res.SwapBody(buf.B)
 	if cap(buf.B) > 10 {
 		replacer.ReleaseBuffer(buf)
 	}
+
+	if store {
+		p.cache.put(cacheKey, res)
+	}
 	return nil
 }
 
+type gunzipError struct {
+	error
+}
+
 type tracker struct {
 	lock        sync.Mutex
 	requests    uint32
 	bytes       uint64
 	uniqueUsers map[string]bool
 	server      *fasthttp.Server
+	tunnels     *tunnelStats
 }
 
-func (t *tracker) start() {
+func (p *Proxy) startTracker() {
 	go func() {
 		for range time.Tick(60 * time.Second) {
-			t.lock.Lock()
-			log.Printf("Requests: %d, Traffic: %s, Online: %d, Concurrency: %d",
-				t.requests, bytefmt.ByteSize(t.bytes), len(t.uniqueUsers),
-				t.server.GetCurrentConcurrency(),
-			)
-			t.requests = 0
-			t.bytes = 0
-			t.uniqueUsers = make(map[string]bool)
-			t.lock.Unlock()
+			// Уровень логирования может поменяться на лету, поэтому тикер работает всегда
+			if p.getConfig().LogVerbosity > 0 {
+				p.tracker.flush()
+			}
 		}
 	}()
 }
 
+func (t *tracker) flush() {
+	t.lock.Lock()
+	log.Printf("Requests: %d, Traffic: %s, Online: %d, Concurrency: %d, Tunnels: %d",
+		t.requests, bytefmt.ByteSize(t.bytes), len(t.uniqueUsers),
+		t.server.GetCurrentConcurrency(), t.tunnels.active.Load(),
+	)
+	t.requests = 0
+	t.bytes = 0
+	t.uniqueUsers = make(map[string]bool)
+	t.lock.Unlock()
+}
+
+// Текущие значения с последнего вывода статистики
+func (t *tracker) snapshot() (requests uint32, bytes uint64, online int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.requests, t.bytes, len(t.uniqueUsers)
+}
+
 func (t *tracker) trackRequest(ip string, size int) {
 	t.lock.Lock()
 
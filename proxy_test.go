@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// Маршрут по умолчанию на апстрим без замен
+const testRoutes = `[
+  {"host": "files.test", "via": ["default", "endpoint", "proxy-host"], "upstream_scheme": "http"},
+  {"host": "static.test", "via": ["static", "endpoint"], "upstream_scheme": "http"}
+]`
+
+// Адрес, с которого к тестовому прокси подключаются клиенты
+var testClientAddr = &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}
+
+// Прокси, все запросы которого к апстримам уходят в upstream. Возвращается клиент, подключенный к прокси.
+func newTestProxy(t *testing.T, config ProxyConfig, upstream fasthttp.RequestHandler) (*Proxy, *fasthttp.Client) {
+	t.Helper()
+	if config.LogRedact == "" {
+		config.LogRedact = logRedactSecrets
+	}
+	if config.RoutesFile == "" {
+		config.RoutesFile = writeTestFile(t, "routes.json", testRoutes)
+	}
+	p, err := NewProxy(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstreamLn := fasthttputil.NewInmemoryListener()
+	go (&fasthttp.Server{Handler: upstream}).Serve(upstreamLn)
+	dial := func(string) (net.Conn, error) {
+		conn, err := upstreamLn.Dial()
+		if err != nil {
+			return nil, err
+		}
+		return newIdleTimeoutConn(conn), nil
+	}
+	p.client.Dial = dial
+	for _, r := range p.state.Load().routes.routes {
+		r.client.Dial = dial
+	}
+
+	proxyLn := fasthttputil.NewInmemoryListener()
+	go p.server.Serve(proxyLn)
+	t.Cleanup(func() {
+		proxyLn.Close()
+		upstreamLn.Close()
+	})
+	return p, &fasthttp.Client{
+		// Без TCP адреса клиент выглядел бы для прокси как клиент на unix сокете, которому доверяются заголовки
+		Dial: func(string) (net.Conn, error) {
+			return proxyLn.DialWithLocalAddr(testClientAddr)
+		},
+		ReadTimeout: 5 * time.Second,
+	}
+}
+
+func writeTestFile(t *testing.T, name, data string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func doTestRequest(t *testing.T, client *fasthttp.Client, uri string, prepare func(req *fasthttp.Request)) *fasthttp.Response {
+	t.Helper()
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(uri)
+	if prepare != nil {
+		prepare(req)
+	}
+	res := &fasthttp.Response{}
+	if err := client.Do(req, res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// Статистика по ответу потоком пишется после отправки тела, поэтому ее приходится подождать
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !done(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestStreamedResponseSize(t *testing.T) {
+	body := strings.Repeat("0123456789", 50000)
+	p, client := newTestProxy(t, ProxyConfig{LogVerbosity: 1}, func(ctx *fasthttp.RequestCtx) {
+		// Без Content-Length, тело уходит чанками
+		ctx.SetBodyStream(strings.NewReader(body), -1)
+	})
+
+	res := doTestRequest(t, client, "http://proxy.test/big", nil)
+	if string(res.Body()) != body {
+		t.Fatalf("unexpected body of %d bytes", len(res.Body()))
+	}
+	waitFor(t, "request stats", func() bool {
+		requests, _, _ := p.tracker.snapshot()
+		return requests == 1
+	})
+	if _, bytes, _ := p.tracker.snapshot(); bytes != uint64(len(body)) {
+		t.Errorf("tracked %d bytes, expected %d", bytes, len(body))
+	}
+}
+
+// Большой ответ, все замены которого умеют работать по частям, меняется потоком, остальные -- целиком
+func TestStreamedRewrite(t *testing.T) {
+	rules := writeTestFile(t, "rules.json", `[
+  {"name": "js-domain", "content_type": ["text/javascript"], "action": "string", "find": "vk.com", "replace": "{domain}"},
+  {"name": "js-id", "content_type": ["text/javascript"], "action": "regex", "find": "proxy\\.test/(\\d+)", "replace": "proxy.test/id$1"},
+  {"name": "text-domain", "content_type": ["text/plain"], "action": "strings", "replaces": [["vk.com", "{domain}"]]}
+]`)
+	body := strings.Repeat("https://vk.com/123 ", 50000)
+	small := strings.Repeat("https://vk.com/123 ", 10)
+	p, client := newTestProxy(t, ProxyConfig{BaseDomain: "proxy.test", RewriteRulesFile: rules, LogVerbosity: 1},
+		func(ctx *fasthttp.RequestCtx) {
+			switch string(ctx.Path()) {
+			case "/big.js":
+				ctx.SetContentType("text/javascript")
+				ctx.SetBodyStream(strings.NewReader(body), -1)
+			case "/small.js":
+				ctx.SetContentType("text/javascript")
+				ctx.SetBodyString(small)
+			case "/big.txt":
+				ctx.SetContentType("text/plain")
+				ctx.SetBodyStream(strings.NewReader(body), -1)
+			}
+		})
+	replaceJs := func(s string) string {
+		s = strings.ReplaceAll(s, "vk.com", "proxy.test")
+		return regexp.MustCompile(`proxy\.test/(\d+)`).ReplaceAllString(s, "proxy.test/id$1")
+	}
+
+	total := 0
+	for _, c := range []struct {
+		path     string
+		expected string
+		streamed bool
+	}{
+		{"/big.js", replaceJs(body), true},
+		{"/small.js", replaceJs(small), false},
+		{"/big.txt", strings.ReplaceAll(body, "vk.com", "proxy.test"), false},
+	} {
+		res := doTestRequest(t, client, "http://proxy.test"+c.path, nil)
+		if string(res.Body()) != c.expected {
+			t.Errorf("%s: unexpected body of %d bytes", c.path, len(res.Body()))
+		}
+		if streamed := res.Header.ContentLength() < 0; streamed != c.streamed {
+			t.Errorf("%s: streamed = %v, expected %v", c.path, streamed, c.streamed)
+		}
+		total += len(c.expected)
+	}
+	waitFor(t, "request stats", func() bool {
+		requests, _, _ := p.tracker.snapshot()
+		return requests == 3
+	})
+	if _, bytes, _ := p.tracker.snapshot(); bytes != uint64(total) {
+		t.Errorf("tracked %d bytes, expected %d", bytes, total)
+	}
+}
+
+// read_timeout маршрута ограничивает ответ, который прокси читает в память, целиком, а ответ, который отдается
+// клиенту потоком, -- только паузами между кусками
+func TestUpstreamReadTimeout(t *testing.T) {
+	routes := writeTestFile(t, "routes.json", `[
+  {"host": "files.test", "via": ["default"], "upstream_scheme": "http", "read_timeout": "300ms"}
+]`)
+	rules := writeTestFile(t, "rules.json", `[
+  {"name": "text", "content_type": ["text/plain"], "action": "strings", "replaces": [["a", "b"]]}
+]`)
+	_, client := newTestProxy(t, ProxyConfig{RoutesFile: routes, RewriteRulesFile: rules}, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetContentType(string(ctx.QueryArgs().Peek("type")))
+		// 5 кусков по 100 мс: дольше таймаута целиком, но без пауз длиннее него
+		ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+			for i := 0; i < 5; i++ {
+				time.Sleep(100 * time.Millisecond)
+				w.WriteString("aaaa")
+				w.Flush()
+			}
+		})
+	})
+
+	res := doTestRequest(t, client, "http://proxy.test/file?type=application/octet-stream", nil)
+	if res.StatusCode() != 200 || string(res.Body()) != strings.Repeat("aaaa", 5) {
+		t.Errorf("streamed response got %d %q", res.StatusCode(), res.Body())
+	}
+	res = doTestRequest(t, client, "http://proxy.test/file?type=text/plain", nil)
+	if res.StatusCode() != fasthttp.StatusRequestTimeout {
+		t.Errorf("buffered response longer than read_timeout got %d %q, expected 408", res.StatusCode(), res.Body())
+	}
+}
+
+// Кусок тела запроса раз в 100 мс
+type slowReader struct {
+	chunks int
+}
+
+func (r *slowReader) Read(b []byte) (int, error) {
+	if r.chunks == 0 {
+		return 0, io.EOF
+	}
+	r.chunks--
+	time.Sleep(100 * time.Millisecond)
+	return copy(b, "aaaa"), nil
+}
+
+// Таймауты сервера ограничивают паузы между кусками тела, которое идет потоком, а не все тело целиком
+func TestStreamedClientTimeouts(t *testing.T) {
+	readTimeout, writeTimeout := serverReadTimeout, serverWriteTimeout
+	serverReadTimeout, serverWriteTimeout = 300*time.Millisecond, 300*time.Millisecond
+	t.Cleanup(func() {
+		serverReadTimeout, serverWriteTimeout = readTimeout, writeTimeout
+	})
+	p, _ := newTestProxy(t, ProxyConfig{}, func(ctx *fasthttp.RequestCtx) {
+		if ctx.IsPost() {
+			ctx.SetBodyString(strconv.Itoa(len(ctx.PostBody())))
+			return
+		}
+		ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+			for i := 0; i < 5; i++ {
+				time.Sleep(100 * time.Millisecond)
+				w.WriteString("aaaa")
+				w.Flush()
+			}
+		})
+	})
+	// Соединение в памяти не соблюдает дедлайн записи, пока читатель успевает
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.server.Serve(ln)
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	client := &fasthttp.Client{
+		Dial: func(string) (net.Conn, error) {
+			return net.Dial("tcp", ln.Addr().String())
+		},
+		ReadTimeout: 5 * time.Second,
+	}
+
+	res := doTestRequest(t, client, "http://proxy.test/download", nil)
+	if res.StatusCode() != 200 || string(res.Body()) != strings.Repeat("aaaa", 5) {
+		t.Errorf("download longer than write timeout got %d %q", res.StatusCode(), res.Body())
+	}
+	res = doTestRequest(t, client, "http://proxy.test/upload", func(req *fasthttp.Request) {
+		req.Header.SetMethod(fasthttp.MethodPost)
+		req.SetBodyStream(&slowReader{chunks: 5}, -1)
+	})
+	if res.StatusCode() != 200 || string(res.Body()) != "20" {
+		t.Errorf("upload longer than read timeout got %d %q", res.StatusCode(), res.Body())
+	}
+}
+
+// Тело больше -max-body-size отвергается сразу по Content-Length, а без него -- когда прочитано больше лимита
+func TestMaxBodySize(t *testing.T) {
+	p, client := newTestProxy(t, ProxyConfig{MaxBodySize: 1024}, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString(strconv.Itoa(len(ctx.Request.Body())))
+	})
+	setPassThroughUpstream(t, p, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString(strconv.Itoa(len(ctx.Request.Body())))
+	})
+	for _, c := range []struct {
+		uri     string
+		size    int
+		chunked bool
+		status  int
+	}{
+		{"/method/docs.save", 1024, false, 200},
+		{"/method/docs.save", 1025, false, fasthttp.StatusRequestEntityTooLarge},
+		{"/method/docs.save", 1024, true, 200},
+		{"/method/docs.save", 2048, true, fasthttp.StatusRequestEntityTooLarge},
+		{"/_/sun9-1.userapi.com/upload", 1024, false, 200},
+		{"/_/sun9-1.userapi.com/upload", 1025, false, fasthttp.StatusRequestEntityTooLarge},
+		{"/_/sun9-1.userapi.com/upload", 2048, true, fasthttp.StatusRequestEntityTooLarge},
+	} {
+		res := doTestRequest(t, client, "http://proxy.test"+c.uri, func(req *fasthttp.Request) {
+			req.Header.SetMethod(fasthttp.MethodPost)
+			if c.chunked {
+				req.SetBodyStream(strings.NewReader(strings.Repeat("x", c.size)), -1)
+			} else {
+				req.SetBodyString(strings.Repeat("x", c.size))
+			}
+		})
+		if res.StatusCode() != c.status {
+			t.Errorf("%s with %d bytes (chunked %v) got %d, expected %d", c.uri, c.size, c.chunked, res.StatusCode(), c.status)
+		} else if c.status == 200 && string(res.Body()) != strconv.Itoa(c.size) {
+			t.Errorf("%s with %d bytes: upstream got %s bytes", c.uri, c.size, res.Body())
+		}
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	keysFile := writeTestFile(t, "keys.txt", "secret-key test\n")
+	config := ProxyConfig{BaseDomain: "proxy.test", LogVerbosity: 1, ReduceMemoryUsage: true, AccessKeysFile: keysFile}
+	p, client := newTestProxy(t, config, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString(string(ctx.Host()) + string(ctx.Path()))
+	})
+	old := p.state.Load()
+
+	// newTestProxy дописывает в настройки файл маршрутов и режим -log-redact
+	config = p.getConfig()
+	config.BaseDomain = "other.test"
+	config.FilterFeed = true
+	config.ReduceMemoryUsage = false
+	if err := p.Reconfigure(config); err != nil {
+		t.Fatal(err)
+	}
+	state := p.state.Load()
+	if state == old {
+		t.Fatal("state was not replaced")
+	}
+	// Запросы, которые уже взяли старое состояние, дорабатывают с ним
+	if old.config.BaseDomain != "proxy.test" || old.replacer.ProxyBaseDomain != "proxy.test" || old.replacer.FilterFeed {
+		t.Errorf("old state was changed: %+v", old.config)
+	}
+	if state.replacer.ProxyBaseDomain != "other.test" || !state.replacer.FilterFeed {
+		t.Errorf("replacer was not rebuilt: %q, filter %v", state.replacer.ProxyBaseDomain, state.replacer.FilterFeed)
+	}
+	// ReduceMemoryUsage меняется только после перезапуска
+	if !state.config.ReduceMemoryUsage {
+		t.Error("ReduceMemoryUsage changed without restart")
+	}
+	// Файлы, которые не менялись, не перечитываются: клиенты маршрутов и статистика ключей остаются прежними
+	if state.routes != old.routes || state.rules != old.rules || state.keys != old.keys {
+		t.Error("unchanged files were reloaded")
+	}
+	if state.config.LogVerbosity != 1 || state.config.AccessKeysFile != keysFile {
+		t.Errorf("unchanged settings were lost: %+v", state.config)
+	}
+	res := doTestRequest(t, client, "http://other.test/a", func(req *fasthttp.Request) {
+		req.Header.Set(accessKeyHeader, "secret-key")
+	})
+	if string(res.Body()) != "files.test/a" {
+		t.Errorf("request after Reconfigure got %d %q", res.StatusCode(), res.Body())
+	}
+
+	// С ошибкой в новых настройках остается прежнее состояние
+	for _, c := range []struct {
+		name   string
+		change func(c *ProxyConfig)
+	}{
+		{"log-redact", func(c *ProxyConfig) { c.LogRedact = "everything" }},
+		{"routes", func(c *ProxyConfig) { c.RoutesFile = writeTestFile(t, "routes.json", `[]`) }},
+		{"missing routes", func(c *ProxyConfig) { c.RoutesFile = filepath.Join(t.TempDir(), "routes.json") }},
+		{"rules", func(c *ProxyConfig) { c.RewriteRulesFile = writeTestFile(t, "rules.json", `{`) }},
+		{"keys", func(c *ProxyConfig) { c.AccessKeysFile = writeTestFile(t, "keys.txt", "a/b\n") }},
+	} {
+		broken := config
+		broken.BaseDomain = "broken.test"
+		c.change(&broken)
+		if err := p.Reconfigure(broken); err == nil {
+			t.Errorf("%s: no error", c.name)
+		}
+		if p.state.Load() != state {
+			t.Errorf("%s: state was replaced", c.name)
+		}
+	}
+}
+
+func TestReloadFiles(t *testing.T) {
+	rulesFile := writeTestFile(t, "rules.json",
+		`[{"name": "a", "action": "string", "find": "x", "replace": "https://{domain}/_/a.example.com/x"}]`)
+	keysFile := writeTestFile(t, "keys.txt", "old-key\n")
+	p, client := newTestProxy(t, ProxyConfig{
+		BaseDomain:       "proxy.test",
+		LogVerbosity:     2,
+		RewriteRulesFile: rulesFile,
+		AccessKeysFile:   keysFile,
+	}, func(ctx *fasthttp.RequestCtx) {})
+	doTestRequest(t, client, "http://proxy.test/a", func(req *fasthttp.Request) {
+		req.Header.Set(accessKeyHeader, "old-key")
+	})
+	old := p.state.Load()
+
+	if err := os.WriteFile(rulesFile,
+		[]byte(`[{"name": "a", "action": "string", "find": "x", "replace": "https://{domain}/_/b.example.com/x"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keysFile, []byte("old-key\nnew-key\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ReloadFiles(); err != nil {
+		t.Fatal(err)
+	}
+	state := p.state.Load()
+	if state == old || state.routes == old.routes {
+		t.Fatal("files were not reloaded")
+	}
+	if state.rules.IsProxiedHost([]byte("a.example.com")) || !state.rules.IsProxiedHost([]byte("b.example.com")) {
+		t.Error("rules were not reloaded")
+	}
+	if state.keys.keys["new-key"] == nil {
+		t.Error("keys were not reloaded")
+	}
+	// Статистика ключа переживает перечитывание
+	if key := state.keys.keys["old-key"]; key != old.keys.keys["old-key"] || key.requests.Load() != 1 {
+		t.Error("old key statistics were lost")
+	}
+	// Настройки из флагов не меняются
+	if state.config.BaseDomain != "proxy.test" || state.config.LogVerbosity != 2 || state.replacer.ProxyBaseDomain != "proxy.test" {
+		t.Errorf("settings changed on reload: %+v", state.config)
+	}
+
+	// С ошибкой в любом из файлов остается прежнее состояние
+	if err := os.WriteFile(rulesFile, []byte(`{`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keysFile, []byte("old-key\nnewer-key\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ReloadFiles(); err == nil {
+		t.Error("no error for broken rules")
+	}
+	if p.state.Load() != state {
+		t.Error("state was replaced after failed reload")
+	}
+}
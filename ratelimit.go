@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Классы запросов, для каждого свои лимиты
+const (
+	limitClassApi = iota
+	limitClassMedia
+	limitClassLongpoll
+	limitClassCount
+)
+
+var (
+	limitClassNames = [limitClassCount]string{"api", "media", "longpoll"}
+
+	actArg         = []byte("act")
+	actACheck      = []byte("a_check")
+	endpointPrefix = []byte("/@")
+
+	// Так же отвечает api.vk.com, приложения на эту ошибку делают паузу и повторяют запрос
+	tooManyRequestsBody = []byte(`{"error":{"error_code":6,"error_msg":"Too many requests per second","request_params":[]}}`)
+)
+
+// Лимит запросов от одного клиента. Задается флагом в виде rate=20,burst=40,concurrency=8, любую часть можно
+// пропустить. Нулевое значение - без ограничений.
+type rateLimit struct {
+	Rate        float64 // запросов в секунду
+	Burst       int     // сколько запросов можно сделать разом после простоя
+	Concurrency int     // одновременных запросов
+}
+
+func (l *rateLimit) Set(value string) error {
+	parsed := rateLimit{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return fmt.Errorf("expected key=value, got %q", part)
+		}
+		var err error
+		switch key {
+		case "rate":
+			parsed.Rate, err = strconv.ParseFloat(val, 64)
+		case "burst":
+			parsed.Burst, err = strconv.Atoi(val)
+		case "concurrency":
+			parsed.Concurrency, err = strconv.Atoi(val)
+		default:
+			return fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+	if parsed.Rate < 0 || parsed.Burst < 0 || parsed.Concurrency < 0 {
+		return fmt.Errorf("limits can not be negative")
+	}
+	if parsed.Rate > 0 && parsed.Burst == 0 {
+		parsed.Burst = int(math.Ceil(parsed.Rate))
+	}
+	*l = parsed
+	return nil
+}
+
+func (l *rateLimit) String() string {
+	var parts []string
+	if l.Rate > 0 {
+		parts = append(parts, "rate="+strconv.FormatFloat(l.Rate, 'f', -1, 64), "burst="+strconv.Itoa(l.Burst))
+	}
+	if l.Concurrency > 0 {
+		parts = append(parts, "concurrency="+strconv.Itoa(l.Concurrency))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *rateLimit) enabled() bool {
+	return l.Rate > 0 || l.Concurrency > 0
+}
+
+// Token bucket и счетчик активных запросов одного клиента
+type clientBucket struct {
+	tokens float64
+	last   time.Time
+	active int
+}
+
+type rateLimiter struct {
+	lock    sync.Mutex
+	clients map[string]*clientBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{clients: make(map[string]*clientBucket)}
+}
+
+// Занимает место под запрос клиента. Если получилось, то после запроса нужно вызвать release.
+func (l *rateLimiter) acquire(client string, limit rateLimit) bool {
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b := l.clients[client]
+	if b == nil {
+		b = &clientBucket{tokens: float64(limit.Burst), last: now}
+		l.clients[client] = b
+	}
+	if limit.Concurrency > 0 && b.active >= limit.Concurrency {
+		return false
+	}
+	if limit.Rate > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+		b.last = now
+		if b.tokens < 1 {
+			return false
+		}
+		b.tokens--
+	}
+	b.active++
+	return true
+}
+
+func (l *rateLimiter) release(client string) {
+	l.lock.Lock()
+	if b := l.clients[client]; b != nil {
+		b.active--
+	}
+	l.lock.Unlock()
+}
+
+func (l *rateLimiter) size() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.clients)
+}
+
+// Удаляет клиентов без активных запросов, у которых бакет уже успел наполниться
+func (l *rateLimiter) cleanup(limit rateLimit) {
+	now := time.Now()
+	l.lock.Lock()
+	for client, b := range l.clients {
+		if b.active == 0 && (limit.Rate == 0 || b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= float64(limit.Burst)) {
+			delete(l.clients, client)
+		}
+	}
+	l.lock.Unlock()
+}
+
+type rateLimiters [limitClassCount]*rateLimiter
+
+func newRateLimiters() *rateLimiters {
+	var limiters rateLimiters
+	for i := range limiters {
+		limiters[i] = newRateLimiter()
+	}
+	return &limiters
+}
+
+func (c *ProxyConfig) rateLimit(class int) rateLimit {
+	switch class {
+	case limitClassMedia:
+		return c.MediaRateLimit
+	case limitClassLongpoll:
+		return c.LongpollRateLimit
+	}
+	return c.ApiRateLimit
+}
+
+// Лонгпулл определяется по параметру act=a_check, он есть у всех версий лонгпулла вк. Остальные запросы через
+// /@ и /_/, а также VKUI на статик домене считаются медиа.
+func limitClassOf(ctx *fasthttp.RequestCtx, config *ProxyConfig) int {
+	if bytes.Equal(ctx.QueryArgs().PeekBytes(actArg), actACheck) {
+		return limitClassLongpoll
+	}
+	uri := ctx.RequestURI()
+	if bytes.HasPrefix(uri, passThroughPrefixBytes) || bytes.HasPrefix(uri, endpointPrefix) ||
+		string(ctx.Host()) == config.BaseStaticDomain {
+		return limitClassMedia
+	}
+	return limitClassApi
+}
+
+func (p *Proxy) startRateLimitCleanup() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			config := p.getConfig()
+			for class, limiter := range p.limiters {
+				limiter.cleanup(config.rateLimit(class))
+			}
+		}
+	}()
+}
+
+func tooManyRequests(ctx *fasthttp.RequestCtx, class int) {
+	ctx.Response.Reset()
+	// На ошибки апи вк отвечает с кодом 200, остальным клиентам нужен нормальный код ответа
+	if class != limitClassApi {
+		ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+		ctx.Response.Header.Set(fasthttp.HeaderRetryAfter, "1")
+	}
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.SetBody(tooManyRequestsBody)
+}
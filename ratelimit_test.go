@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRateLimitSet(t *testing.T) {
+	for value, expected := range map[string]rateLimit{
+		"":                               {},
+		"rate=20,burst=40,concurrency=8": {Rate: 20, Burst: 40, Concurrency: 8},
+		"rate=2.5":                       {Rate: 2.5, Burst: 3},
+		" concurrency=2 , ":              {Concurrency: 2},
+		"burst=5":                        {Burst: 5},
+	} {
+		var l rateLimit
+		if err := l.Set(value); err != nil {
+			t.Errorf("Set(%q): %s", value, err)
+		} else if l != expected {
+			t.Errorf("Set(%q) = %+v, expected %+v", value, l, expected)
+		}
+	}
+	for _, value := range []string{"rate", "rate=x", "speed=1", "rate=-1", "concurrency=-1"} {
+		var l rateLimit
+		if err := l.Set(value); err == nil {
+			t.Errorf("Set(%q) must fail", value)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	limit := rateLimit{Rate: 10, Burst: 3}
+	l := newRateLimiter()
+	for i := 0; i < limit.Burst; i++ {
+		if !l.acquire("a", limit) {
+			t.Fatalf("request %d within burst was limited", i+1)
+		}
+		l.release("a")
+	}
+	if l.acquire("a", limit) {
+		t.Fatal("request over burst must be limited")
+	}
+	if !l.acquire("b", limit) {
+		t.Fatal("limit of one client must not affect others")
+	}
+	l.release("b")
+
+	// За 120 мс при 10 запросах в секунду накапливается один токен
+	time.Sleep(120 * time.Millisecond)
+	if !l.acquire("a", limit) {
+		t.Fatal("bucket must refill over time")
+	}
+	l.release("a")
+	if l.acquire("a", limit) {
+		t.Fatal("only one token must be refilled")
+	}
+
+	// Клиент удаляется, только когда бакет снова полон
+	l.cleanup(limit)
+	if l.size() != 1 {
+		t.Fatalf("got %d clients after cleanup, expected only the client with a full bucket removed", l.size())
+	}
+	time.Sleep(350 * time.Millisecond)
+	l.cleanup(limit)
+	if l.size() != 0 {
+		t.Errorf("got %d clients after cleanup, expected 0", l.size())
+	}
+}
+
+func TestConcurrencyCap(t *testing.T) {
+	limit := rateLimit{Concurrency: 2}
+	l := newRateLimiter()
+	if !l.acquire("a", limit) || !l.acquire("a", limit) {
+		t.Fatal("requests within the cap were limited")
+	}
+	if l.acquire("a", limit) {
+		t.Fatal("request over the cap must be limited")
+	}
+	l.cleanup(limit)
+	if l.size() != 1 {
+		t.Fatal("client with active requests must not be removed")
+	}
+	l.release("a")
+	if !l.acquire("a", limit) {
+		t.Fatal("released place must be available")
+	}
+}
+
+// Место в лимите занято, пока ответ отдается потоком, а не только пока апстрим отвечает заголовками
+func TestConcurrencyCapStreamed(t *testing.T) {
+	finish := make(chan struct{})
+	p, client := newTestProxy(t, ProxyConfig{ApiRateLimit: rateLimit{Concurrency: 1}}, func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) != "/slow" {
+			ctx.SetBodyString("fast")
+			return
+		}
+		ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+			w.WriteString("first ")
+			w.Flush()
+			<-finish
+			w.WriteString("second")
+		})
+	})
+	client.StreamResponseBody = true
+
+	slow := doTestRequest(t, client, "http://proxy.test/slow", nil)
+	chunk := make([]byte, len("first "))
+	if _, err := io.ReadFull(slow.BodyStream(), chunk); err != nil {
+		t.Fatal(err)
+	}
+	if res := doTestRequest(t, client, "http://proxy.test/fast", nil); string(res.Body()) != string(tooManyRequestsBody) {
+		t.Fatalf("request during the streamed response must be limited, got %q", res.Body())
+	}
+
+	close(finish)
+	if rest, err := io.ReadAll(slow.BodyStream()); err != nil || string(rest) != "second" {
+		t.Fatalf("unexpected rest of the body %q, %v", rest, err)
+	}
+	slow.CloseBodyStream()
+	limiter := p.limiters[limitClassApi]
+	waitFor(t, "released place", func() bool {
+		limiter.lock.Lock()
+		defer limiter.lock.Unlock()
+		for _, b := range limiter.clients {
+			if b.active > 0 {
+				return false
+			}
+		}
+		return true
+	})
+	if res := doTestRequest(t, client, "http://proxy.test/fast", nil); string(res.Body()) != "fast" {
+		t.Errorf("request after the streamed response got %q", res.Body())
+	}
+}
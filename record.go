@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/xtrafrancyz/vk-proxy/bytefmt"
+)
+
+// Возвращается в режиме воспроизведения, если для запроса нет записанного ответа
+var errNotRecorded = errors.New("no recorded response for the request")
+
+// Тела запросов больше этого размера не читаются в память: такие запросы не записываются, а при воспроизведении
+// получают 413
+var maxRecordedBody = 4 * bytefmt.MEGABYTE
+
+// Заголовки, значения которых не записываются
+var recordSecretHeaders = map[string]bool{
+	fasthttp.HeaderCookie:        true,
+	fasthttp.HeaderSetCookie:     true,
+	fasthttp.HeaderAuthorization: true,
+	accessKeyHeader:              true,
+}
+
+// Заголовки, которые после записи становятся неверными: тело хранится распакованным и с замаскированными секретами
+var recordSkipHeaders = map[string]bool{
+	fasthttp.HeaderContentLength:    true,
+	fasthttp.HeaderContentEncoding:  true,
+	fasthttp.HeaderTransferEncoding: true,
+	fasthttp.HeaderConnection:       true,
+}
+
+type recordedMessage struct {
+	Method  string      `json:"method,omitempty"`
+	Uri     string      `json:"uri,omitempty"`
+	Status  int         `json:"status,omitempty"`
+	Headers [][2]string `json:"headers,omitempty"`
+	Body    string      `json:"body,omitempty"`
+
+	contentType []byte
+	rawBody     []byte
+}
+
+func (m *recordedMessage) copyHeaders(visit func(func(key, value []byte))) {
+	visit(func(key, value []byte) {
+		name := string(key)
+		if recordSkipHeaders[name] {
+			return
+		}
+		if recordSecretHeaders[name] {
+			value = redactedValue
+		}
+		m.Headers = append(m.Headers, [2]string{name, string(value)})
+	})
+}
+
+func (m *recordedMessage) setBody(contentType, body []byte) {
+	m.contentType = append([]byte(nil), contentType...)
+	m.rawBody = append([]byte(nil), body...)
+}
+
+func (m *recordedMessage) redactBody() {
+	if m.rawBody != nil {
+		m.Body = string(redactBody(logRedactSecrets, m.contentType, m.rawBody))
+	}
+}
+
+// Один запрос к апстриму: запрос после prepareProxyRequest, ответ апстрима до замен и ответ клиенту после них
+type exchange struct {
+	Time     time.Time       `json:"time"`
+	Request  recordedMessage `json:"request"`
+	Upstream recordedMessage `json:"upstream"`
+	Response recordedMessage `json:"response"`
+}
+
+// Тело запроса читается в память: без него все запросы к одному методу апи были бы для воспроизведения одинаковыми.
+// maxBody -- ограничение -max-body-size или 0.
+func newExchange(req *fasthttp.Request, maxBody int) (*exchange, error) {
+	limit := maxRecordedBody
+	if maxBody > 0 && maxBody < limit {
+		limit = maxBody
+	}
+	if err := bufferRequestBody(req, limit); err != nil {
+		return nil, err
+	}
+	e := &exchange{Time: time.Now()}
+	e.Request.Method = string(req.Header.Method())
+	e.Request.Uri = string(redactText(logRedactSecrets, req.URI().FullURI()))
+	e.Request.copyHeaders(req.Header.VisitAll)
+	e.Request.setBody(req.Header.ContentType(), req.Body())
+	e.Request.redactBody()
+	return e, nil
+}
+
+// Заголовки ответа апстрима нужно взять до processProxyResponse, который их меняет. Тело записывается там же
+// после распаковки, при записи ответы не отдаются потоком.
+func (e *exchange) setUpstream(res *fasthttp.Response) {
+	e.Upstream.Status = res.StatusCode()
+	e.Upstream.copyHeaders(res.Header.VisitAll)
+}
+
+func (e *exchange) setUpstreamBody(contentType, body []byte) {
+	e.Upstream.setBody(contentType, body)
+}
+
+// Ключ для поиска записанного ответа. Запрос берется уже с замаскированными секретами, чтобы ключи записи и
+// воспроизведения совпадали.
+func (e *exchange) replayKey() string {
+	return e.Request.Method + " " + e.Request.Uri + " " + e.Request.Body
+}
+
+// Запасной ключ без query и тела запроса
+func (e *exchange) replayPathKey() string {
+	uri := e.Request.Uri
+	if idx := strings.IndexByte(uri, '?'); idx != -1 {
+		uri = uri[:idx]
+	}
+	return e.Request.Method + " " + uri
+}
+
+// Сохраняет каждый обмен с апстримом отдельным JSON файлом в папке -record-dir
+type recorder struct {
+	dir string
+	seq atomic.Uint64
+}
+
+func newRecorder(dir string) (*recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &recorder{dir: dir}, nil
+}
+
+// Ответ записывается с телом целиком. Обычно processProxyResponse при записи уже прочитал его в память.
+func (r *recorder) save(e *exchange, res *fasthttp.Response) {
+	e.Response.Status = res.StatusCode()
+	e.Response.copyHeaders(res.Header.VisitAll)
+	if err := readBody(res); err != nil {
+		log.Printf("Could not record exchange: %s", err)
+		return
+	}
+	e.Response.setBody(res.Header.ContentType(), res.Body())
+	name := fmt.Sprintf("%s-%06d-%s.json", e.Time.Format("20060102-150405.000"), r.seq.Add(1),
+		recordFileSuffix(e.replayPathKey()))
+	go func() {
+		e.Upstream.redactBody()
+		e.Response.redactBody()
+		data, err := json.MarshalIndent(e, "", "  ")
+		if err == nil {
+			// Через временный файл, чтобы в папке не появлялись недописанные записи
+			path := filepath.Join(r.dir, name)
+			if err = os.WriteFile(path+".tmp", data, 0644); err == nil {
+				err = os.Rename(path+".tmp", path)
+			}
+		}
+		if err != nil {
+			log.Printf("Could not record exchange: %s", err)
+		}
+	}()
+}
+
+// Часть имени файла из метода, домена и пути, чтобы записи было удобно искать
+func recordFileSuffix(key string) string {
+	key = strings.Replace(strings.Replace(key, "https://", "", 1), "http://", "", 1)
+	suffix := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, key)
+	if len(suffix) > 100 {
+		suffix = suffix[:100]
+	}
+	return suffix
+}
+
+// Отдает записанные ответы апстрима вместо запросов в вк. Если одному запросу соответствует несколько записей, то
+// они отдаются по очереди.
+type replayer struct {
+	lock   sync.Mutex
+	exact  map[string][]*exchange
+	byPath map[string][]*exchange
+	next   map[string]int
+}
+
+func newReplayer(dir string) (*replayer, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	// Имена начинаются со времени записи
+	sort.Strings(files)
+	r := &replayer{
+		exact:  make(map[string][]*exchange),
+		byPath: make(map[string][]*exchange),
+		next:   make(map[string]int),
+	}
+	loaded := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		e := &exchange{}
+		if err = json.Unmarshal(data, e); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if e.Upstream.Status == 0 {
+			continue
+		}
+		r.exact[e.replayKey()] = append(r.exact[e.replayKey()], e)
+		r.byPath[e.replayPathKey()] = append(r.byPath[e.replayPathKey()], e)
+		loaded++
+	}
+	if loaded == 0 {
+		return nil, fmt.Errorf("%s: no recorded exchanges", dir)
+	}
+	log.Printf("Replaying %d recorded exchanges from %s", loaded, dir)
+	return r, nil
+}
+
+// Записывает в ответ сохраненный ответ апстрима. Дальше он обрабатывается так же, как настоящий.
+func (r *replayer) serve(req *fasthttp.Request, res *fasthttp.Response, maxBody int) error {
+	key, err := newExchange(req, maxBody)
+	if err != nil {
+		return err
+	}
+	e := r.find(key)
+	if e == nil {
+		return errNotRecorded
+	}
+	res.Reset()
+	res.SetStatusCode(e.Upstream.Status)
+	for _, header := range e.Upstream.Headers {
+		res.Header.Add(header[0], header[1])
+	}
+	res.SetBodyString(e.Upstream.Body)
+	return nil
+}
+
+func (r *replayer) find(req *exchange) *exchange {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := req.replayKey()
+	list := r.exact[key]
+	if list == nil {
+		key = req.replayPathKey()
+		list = r.byPath[key]
+	}
+	if list == nil {
+		return nil
+	}
+	i := r.next[key]
+	r.next[key] = (i + 1) % len(list)
+	return list[i]
+}
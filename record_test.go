@@ -0,0 +1,138 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Запросы с разным телом к одному методу и ответ потоком должны после записи воспроизводиться как были
+func TestRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	big := strings.Repeat("0123456789", 50000)
+	p, client := newTestProxy(t, ProxyConfig{}, func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) == "/big" {
+			ctx.SetBodyStream(strings.NewReader(big), -1)
+			return
+		}
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"response":"` + string(ctx.PostArgs().Peek("x")) + `"}`)
+	})
+	if err := p.EnableRecording(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(client *fasthttp.Client, x string) string {
+		res := doTestRequest(t, client, "http://proxy.test/method/users.get", func(req *fasthttp.Request) {
+			req.Header.SetMethod(fasthttp.MethodPost)
+			req.Header.SetContentType("application/x-www-form-urlencoded")
+			req.SetBodyString("x=" + x)
+		})
+		return string(res.Body())
+	}
+	get := func(client *fasthttp.Client) (int, string) {
+		res := doTestRequest(t, client, "http://proxy.test/big", nil)
+		return res.StatusCode(), string(res.Body())
+	}
+
+	expected := map[string]string{"1": `{"response":"1"}`, "2": `{"response":"2"}`}
+	for x, body := range expected {
+		if got := post(client, x); got != body {
+			t.Fatalf("recording: x=%s got %q", x, got)
+		}
+	}
+	if status, body := get(client); status != 200 || body != big {
+		t.Fatalf("recording: streamed response %d with %d bytes", status, len(body))
+	}
+	waitFor(t, "recorded files", func() bool {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+		return len(files) == 3
+	})
+
+	p, client = newTestProxy(t, ProxyConfig{}, func(ctx *fasthttp.RequestCtx) {
+		t.Errorf("replay must not reach upstream: %s", ctx.Path())
+	})
+	if err := p.EnableReplay(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []string{"2", "1", "2"} {
+		if got := post(client, x); got != expected[x] {
+			t.Errorf("replay: x=%s got %q, expected %q", x, got, expected[x])
+		}
+	}
+	if status, body := get(client); status != 200 || body != big {
+		t.Errorf("replay: streamed response %d with %d bytes", status, len(body))
+	}
+}
+
+// Content-Length присылает клиент: по нему тело только отвергается, но память под него не выделяется
+func TestBufferRequestBody(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		body   string
+		length int
+		err    error
+	}{
+		{"fits", "0123456789", 10, nil},
+		{"fits chunked", "0123456789", -1, nil},
+		{"too large", "0123456789a", 11, fasthttp.ErrBodyTooLarge},
+		{"too large chunked", "0123456789a", -1, fasthttp.ErrBodyTooLarge},
+		{"huge content length", "", 1 << 40, fasthttp.ErrBodyTooLarge},
+	} {
+		req := &fasthttp.Request{}
+		req.SetBodyStream(strings.NewReader(c.body), c.length)
+		err := bufferRequestBody(req, 10)
+		if err != c.err {
+			t.Errorf("%s: got error %v, expected %v", c.name, err, c.err)
+		} else if err == nil && (req.IsBodyStream() || string(req.Body()) != c.body) {
+			t.Errorf("%s: buffered body %q", c.name, req.Body())
+		}
+	}
+}
+
+// Большая загрузка при записи проксируется, но не записывается, а при воспроизведении получает 413
+func TestRecordLargeBody(t *testing.T) {
+	limit := maxRecordedBody
+	maxRecordedBody = 1024
+	t.Cleanup(func() {
+		maxRecordedBody = limit
+	})
+	dir := t.TempDir()
+	large := strings.Repeat("x", maxRecordedBody+1)
+	p, client := newTestProxy(t, ProxyConfig{}, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString(strconv.Itoa(len(ctx.Request.Body())))
+	})
+	if err := p.EnableRecording(dir); err != nil {
+		t.Fatal(err)
+	}
+	upload := func(client *fasthttp.Client, body string) *fasthttp.Response {
+		return doTestRequest(t, client, "http://proxy.test/upload", func(req *fasthttp.Request) {
+			req.Header.SetMethod(fasthttp.MethodPost)
+			req.SetBodyString(body)
+		})
+	}
+	if res := upload(client, large); res.StatusCode() != 200 || string(res.Body()) != strconv.Itoa(len(large)) {
+		t.Fatalf("large upload while recording got %d %q", res.StatusCode(), res.Body())
+	}
+	if res := upload(client, "small"); res.StatusCode() != 200 {
+		t.Fatalf("small upload while recording got %d", res.StatusCode())
+	}
+	waitFor(t, "recorded files", func() bool {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+		return len(files) == 1
+	})
+
+	p, client = newTestProxy(t, ProxyConfig{}, nil)
+	if err := p.EnableReplay(dir); err != nil {
+		t.Fatal(err)
+	}
+	if res := upload(client, large); res.StatusCode() != fasthttp.StatusRequestEntityTooLarge {
+		t.Errorf("large upload while replaying got %d", res.StatusCode())
+	}
+	if res := upload(client, "small"); res.StatusCode() != 200 || string(res.Body()) != "5" {
+		t.Errorf("small upload while replaying got %d %q", res.StatusCode(), res.Body())
+	}
+}
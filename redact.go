@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Режимы -log-redact
+const (
+	// Маскируются токены, секреты, пароли, телефоны и подписи
+	logRedactSecrets = "secrets"
+	// Из JSON остаются только ключи и структура, все значения маскируются. Для отладки на общем сервере.
+	logRedactAll = "all"
+	// Все пишется как есть, только для локальной отладки
+	logRedactNone = "none"
+)
+
+var (
+	redactedValue      = []byte("***")
+	redactedJsonString = []byte(`"***"`)
+	redactedJsonNumber = []byte("0")
+	jsonContentType    = []byte("json")
+	formContentType    = []byte("application/x-www-form-urlencoded")
+	queryParamRegexp   = regexp.MustCompile(`([A-Za-z_]+)=([^&\s"'\\,;]*)`)
+	phoneRegexp        = regexp.MustCompile(`(?:\+|\b)[78]\s?\(?9\d{2}\)?[\s-]?\d{3}[\s-]?\d{2}[\s-]?\d{2}\b|\+\d{10,14}\b`)
+	sensitiveKeys      = map[string]bool{
+		"token": true, "code": true, "secret": true, "password": true, "passwd": true, "pass": true, "sig": true,
+		"hash": true, "phone": true, "sid": true, "key": true, "auth": true,
+	}
+	sensitiveKeySuffixes = []string{"_token", "_secret", "_password", "_hash", "_sig", "_phone", "_key"}
+)
+
+func validateLogRedact(mode string) error {
+	switch mode {
+	case logRedactSecrets, logRedactAll, logRedactNone:
+		return nil
+	}
+	return fmt.Errorf("unknown log-redact mode %q, expected secrets, all or none", mode)
+}
+
+func isSensitiveKey(key []byte) bool {
+	lower := strings.ToLower(string(key))
+	if sensitiveKeys[lower] {
+		return true
+	}
+	for _, suffix := range sensitiveKeySuffixes {
+		if strings.HasSuffix(lower, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Маскирует значения чувствительных параметров вида key=value (query string, form body, текст ошибки) и телефоны
+func redactText(mode string, text []byte) []byte {
+	if mode == logRedactNone || len(text) == 0 {
+		return text
+	}
+	text = queryParamRegexp.ReplaceAllFunc(text, func(param []byte) []byte {
+		eq := bytes.IndexByte(param, '=')
+		if mode == logRedactAll || isSensitiveKey(param[:eq]) {
+			return append(append([]byte(nil), param[:eq+1]...), redactedValue...)
+		}
+		return param
+	})
+	return phoneRegexp.ReplaceAll(text, redactedValue)
+}
+
+func redactString(mode string, text string) string {
+	if mode == logRedactNone {
+		return text
+	}
+	return string(redactText(mode, []byte(text)))
+}
+
+// Ключ доступа в начале пути не должен попасть в лог, даже неверный
+func redactPath(mode string, path []byte) []byte {
+	if mode != logRedactNone && bytes.HasPrefix(path, accessKeyPrefixBytes) {
+		if end := bytes.IndexByte(path[len(accessKeyPrefix):], '/'); end != -1 {
+			return append(append([]byte(accessKeyPrefix), redactedValue...), path[len(accessKeyPrefix)+end:]...)
+		}
+		return append([]byte(accessKeyPrefix), redactedValue...)
+	}
+	return path
+}
+
+// Тело запроса или ответа для лога. JSON разбирается по токенам, остальное обрабатывается как текст.
+func redactBody(mode string, contentType []byte, body []byte) []byte {
+	if mode == logRedactNone || len(body) == 0 {
+		return body
+	}
+	if bytes.Contains(contentType, jsonContentType) ||
+		len(contentType) == 0 && (body[0] == '{' || body[0] == '[') {
+		return redactJson(mode, body)
+	}
+	if mode == logRedactAll && !bytes.Contains(contentType, formContentType) {
+		return []byte(fmt.Sprintf("<%d bytes of %s>", len(body), contentType))
+	}
+	return redactText(mode, body)
+}
+
+// Проходит по JSON без полного разбора: значения чувствительных ключей заменяются на "***" или 0, в остальных
+// строках маскируются параметры ссылок и телефоны. Объекты и массивы под чувствительным ключом маскируются
+// целиком. Некорректный JSON тоже обрабатывается, но хуже: строка в объекте после { или , считается ключом, даже
+// если за ней нет двоеточия.
+func redactJson(mode string, body []byte) []byte {
+	out := make([]byte, 0, len(body))
+	levels := []jsonLevel{{}}
+	sensitive := func() bool {
+		level := &levels[len(levels)-1]
+		return mode == logRedactAll || level.sensitive || level.key != nil && isSensitiveKey(level.key)
+	}
+	// Последний значимый символ перед текущим
+	var prev byte
+	for i := 0; i < len(body); {
+		c := body[i]
+		switch {
+		case c == '"':
+			end := jsonStringEnd(body, i)
+			str := body[i:end]
+			if isJsonKey(body, end) || levels[len(levels)-1].object && (prev == '{' || prev == ',') {
+				levels[len(levels)-1].key = unescapeJsonKey(str)
+				out = append(out, str...)
+			} else if sensitive() {
+				out = append(out, redactedJsonString...)
+			} else {
+				out = append(out, redactText(mode, str)...)
+			}
+			i, prev = end, c
+			continue
+		case c == '-' || c >= '0' && c <= '9':
+			end := i + 1
+			for end < len(body) && strings.IndexByte("0123456789.eE+-", body[end]) != -1 {
+				end++
+			}
+			if sensitive() {
+				out = append(out, redactedJsonNumber...)
+			} else {
+				out = append(out, body[i:end]...)
+			}
+			i, prev = end, c
+			continue
+		case c == '{' || c == '[':
+			levels = append(levels, jsonLevel{object: c == '{', sensitive: sensitive()})
+		case c == '}' || c == ']':
+			if len(levels) > 1 {
+				levels = levels[:len(levels)-1]
+			}
+		}
+		out = append(out, c)
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			prev = c
+		}
+		i++
+	}
+	return out
+}
+
+// Ключ без кавычек. Экранированный ключ (access\u005ftoken) раскодируется, чтобы его нельзя было спрятать от
+// isSensitiveKey.
+func unescapeJsonKey(str []byte) []byte {
+	if bytes.IndexByte(str, '\\') == -1 {
+		return str[1 : len(str)-1]
+	}
+	var key string
+	if err := json.Unmarshal(str, &key); err != nil {
+		return str[1 : len(str)-1]
+	}
+	return []byte(key)
+}
+
+// Уровень вложенности JSON для redactJson
+type jsonLevel struct {
+	object bool
+	// Последний ключ в объекте
+	key []byte
+	// Объект или массив лежит под чувствительным ключом
+	sensitive bool
+}
+
+// Индекс после закрывающей кавычки строки, которая начинается в start
+func jsonStringEnd(body []byte, start int) int {
+	for i := start + 1; i < len(body); i++ {
+		switch body[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return len(body)
+}
+
+func isJsonKey(body []byte, end int) bool {
+	for ; end < len(body); end++ {
+		switch body[end] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case ':':
+			return true
+		}
+		return false
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRedactJson(t *testing.T) {
+	for _, c := range []struct {
+		name, body, secrets, all string
+	}{
+		{
+			"nested keys",
+			`{"response":{"access_token":"abc","user":{"id":1,"secret_key":"s"},"items":[{"token":"t"}]}}`,
+			`{"response":{"access_token":"***","user":{"id":1,"secret_key":"***"},"items":[{"token":"***"}]}}`,
+			`{"response":{"access_token":"***","user":{"id":0,"secret_key":"***"},"items":[{"token":"***"}]}}`,
+		},
+		{
+			"key suffixes and numbers",
+			`{"key":"k","refresh_token":"r","Webhook_Secret":"w","access_token":12345,"count":2}`,
+			`{"key":"***","refresh_token":"***","Webhook_Secret":"***","access_token":0,"count":2}`,
+			`{"key":"***","refresh_token":"***","Webhook_Secret":"***","access_token":0,"count":0}`,
+		},
+		{
+			"values under sensitive key",
+			`{"secret_key":["a","b"],"auth":{"user":"x","ids":[1,2]},"tokens":["a"]}`,
+			`{"secret_key":["***","***"],"auth":{"user":"***","ids":[0,0]},"tokens":["a"]}`,
+			`{"secret_key":["***","***"],"auth":{"user":"***","ids":[0,0]},"tokens":["***"]}`,
+		},
+		{
+			"links and phones in strings",
+			`{"text":"call +79161234567 or see https://x.com/?access_token=zz&v=1"}`,
+			`{"text":"call *** or see https://x.com/?access_token=***&v=1"}`,
+			`{"text":"***"}`,
+		},
+		{
+			"escaped strings",
+			`{"a":"he said \"token=abc\" ok","access\u005ftoken":"v","b\"c":"d","access_token":"x\"y"}`,
+			`{"a":"he said \"token=***\" ok","access\u005ftoken":"***","b\"c":"d","access_token":"***"}`,
+			`{"a":"***","access\u005ftoken":"***","b\"c":"***","access_token":"***"}`,
+		},
+		{
+			"whitespace",
+			"{\n  \"access_token\" : \"abc\",\n  \"v\" : \"5.131\"\n}",
+			"{\n  \"access_token\" : \"***\",\n  \"v\" : \"5.131\"\n}",
+			"{\n  \"access_token\" : \"***\",\n  \"v\" : \"***\"\n}",
+		},
+		{
+			"array of objects",
+			`[{"refresh_token":"r"},"plain"]`,
+			`[{"refresh_token":"***"},"plain"]`,
+			`[{"refresh_token":"***"},"***"]`,
+		},
+		{
+			"unterminated string",
+			`{"access_token":"abc`,
+			`{"access_token":"***"`,
+			`{"access_token":"***"`,
+		},
+		{
+			"missing colon",
+			`{"a":"b",,"access_token" "x"}`,
+			`{"a":"b",,"access_token" "***"}`,
+			`{"a":"***",,"access_token" "***"}`,
+		},
+		{
+			"unbalanced brackets",
+			`]]{"token":"t"}}}`,
+			`]]{"token":"***"}}}`,
+			`]]{"token":"***"}}}`,
+		},
+	} {
+		if got := string(redactJson(logRedactSecrets, []byte(c.body))); got != c.secrets {
+			t.Errorf("%s: secrets\n got      %s\n expected %s", c.name, got, c.secrets)
+		}
+		if got := string(redactJson(logRedactAll, []byte(c.body))); got != c.all {
+			t.Errorf("%s: all\n got      %s\n expected %s", c.name, got, c.all)
+		}
+		if got := string(redactBody(logRedactNone, []byte("application/json"), []byte(c.body))); got != c.body {
+			t.Errorf("%s: none changed body to %s", c.name, got)
+		}
+	}
+}
+
+func TestRedactText(t *testing.T) {
+	for _, c := range []struct {
+		text, secrets, all string
+	}{
+		{"access_token=abc&v=5.131&user_id=1", "access_token=***&v=5.131&user_id=1", "access_token=***&v=***&user_id=***"},
+		{"phone=+79161234567&password=qwerty&api_key=k", "phone=***&password=***&api_key=***", "phone=***&password=***&api_key=***"},
+		{
+			`Get "https://api.vk.com/method/users.get?access_token=abc&v=5": dial tcp: i/o timeout`,
+			`Get "https://api.vk.com/method/users.get?access_token=***&v=5": dial tcp: i/o timeout`,
+			`Get "https://api.vk.com/method/users.get?access_token=***&v=***": dial tcp: i/o timeout`,
+		},
+		{"client_secret=s; sig=1a2b, code=c", "client_secret=***; sig=***, code=***", "client_secret=***; sig=***, code=***"},
+		{"8 (916) 123-45-67 and 89161234567", "*** and ***", "*** and ***"},
+		{"no secrets here", "no secrets here", "no secrets here"},
+		{"", "", ""},
+	} {
+		if got := redactString(logRedactSecrets, c.text); got != c.secrets {
+			t.Errorf("secrets %q = %q, expected %q", c.text, got, c.secrets)
+		}
+		if got := redactString(logRedactAll, c.text); got != c.all {
+			t.Errorf("all %q = %q, expected %q", c.text, got, c.all)
+		}
+		if got := redactString(logRedactNone, c.text); got != c.text {
+			t.Errorf("none %q = %q", c.text, got)
+		}
+	}
+}
+
+func TestRedactPath(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/~secret/method/users.get": "/~***/method/users.get",
+		"/~secret/":                 "/~***/",
+		"/~secret":                  "/~***",
+		"/~":                        "/~***",
+		"/method/users.get":         "/method/users.get",
+		"/_/sun9-1.userapi.com/~a":  "/_/sun9-1.userapi.com/~a",
+	} {
+		for _, mode := range []string{logRedactSecrets, logRedactAll} {
+			if got := string(redactPath(mode, []byte(path))); got != expected {
+				t.Errorf("%s %q = %q, expected %q", mode, path, got, expected)
+			}
+		}
+		if got := string(redactPath(logRedactNone, []byte(path))); got != path {
+			t.Errorf("none %q = %q", path, got)
+		}
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	for _, c := range []struct {
+		mode, contentType, body, expected string
+	}{
+		{logRedactSecrets, "application/json; charset=utf-8", `{"token":"x"}`, `{"token":"***"}`},
+		{logRedactSecrets, "", `{"token":"x"}`, `{"token":"***"}`},
+		{logRedactSecrets, "", `[{"token":"x"}]`, `[{"token":"***"}]`},
+		{logRedactSecrets, "application/x-www-form-urlencoded", "access_token=x&v=5.131", "access_token=***&v=5.131"},
+		{logRedactAll, "application/x-www-form-urlencoded", "access_token=x&v=5.131", "access_token=***&v=***"},
+		{logRedactSecrets, "text/plain", "password=x", "password=***"},
+		{logRedactAll, "text/plain", "hello password=x", "<16 bytes of text/plain>"},
+		{logRedactAll, "image/png", "\x89PNG", "<4 bytes of image/png>"},
+		{logRedactNone, "application/x-www-form-urlencoded", "access_token=x", "access_token=x"},
+		{logRedactSecrets, "application/json", "", ""},
+	} {
+		if got := string(redactBody(c.mode, []byte(c.contentType), []byte(c.body))); got != c.expected {
+			t.Errorf("%s %s %q = %q, expected %q", c.mode, c.contentType, c.body, got, c.expected)
+		}
+	}
+}
+
+func TestValidateLogRedact(t *testing.T) {
+	for _, mode := range []string{logRedactSecrets, logRedactAll, logRedactNone} {
+		if err := validateLogRedact(mode); err != nil {
+			t.Error(err)
+		}
+	}
+	if validateLogRedact("") == nil || validateLogRedact("some") == nil {
+		t.Error("unknown mode must fail")
+	}
+}
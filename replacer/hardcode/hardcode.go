@@ -2,34 +2,18 @@ package hardcode
 
 import (
 	"bytes"
+	"io"
 	"sync"
 	"unicode/utf8"
 
 	"github.com/valyala/bytebufferpool"
+	"github.com/xtrafrancyz/vk-proxy/replacer/x"
 )
 
 var (
-	userapiStr            = []byte("userapi")
-	vkuserStr             = []byte("vkuser")
-	vkcdnStr              = []byte("vk-cdn")
-	vkStr                 = []byte("vk")
-	mycdnStr              = []byte("mycdn")
-	comStr                = []byte("com")
-	netStr                = []byte("net")
-	meStr                 = []byte("me")
-	videoStr              = []byte("video")
-	audioStr              = []byte("audio")
-	liveStr               = []byte("live")
-	m3u8Str               = []byte(".m3u8")
 	escapedSlashStr       = []byte(`\/`)
 	escapedDoubleSlashStr = []byte(`\/\/`)
 	jsonHttpsStr          = []byte(`"https:`)
-	docPathStr            = []byte(`doc`)
-	imagesPathStr         = []byte(`images\/`)
-	imagesPath2Str        = []byte(`\/images\/`)
-	stickerPathStr        = []byte(`sticker`)
-	stickersPathEndingStr = []byte(`s_`)
-	videoHlsStr           = []byte(`video_hls.php`)
 
 	domainChars = func() (as asciiSet) {
 		for i := 'a'; i <= 'z'; i++ {
@@ -50,10 +34,6 @@ var (
 		i := make([]insertion, 0, 32)
 		return &i
 	}}
-
-	parsedUriPool = sync.Pool{New: func() interface{} {
-		return &parsedUri{}
-	}}
 )
 
 const (
@@ -63,19 +43,23 @@ const (
 )
 
 type HardcodedDomainReplaceConfig struct {
-	Pool *bytebufferpool.Pool
+	Pool x.BufferPool
 
 	// Домен, который просто пропускает трафик через себя без обработки, обычно domain.com\/_\/
 	SimpleReplace string
 
 	// Домен для замены с обработкой, обычно domain.com\/@
 	SmartReplace string
+
+	// Какие ссылки менять, по умолчанию DefaultHosts
+	Hosts *HostTable
 }
 
 type hardcodedDomainReplace struct {
-	pool   *bytebufferpool.Pool
+	pool   x.BufferPool
 	simple []byte
 	smart  []byte
+	hosts  *HostTable
 }
 
 type insertion struct {
@@ -83,20 +67,8 @@ type insertion struct {
 	content []byte
 }
 
-type parsedUri struct {
-	host [][]byte
-}
-
-func (u *parsedUri) prepareHost() [][]byte {
-	if u.host == nil {
-		u.host = make([][]byte, 3, 3)
-	} else {
-		u.host = u.host[:3]
-	}
-	return u.host
-}
-
-func (u *parsedUri) getPath(s []byte, offset int) []byte {
+// Путь ссылки после домена, который заканчивается в s на offset
+func linkPath(s []byte, offset int) []byte {
 	if offset+5 > len(s) || s[offset] != '\\' {
 		return nil
 	}
@@ -110,36 +82,88 @@ func (u *parsedUri) getPath(s []byte, offset int) []byte {
 //    -> "https:\/\/proxy_domain\/@vk.com\/video_hls.php
 // - "https:\\/\\/vk\.com\\/((?:\\/)?images\\/|sticker(:?\\/|s_)|doc-?[0-9]+_)
 //    -> "https:\/\/proxy_domain\/_\/vk.com\/$1
+//
+// Домены и пути берутся из таблицы config.Hosts, регулярки выше соответствуют DefaultHosts.
 func NewHardcodedDomainReplace(config HardcodedDomainReplaceConfig) *hardcodedDomainReplace {
 	v := &hardcodedDomainReplace{
 		pool:   config.Pool,
 		simple: []byte(config.SimpleReplace),
 		smart:  []byte(config.SmartReplace),
+		hosts:  config.Hosts,
+	}
+	if v.hosts == nil {
+		v.hosts = defaultHostTable
 	}
 	return v
 }
 
 func (v *hardcodedDomainReplace) Apply(input *bytebufferpool.ByteBuffer) *bytebufferpool.ByteBuffer {
 	// Быстрый путь для ответов без ссылок
-	index := bytes.Index(input.B, escapedDoubleSlashStr)
-	if index == -1 {
+	if bytes.Index(input.B, escapedDoubleSlashStr) == -1 {
 		return input
 	}
 
-	offset := index
 	inputLen := len(input.B)
 
-	uri := parsedUriPool.Get().(*parsedUri)
 	_insertion := insertionsPool.Get().(*[]insertion)
-	insertions := *_insertion
+	insertions, _ := v.findInsertions(input.B, 0, inputLen, (*_insertion)[:0])
 	defer func() {
 		*_insertion = insertions[:0]
 		insertionsPool.Put(_insertion)
 	}()
 
+	if len(insertions) == 0 {
+		return input
+	}
+
+	neededLength := inputLen
+	for _, ins := range insertions {
+		neededLength += len(ins.content)
+	}
+
+	output := v.pool.Get()
+	if cap(output.B) < neededLength {
+		output.B = make([]byte, 0, roundUpToPowerOfTwo(neededLength))
+	}
+
+	lastAppend := 0
+	for _, ins := range insertions {
+		output.B = append(append(output.B, input.B[lastAppend:ins.offset]...), ins.content...)
+		lastAppend = ins.offset
+	}
+	output.B = append(output.B, input.B[lastAppend:]...)
+
+	v.pool.Put(input)
+	return output
+}
+
+func (v *hardcodedDomainReplace) NewWriter(w io.Writer) io.WriteCloser {
+	return x.NewStreamWriter(w, jsonHttpsLen, streamLookahead(v.hosts), v.process)
+}
+
+func (v *hardcodedDomainReplace) process(dst, src []byte, from, limit int) ([]byte, int) {
+	_insertion := insertionsPool.Get().(*[]insertion)
+	insertions, next := v.findInsertions(src, from, limit, (*_insertion)[:0])
+	lastAppend := from
+	for _, ins := range insertions {
+		dst = append(append(dst, src[lastAppend:ins.offset]...), ins.content...)
+		lastAppend = ins.offset
+	}
+	dst = append(dst, src[lastAppend:next]...)
+	*_insertion = insertions[:0]
+	insertionsPool.Put(_insertion)
+	return dst, next
+}
+
+// Ищет ссылки, которые начинаются в input[from:limit], и возвращает места вставки домена прокси и позицию,
+// с которой нужно продолжить поиск
+func (v *hardcodedDomainReplace) findInsertions(input []byte, from, limit int, insertions []insertion) ([]insertion, int) {
+	offset := from
+	inputLen := len(input)
+
 	for {
-		index = bytes.Index(input.B[offset:], escapedDoubleSlashStr)
-		if index == -1 {
+		index := bytes.Index(input[offset:], escapedDoubleSlashStr)
+		if index == -1 || offset+index >= limit {
 			break
 		}
 		match := offset + index
@@ -149,98 +173,22 @@ func (v *hardcodedDomainReplace) Apply(input *bytebufferpool.ByteBuffer) *bytebu
 		}
 
 		// Проверка на то что ссылка начинается с http и стоит в начале json строки
-		if match < jsonHttpsLen || !bytes.Equal(input.B[match-jsonHttpsLen:match], jsonHttpsStr) {
+		if match < jsonHttpsLen || !bytes.Equal(input[match-jsonHttpsLen:match], jsonHttpsStr) {
 			continue
 		}
 
 		// Чтение домена
-		domainLength := bytes.Index(input.B[offset:min(inputLen, offset+maxDomainPartLen*3)], escapedSlashStr)
+		domainLength := bytes.Index(input[offset:min(inputLen, offset+maxDomainPartLen*3)], escapedSlashStr)
 		if domainLength == -1 {
 			continue
 		}
 
-		// Проверка домена на допустимые символы
-		uri.host = split(input.B[offset:offset+domainLength], '.', uri.prepareHost())
-		for _, part := range uri.host {
-			if len(part) > maxDomainPartLen || !testDomainPart(part) {
-				continue
-			}
-		}
-
+		// Ссылки на домены не из таблицы пропускаются
 		ins := v.simple
-		// Проверка что домен можно проксировать
-		if len(uri.host) == 2 {
-			if bytes.Equal(uri.host[0], vkStr) && bytes.Equal(uri.host[1], comStr) { // vk.com
-				path := uri.getPath(input.B, offset+domainLength)
-				if bytes.HasPrefix(path, docPathStr) { // vk.com/doc[-0-9]*
-					c := path[len(docPathStr)]
-					if c != '-' && !(c >= '0' && c <= '9') {
-						continue
-					}
-				} else if bytes.HasPrefix(path, imagesPathStr) || bytes.HasPrefix(path, imagesPath2Str) { // vk.com//?images/*
-					// allow
-				} else if bytes.HasPrefix(path, stickerPathStr) { // vk.com/sticker*
-					path2 := path[len(stickerPathStr):]
-					if !bytes.HasPrefix(path2, escapedSlashStr) && // vk.com/sticker/*
-						!bytes.HasPrefix(path2, stickersPathEndingStr) { // vk.com/stickers_
-						continue
-					}
-				} else if bytes.HasPrefix(path, videoHlsStr) {
-					ins = v.smart
-				} else {
-					continue
-				}
-			} else {
-				continue
-			}
-		} else if len(uri.host) == 3 {
-			if bytes.Equal(uri.host[1], userapiStr) { // *.userapi.com
-				if !bytes.Equal(uri.host[2], comStr) {
-					continue
-				}
-			} else if bytes.Equal(uri.host[1], vkcdnStr) { // *.vk-cdn.net
-				if !bytes.Equal(uri.host[2], netStr) {
-					continue
-				}
-			} else if bytes.Equal(uri.host[1], mycdnStr) { // *.mycdn.me
-				if bytes.Equal(uri.host[2], meStr) {
-					path := uri.getPath(input.B, offset+domainLength)
-					if bytes.Contains(path[:min(100, len(path))], m3u8Str) {
-						ins = v.smart
-					}
-				} else {
-					continue
-				}
-			} else if bytes.Equal(uri.host[1], vkStr) { // *.vk.*
-				if bytes.Equal(uri.host[2], comStr) { // *.vk.com
-					// Домен m.vk.com не проксим, все остальные *.vk.com проксятся
-					if len(uri.host[0]) == 1 && uri.host[0][0] == 'm' {
-						continue
-					}
-				} else {
-					continue
-				}
-			} else if bytes.Equal(uri.host[1], vkuserStr) { // *.vkuser.net
-				if !bytes.Equal(uri.host[2], netStr) {
-					continue
-				}
-			} else if bytes.HasPrefix(uri.host[1], vkuserStr) { // *.vkuser(audio|video|live).(net|com)
-				if !bytes.Equal(uri.host[2], comStr) && !bytes.Equal(uri.host[2], netStr) {
-					continue
-				}
-				r := uri.host[1][len(vkuserStr):]
-				if bytes.Equal(r, audioStr) {
-					path := uri.getPath(input.B, offset+domainLength)
-					if bytes.Contains(path[:min(300, len(path))], m3u8Str) {
-						ins = v.smart
-					}
-				} else if !bytes.Equal(r, videoStr) && !bytes.Equal(r, liveStr) {
-					continue
-				}
-			} else {
-				continue
-			}
-		} else {
+		switch v.hosts.classifyLink(input[offset:offset+domainLength], linkPath(input, offset+domainLength), escapedSlashes) {
+		case linkSmart:
+			ins = v.smart
+		case linkSkip:
 			continue
 		}
 		insertions = append(insertions, insertion{
@@ -248,31 +196,16 @@ func (v *hardcodedDomainReplace) Apply(input *bytebufferpool.ByteBuffer) *bytebu
 			content: ins,
 		})
 	}
-	parsedUriPool.Put(uri)
-
-	if len(insertions) == 0 {
-		return input
-	}
-
-	neededLength := inputLen
-	for _, ins := range insertions {
-		neededLength += len(ins.content)
-	}
 
-	output := v.pool.Get()
-	if cap(output.B) < neededLength {
-		output.B = make([]byte, 0, roundUpToPowerOfTwo(neededLength))
-	}
-
-	lastAppend := 0
-	for _, ins := range insertions {
-		output.B = append(append(output.B, input.B[lastAppend:ins.offset]...), ins.content...)
-		lastAppend = ins.offset
+	if offset < limit {
+		offset = limit
 	}
-	output.B = append(output.B, input.B[lastAppend:]...)
+	return insertions, offset
+}
 
-	v.pool.Put(input)
-	return output
+// Сколько байт после начала ссылки нужно, чтобы решить, менять ли ее: \/\/, домен, \/ и путь
+func streamLookahead(hosts *HostTable) int {
+	return escapedDoubleSlashLen + maxDomainPartLen*3 + 2 + hosts.maxPathLen
 }
 
 func testDomainPart(part []byte) bool {
@@ -303,22 +236,6 @@ func roundUpToPowerOfTwo(i int) int {
 	return i + 1
 }
 
-func split(s []byte, sep byte, result [][]byte) [][]byte {
-	n := cap(result) - 1
-	i := 0
-	for i < n {
-		m := bytes.IndexByte(s, sep)
-		if m < 0 {
-			break
-		}
-		result[i] = s[:m:m]
-		s = s[m+1:]
-		i++
-	}
-	result[i] = s
-	return result[:i+1]
-}
-
 // asciiSet is a 32-byte value, where each bit represents the presence of a
 // given ASCII character in the set. The 128-bits of the lower 16 bytes,
 // starting with the least-significant bit of the lowest word to the
@@ -0,0 +1,268 @@
+package hardcode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// HostRule -- строка таблицы доменов, ссылки на которые переписываются на прокси
+type HostRule struct {
+	// Домен целиком (vk.com) или его поддомены на один уровень (*.userapi.com)
+	Host string `json:"host"`
+	// Поддомены, которые не проксируются: m для *.vk.com
+	Except []string `json:"except"`
+	// Если заданы, то проксируются только ссылки с этими путями
+	Paths []PathRule `json:"paths"`
+	// Замена с обработкой (SmartReplace) вместо простой (SimpleReplace)
+	Smart bool `json:"smart"`
+	// Если в первых SniffLength байтах пути есть эта строка, то замена с обработкой. Так находятся плейлисты .m3u8.
+	SmartSniff  string `json:"smart_sniff"`
+	SniffLength int    `json:"sniff_length"`
+}
+
+// PathRule -- путь, который проксируется на домене с HostRule.Paths
+type PathRule struct {
+	// Начало пути после домена и слеша, слеши пишутся без экранирования: images/
+	Prefix string `json:"prefix"`
+	// Если задано, то сразу после Prefix должен идти один из этих символов
+	Next  string `json:"next"`
+	Smart bool   `json:"smart"`
+}
+
+// DefaultHosts -- домены вк, которые проксируются всегда
+var DefaultHosts = []HostRule{
+	{Host: "vk.com", Paths: []PathRule{
+		{Prefix: "doc", Next: "-0123456789"},
+		{Prefix: "images/"},
+		{Prefix: "/images/"},
+		{Prefix: "sticker/"},
+		{Prefix: "stickers_"},
+		{Prefix: "video_hls.php", Smart: true},
+	}},
+	{Host: "*.vk.com", Except: []string{"m"}},
+	{Host: "*.userapi.com"},
+	{Host: "*.vk-cdn.net"},
+	{Host: "*.mycdn.me", SmartSniff: ".m3u8", SniffLength: 100},
+	{Host: "*.vkuser.net"},
+	{Host: "*.vkuseraudio.net", SmartSniff: ".m3u8", SniffLength: 300},
+	{Host: "*.vkuseraudio.com", SmartSniff: ".m3u8", SniffLength: 300},
+	{Host: "*.vkuservideo.net"},
+	{Host: "*.vkuservideo.com"},
+	{Host: "*.vkuserlive.net"},
+	{Host: "*.vkuserlive.com"},
+}
+
+var defaultHostTable = MustHostTable(DefaultHosts)
+
+// Как записаны слеши в ссылке: в JSON от апи они экранированы, но могут быть и обычными
+type slashStyle int
+
+const (
+	escapedSlashes slashStyle = iota
+	plainSlashes
+)
+
+var slashes = [2][]byte{escapedSlashStr, []byte("/")}
+
+type linkAction int
+
+const (
+	// Ссылка не меняется
+	linkSkip linkAction = iota
+	// Перед доменом вставляется SimpleReplace
+	linkSimple
+	// Перед доменом вставляется SmartReplace
+	linkSmart
+)
+
+// HostTable -- разобранная таблица доменов. Поиск по ней не выделяет память.
+type HostTable struct {
+	exact    map[string]*hostRule
+	wildcard map[string]*hostRule
+	// Сколько байт пути нужно прочитать, чтобы применить любое правило
+	maxPathLen int
+}
+
+type hostRule struct {
+	except []string
+	paths  []pathRule
+	smart  bool
+	// По slashStyle
+	sniff       [2][]byte
+	sniffLength int
+}
+
+type pathRule struct {
+	prefix  [2][]byte
+	next    asciiSet
+	hasNext bool
+	smart   bool
+}
+
+// NewHostTable собирает таблицу из нескольких списков. Правило из следующего списка заменяет правило с тем же
+// Host из предыдущих, так DefaultHosts можно дополнить из конфига.
+func NewHostTable(lists ...[]HostRule) (*HostTable, error) {
+	t := &HostTable{
+		exact:    make(map[string]*hostRule),
+		wildcard: make(map[string]*hostRule),
+	}
+	for _, list := range lists {
+		for _, rule := range list {
+			if err := t.add(rule); err != nil {
+				return nil, fmt.Errorf("host %q: %w", rule.Host, err)
+			}
+		}
+	}
+	return t, nil
+}
+
+func MustHostTable(lists ...[]HostRule) *HostTable {
+	t, err := NewHostTable(lists...)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func (t *HostTable) add(rule HostRule) error {
+	host, wildcard := strings.CutPrefix(rule.Host, "*.")
+	if !strings.Contains(host, ".") || !validHost([]byte(host), len(host)) {
+		return errors.New("expected domain or *.domain")
+	}
+	if len(rule.Except) > 0 && !wildcard {
+		return errors.New("except is used only with *.domain")
+	}
+	if (rule.SmartSniff == "") != (rule.SniffLength <= 0) {
+		return errors.New("smart_sniff and sniff_length must be set together")
+	}
+	compiled := &hostRule{
+		except:      rule.Except,
+		smart:       rule.Smart,
+		sniff:       withSlashes(rule.SmartSniff),
+		sniffLength: rule.SniffLength,
+	}
+	t.maxPathLen = max(t.maxPathLen, rule.SniffLength)
+	for _, path := range rule.Paths {
+		if path.Prefix == "" {
+			return errors.New("empty path prefix")
+		}
+		compiledPath := pathRule{
+			prefix:  withSlashes(path.Prefix),
+			hasNext: path.Next != "",
+			smart:   path.Smart,
+		}
+		for i := 0; i < len(path.Next); i++ {
+			if !compiledPath.next.add(path.Next[i]) {
+				return fmt.Errorf("non-ascii next in path %q", path.Prefix)
+			}
+		}
+		compiled.paths = append(compiled.paths, compiledPath)
+		t.maxPathLen = max(t.maxPathLen, len(compiledPath.prefix[escapedSlashes])+1)
+	}
+	if wildcard {
+		t.wildcard[host] = compiled
+	} else {
+		t.exact[host] = compiled
+	}
+	return nil
+}
+
+func withSlashes(s string) [2][]byte {
+	if s == "" {
+		return [2][]byte{}
+	}
+	return [2][]byte{[]byte(strings.ReplaceAll(s, "/", `\/`)), []byte(s)}
+}
+
+func (t *HostTable) lookup(host []byte) *hostRule {
+	if rule := t.exact[string(host)]; rule != nil {
+		return rule
+	}
+	idx := bytes.IndexByte(host, '.')
+	if idx == -1 {
+		return nil
+	}
+	rule := t.wildcard[string(host[idx+1:])]
+	if rule == nil {
+		return nil
+	}
+	for _, except := range rule.except {
+		if string(host[:idx]) == except {
+			return nil
+		}
+	}
+	return rule
+}
+
+// Решает, как заменить ссылку с доменом host. path -- все, что идет после домена и слеша.
+func (t *HostTable) classifyLink(host, path []byte, style slashStyle) linkAction {
+	rule := t.lookup(host)
+	if rule == nil {
+		return linkSkip
+	}
+	smart := rule.smart
+	if rule.paths != nil {
+		matched := false
+		for i := range rule.paths {
+			p := &rule.paths[i]
+			prefix := p.prefix[style]
+			if !bytes.HasPrefix(path, prefix) {
+				continue
+			}
+			if p.hasNext && (len(path) == len(prefix) || !p.next.contains(path[len(prefix)])) {
+				continue
+			}
+			matched, smart = true, smart || p.smart
+			break
+		}
+		if !matched {
+			return linkSkip
+		}
+	}
+	if !smart && rule.sniffLength > 0 && bytes.Contains(path[:min(rule.sniffLength, len(path))], rule.sniff[style]) {
+		smart = true
+	}
+	if smart {
+		return linkSmart
+	}
+	return linkSimple
+}
+
+// IsProxiedHost проверяет, что ссылки на домен переписываются на прокси. Путь в ссылке не учитывается, поэтому
+// для доменов с HostRule.Paths (vk.com) результат всегда положительный. Длина частей домена здесь не ограничена
+// maxDomainPartLen: такие ссылки могут вставить другие замены.
+func (t *HostTable) IsProxiedHost(host []byte) bool {
+	return validHost(host, len(host)) && t.lookup(host) != nil
+}
+
+// IsProxiedHost -- то же, что HostTable.IsProxiedHost для DefaultHosts
+func IsProxiedHost(host []byte) bool {
+	return defaultHostTable.IsProxiedHost(host)
+}
+
+// Все части домена непустые, не длиннее maxPartLen и из допустимых символов
+func validHost(host []byte, maxPartLen int) bool {
+	for {
+		idx := bytes.IndexByte(host, '.')
+		part := host
+		if idx != -1 {
+			part = host[:idx]
+		}
+		if len(part) == 0 || len(part) > maxPartLen || !testDomainPart(part) {
+			return false
+		}
+		if idx == -1 {
+			return true
+		}
+		host = host[idx+1:]
+	}
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,315 @@
+package hardcode
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/valyala/bytebufferpool"
+)
+
+const testDomain = "vk-api-proxy.xtrafrancyz.net"
+
+var (
+	testLabels = []string{"", "m", "M", "x", "sun9-1", "a_b", "vk", "com", "net", "me", "userapi", "vk-cdn", "mycdn",
+		"vkuser", "vkuseraudio", "vkuservideo", "vkuserlive", "vkuserfoo", "sixteen-chars-xx"}
+	testPaths = []string{"", "doc", "doc1", "doc-1_2", "docs", "images/a", "/images/a", "imagesx", "//images/",
+		"sticker", "sticker/1", "stickers_1", "stickerx", "video_hls.php?x", "feed", "a.m3u8", "a.m3u8x",
+		strings.Repeat("a", 95) + ".m3u8", strings.Repeat("a", 96) + ".m3u8",
+		strings.Repeat("a", 295) + ".m3u8", strings.Repeat("a", 296) + ".m3u8"}
+)
+
+// Хосты из 1-4 частей из testLabels
+func testHosts() []string {
+	hosts := append([]string{}, testLabels...)
+	prev := testLabels
+	for n := 2; n <= 4; n++ {
+		var next []string
+		for _, host := range prev {
+			for _, label := range testLabels {
+				// Четвертая часть добавляется только к осмысленным доменам, иначе вариантов слишком много
+				if n == 4 && legacyClassifyHost(split([]byte(host), '.', make([][]byte, 3))) == legacyHostDenied {
+					continue
+				}
+				next = append(next, label+"."+host)
+			}
+		}
+		hosts = append(hosts, next...)
+		prev = next
+	}
+	return hosts
+}
+
+func TestHostTableEquivalence(t *testing.T) {
+	var buf [3][]byte
+	for _, host := range testHosts() {
+		if got, expected := IsProxiedHost([]byte(host)), legacyIsProxiedHost([]byte(host)); got != expected {
+			t.Errorf("IsProxiedHost(%q) = %v, expected %v", host, got, expected)
+		}
+		parts := split([]byte(host), '.', buf[:])
+		for _, path := range testPaths {
+			for style, paths := range []*legacyLinkPaths{&legacyEscapedPaths, &legacyPlainPaths} {
+				p := path
+				if style == int(escapedSlashes) {
+					p = strings.ReplaceAll(path, "/", `\/`)
+				}
+				got := defaultHostTable.classifyLink([]byte(host), []byte(p), slashStyle(style))
+				if expected := legacyClassifyLink(parts, []byte(p), paths); got != expected {
+					t.Errorf("classifyLink(%q, %q) = %v, expected %v", host, p, got, expected)
+				}
+			}
+		}
+	}
+}
+
+func TestHardcodeEquivalence(t *testing.T) {
+	replace := NewHardcodedDomainReplace(HardcodedDomainReplaceConfig{
+		Pool:          &bytebufferpool.Pool{},
+		SimpleReplace: testDomain + `\/_\/`,
+		SmartReplace:  testDomain + `\/@`,
+	})
+
+	// Ответ со всеми вариантами ссылок и ожидаемый результат по старому коду. Путь для старого кода идет до конца
+	// ответа, как в findInsertions.
+	type link struct {
+		host   int
+		length int
+	}
+	input := []byte(`[`)
+	var links []link
+	for _, host := range testHosts() {
+		if strings.Contains(host, `\`) || len(host) >= maxDomainPartLen*3 {
+			continue
+		}
+		for _, path := range testPaths {
+			input = append(input, `"https:\/\/`...)
+			links = append(links, link{host: len(input), length: len(host)})
+			input = append(input, host+`\/`+strings.ReplaceAll(path, "/", `\/`)+`",`...)
+		}
+	}
+	input = append(input, `0]`...)
+
+	var expected []byte
+	var buf [3][]byte
+	last := 0
+	for _, l := range links {
+		host := input[l.host : l.host+l.length]
+		switch legacyClassifyLink(split(host, '.', buf[:]), input[l.host+l.length+2:], &legacyEscapedPaths) {
+		case linkSimple:
+			expected = append(append(expected, input[last:l.host]...), testDomain+`\/_\/`...)
+			last = l.host
+		case linkSmart:
+			expected = append(append(expected, input[last:l.host]...), testDomain+`\/@`...)
+			last = l.host
+		}
+	}
+	expected = append(expected, input[last:]...)
+
+	buffer := &bytebufferpool.ByteBuffer{B: append([]byte{}, input...)}
+	if result := replace.Apply(buffer); !bytes.Equal(result.B, expected) {
+		t.Error("hardcode replace with host table differs from the previous implementation")
+	}
+}
+
+func TestHostTableAllocs(t *testing.T) {
+	host, path := []byte("sun9-1.vkuseraudio.net"), []byte(`a\/index.m3u8`)
+	allocs := testing.AllocsPerRun(100, func() {
+		defaultHostTable.classifyLink(host, path, escapedSlashes)
+		IsProxiedHost(host)
+	})
+	if allocs != 0 {
+		t.Errorf("host table lookup allocates %v times", allocs)
+	}
+}
+
+func TestHostTableConfig(t *testing.T) {
+	table, err := NewHostTable(DefaultHosts, []HostRule{
+		{Host: "*.vk.com"},
+		{Host: "*.vk.me", Paths: []PathRule{{Prefix: "files/", Smart: true}}},
+		{Host: "cdn.example.org", SmartSniff: ".mpd", SniffLength: 20},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		host, path string
+		expected   linkAction
+	}{
+		{"m.vk.com", "feed", linkSimple},
+		{"vk.com", `images\/a`, linkSimple},
+		{"im.vk.me", `files\/a`, linkSmart},
+		{"im.vk.me", `other\/a`, linkSkip},
+		{"cdn.example.org", "a.mpd", linkSmart},
+		{"cdn.example.org", "a.mp4", linkSimple},
+		{"a.cdn.example.org", "a.mp4", linkSkip},
+	} {
+		if got := table.classifyLink([]byte(c.host), []byte(c.path), escapedSlashes); got != c.expected {
+			t.Errorf("classifyLink(%q, %q) = %v, expected %v", c.host, c.path, got, c.expected)
+		}
+	}
+	if streamLookahead(table) != streamLookahead(defaultHostTable) {
+		t.Error("stream lookahead must cover the longest sniff")
+	}
+
+	for _, rules := range [][]HostRule{
+		{{Host: "com"}},
+		{{Host: "*.*.vk.com"}},
+		{{Host: "vk.com/a"}},
+		{{Host: "vk.com", Except: []string{"m"}}},
+		{{Host: "vk.com", SmartSniff: ".m3u8"}},
+		{{Host: "vk.com", Paths: []PathRule{{Prefix: ""}}}},
+	} {
+		if _, err := NewHostTable(rules); err == nil {
+			t.Errorf("host rules %+v must be invalid", rules)
+		}
+	}
+}
+
+func FuzzHostTable(f *testing.F) {
+	f.Add("vk.com", `images\/a`)
+	f.Add("m.vk.com", "a")
+	f.Add("sun9-1.mycdn.me", `a\/b.m3u8`)
+	f.Add("a.b.userapi.com", "a")
+	f.Fuzz(func(t *testing.T, host, path string) {
+		var buf [3][]byte
+		got := defaultHostTable.classifyLink([]byte(host), []byte(path), escapedSlashes)
+		if expected := legacyClassifyLink(split([]byte(host), '.', buf[:]), []byte(path), &legacyEscapedPaths); got != expected {
+			t.Errorf("classifyLink(%q, %q) = %v, expected %v", host, path, got, expected)
+		}
+		if got, expected := IsProxiedHost([]byte(host)), legacyIsProxiedHost([]byte(host)); got != expected {
+			t.Errorf("IsProxiedHost(%q) = %v, expected %v", host, got, expected)
+		}
+	})
+}
+
+// Дальше -- прежняя реализация на вложенных проверках, с которой сравнивается таблица
+
+type legacyLinkPaths struct {
+	slash   []byte
+	images  []byte
+	images2 []byte
+}
+
+var (
+	legacyEscapedPaths = legacyLinkPaths{slash: []byte(`\/`), images: []byte(`images\/`), images2: []byte(`\/images\/`)}
+	legacyPlainPaths   = legacyLinkPaths{slash: []byte("/"), images: []byte("images/"), images2: []byte("/images/")}
+)
+
+func legacyClassifyLink(host [][]byte, path []byte, paths *legacyLinkPaths) linkAction {
+	switch legacyClassifyHost(host) {
+	case legacyHostVkCom:
+		if bytes.HasPrefix(path, []byte("doc")) {
+			if len(path) == 3 {
+				return linkSkip
+			}
+			c := path[3]
+			if c != '-' && !(c >= '0' && c <= '9') {
+				return linkSkip
+			}
+		} else if bytes.HasPrefix(path, paths.images) || bytes.HasPrefix(path, paths.images2) {
+			// allow
+		} else if bytes.HasPrefix(path, []byte("sticker")) {
+			path2 := path[len("sticker"):]
+			if !bytes.HasPrefix(path2, paths.slash) && !bytes.HasPrefix(path2, []byte("s_")) {
+				return linkSkip
+			}
+		} else if bytes.HasPrefix(path, []byte("video_hls.php")) {
+			return linkSmart
+		} else {
+			return linkSkip
+		}
+	case legacyHostMycdn:
+		if bytes.Contains(path[:min(100, len(path))], []byte(".m3u8")) {
+			return linkSmart
+		}
+	case legacyHostVkuserAudio:
+		if bytes.Contains(path[:min(300, len(path))], []byte(".m3u8")) {
+			return linkSmart
+		}
+	case legacyHostSimple:
+		// allow
+	default:
+		return linkSkip
+	}
+	return linkSimple
+}
+
+const (
+	legacyHostDenied = iota
+	legacyHostSimple
+	legacyHostVkCom
+	legacyHostMycdn
+	legacyHostVkuserAudio
+)
+
+// Делит домен на части, как это делал findInsertions до таблицы доменов
+func split(s []byte, sep byte, result [][]byte) [][]byte {
+	n := cap(result) - 1
+	i := 0
+	for i < n {
+		m := bytes.IndexByte(s, sep)
+		if m < 0 {
+			break
+		}
+		result[i] = s[:m:m]
+		s = s[m+1:]
+		i++
+	}
+	result[i] = s
+	return result[:i+1]
+}
+
+func legacyClassifyHost(host [][]byte) int {
+	is := func(b []byte, s string) bool { return string(b) == s }
+	if len(host) == 2 {
+		if is(host[0], "vk") && is(host[1], "com") {
+			return legacyHostVkCom
+		}
+	} else if len(host) == 3 {
+		if is(host[1], "userapi") {
+			if is(host[2], "com") {
+				return legacyHostSimple
+			}
+		} else if is(host[1], "vk-cdn") {
+			if is(host[2], "net") {
+				return legacyHostSimple
+			}
+		} else if is(host[1], "mycdn") {
+			if is(host[2], "me") {
+				return legacyHostMycdn
+			}
+		} else if is(host[1], "vk") {
+			if is(host[2], "com") {
+				if len(host[0]) != 1 || host[0][0] != 'm' {
+					return legacyHostSimple
+				}
+			}
+		} else if is(host[1], "vkuser") {
+			if is(host[2], "net") {
+				return legacyHostSimple
+			}
+		} else if bytes.HasPrefix(host[1], []byte("vkuser")) {
+			if is(host[2], "com") || is(host[2], "net") {
+				r := host[1][len("vkuser"):]
+				if is(r, "audio") {
+					return legacyHostVkuserAudio
+				} else if is(r, "video") || is(r, "live") {
+					return legacyHostSimple
+				}
+			}
+		}
+	}
+	return legacyHostDenied
+}
+
+// Длина частей домена не ограничена, /_/ пропускает и длинные домены
+func legacyIsProxiedHost(host []byte) bool {
+	var buf [3][]byte
+	parts := split(host, '.', buf[:])
+	for _, part := range parts {
+		if len(part) == 0 || !testDomainPart(part) {
+			return false
+		}
+	}
+	return legacyClassifyHost(parts) != legacyHostDenied
+}
@@ -0,0 +1,299 @@
+package hardcode
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	"github.com/json-iterator/go"
+	"github.com/valyala/bytebufferpool"
+	"github.com/xtrafrancyz/vk-proxy/replacer/x"
+)
+
+const jsonSpaces = " \t\r\n"
+
+var (
+	jsonConfig = jsoniter.ConfigFastest
+
+	doubleSlashStr = []byte("//")
+	httpsStr       = []byte("https:")
+	httpStr        = []byte("http:")
+
+	// Ключи со ссылками на картинки и файлы в ответах апи
+	DefaultJsonKeys = []string{"url", "src", "upload_url", "photo_*", "owner_photo"}
+
+	jsonWalkerPool = sync.Pool{New: func() interface{} {
+		w := &jsonWalker{raw: make([]byte, 0, 256)}
+		w.onField = w.field
+		w.onItem = w.item
+		return w
+	}}
+)
+
+type JsonDomainReplaceConfig struct {
+	Pool x.BufferPool
+
+	// Домен, который просто пропускает трафик через себя без обработки, обычно domain.com\/_\/
+	SimpleReplace string
+
+	// Домен для замены с обработкой, обычно domain.com\/@
+	SmartReplace string
+
+	// Какие ссылки менять, по умолчанию DefaultHosts
+	Hosts *HostTable
+
+	// Ключи, в значениях которых ищутся ссылки. Ключ с * на конце задает префикс: photo_*, а * -- все строки.
+	// Строки в массивах относятся к ключу массива. По умолчанию DefaultJsonKeys.
+	Keys []string
+}
+
+type jsonDomainReplace struct {
+	pool x.BufferPool
+	// Вставки для ссылок с экранированными слешами, как их отдает апи
+	simple []byte
+	smart  []byte
+	// Вставки для ссылок с обычными слешами
+	plainSimple []byte
+	plainSmart  []byte
+	hosts       *HostTable
+
+	keys     map[string]bool
+	prefixes []string
+}
+
+// В отличие от NewHardcodedDomainReplace, этот реплейс разбирает JSON и ищет ссылки внутри строк: не только
+// "https:\/\/ в начале строки, но и в середине текста, со слешами без экранирования, http:// (заменяется на
+// https://) и ссылки без схемы //domain. Домены и пути проверяются так же, как в NewHardcodedDomainReplace.
+//
+// Ключи и структура ответа пишутся заново без пробелов, остальные значения копируются как есть. Ответ, который
+// не удалось разобрать, не меняется. Работает медленнее NewHardcodedDomainReplace, зато не пропускает ссылки
+// в тех ключах, где они ожидаются.
+func NewJsonDomainReplace(config JsonDomainReplaceConfig) *jsonDomainReplace {
+	v := &jsonDomainReplace{
+		pool:        config.Pool,
+		simple:      []byte(config.SimpleReplace),
+		smart:       []byte(config.SmartReplace),
+		plainSimple: []byte(strings.ReplaceAll(config.SimpleReplace, `\/`, `/`)),
+		plainSmart:  []byte(strings.ReplaceAll(config.SmartReplace, `\/`, `/`)),
+		hosts:       config.Hosts,
+	}
+	if v.hosts == nil {
+		v.hosts = defaultHostTable
+	}
+	keys := config.Keys
+	if keys == nil {
+		keys = DefaultJsonKeys
+	}
+	for _, key := range keys {
+		if strings.HasSuffix(key, "*") {
+			v.prefixes = append(v.prefixes, key[:len(key)-1])
+		} else {
+			if v.keys == nil {
+				v.keys = make(map[string]bool, len(keys))
+			}
+			v.keys[key] = true
+		}
+	}
+	return v
+}
+
+func (v *jsonDomainReplace) Apply(input *bytebufferpool.ByteBuffer) *bytebufferpool.ByteBuffer {
+	// Быстрый путь для ответов без ссылок
+	if bytes.Index(input.B, doubleSlashStr) == -1 && bytes.Index(input.B, escapedDoubleSlashStr) == -1 {
+		return input
+	}
+
+	output := v.pool.Get()
+	if neededLength := len(input.B) + len(input.B)/8; cap(output.B) < neededLength {
+		output.B = make([]byte, 0, roundUpToPowerOfTwo(neededLength))
+	}
+
+	iter := jsonConfig.BorrowIterator(input.B)
+	w := jsonWalkerPool.Get().(*jsonWalker)
+	w.replace = v
+	// Пробелы вокруг ответа сохраняются, внутри -- нет
+	w.out = append(output.B[:0], input.B[:len(input.B)-len(bytes.TrimLeft(input.B, jsonSpaces))]...)
+	w.changed = false
+	w.value(iter, false)
+	// После ответа могут быть только пробелы
+	ok := w.changed && iter.Error == nil && iter.WhatIsNext() == jsoniter.InvalidValue
+	output.B = append(w.out, input.B[len(bytes.TrimRight(input.B, jsonSpaces)):]...)
+	w.replace = nil
+	w.out = nil
+	jsonWalkerPool.Put(w)
+	jsonConfig.ReturnIterator(iter)
+
+	if !ok {
+		v.pool.Put(output)
+		return input
+	}
+	v.pool.Put(input)
+	return output
+}
+
+func (v *jsonDomainReplace) matchKey(key string) bool {
+	if v.keys[key] {
+		return true
+	}
+	for _, prefix := range v.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Дописывает к dst строку JSON s (вместе с кавычками), вставляя домен прокси в ссылки
+func (v *jsonDomainReplace) appendLinks(dst, s []byte) ([]byte, bool) {
+	if bytes.IndexByte(s, '/') == -1 {
+		return append(dst, s...), false
+	}
+	changed := false
+	last := 0
+	for i := 1; i < len(s)-1; i++ {
+		var style slashStyle
+		var simple, smart []byte
+		if s[i] == '/' && s[i+1] == '/' {
+			style, simple, smart = plainSlashes, v.plainSimple, v.plainSmart
+		} else if s[i] == '\\' && bytes.HasPrefix(s[i:], escapedDoubleSlashStr) {
+			style, simple, smart = escapedSlashes, v.simple, v.smart
+		} else {
+			continue
+		}
+		slash := slashes[style]
+		hostStart := i + len(slash)*2
+		start, http := linkStart(s, i)
+		if start == -1 {
+			i = hostStart - 1
+			continue
+		}
+
+		// Чтение и проверка домена
+		end := len(s) - 1
+		domainLength := bytes.Index(s[hostStart:min(end, hostStart+maxDomainPartLen*3)], slash)
+		if domainLength == -1 {
+			i = hostStart - 1
+			continue
+		}
+		host := s[hostStart : hostStart+domainLength]
+		i = hostStart + domainLength - 1
+		if !validHost(host, maxDomainPartLen) {
+			continue
+		}
+
+		ins := simple
+		switch v.hosts.classifyLink(host, s[hostStart+domainLength+len(slash):end], style) {
+		case linkSmart:
+			ins = smart
+		case linkSkip:
+			continue
+		}
+		if http {
+			// Прокси доступен только по https
+			dst = append(append(dst, s[last:start+len(httpStr)-1]...), 's')
+			last = start + len(httpStr) - 1
+		}
+		dst = append(append(dst, s[last:hostStart]...), ins...)
+		last = hostStart
+		changed = true
+	}
+	return append(dst, s[last:]...), changed
+}
+
+// Находит начало ссылки, у которой // стоит на позиции i строки s. Ссылка может начинаться с https:, http: или
+// сразу с //, иначе возвращается -1. http сообщает, что схему нужно заменить на https.
+func linkStart(s []byte, i int) (start int, http bool) {
+	prev := s[i-1]
+	if prev == ':' {
+		if i > len(httpsStr) && bytes.Equal(s[i-len(httpsStr):i], httpsStr) {
+			start = i - len(httpsStr)
+		} else if i > len(httpStr) && bytes.Equal(s[i-len(httpStr):i], httpStr) {
+			start, http = i-len(httpStr), true
+		} else {
+			return -1, false
+		}
+		// Схема должна быть отдельным словом, а не концом другой: xhttps://
+		if domainChars.contains(s[start-1]) {
+			return -1, false
+		}
+		return start, http
+	}
+	if domainChars.contains(prev) || prev == '.' || prev == '/' || prev == '\\' {
+		return -1, false
+	}
+	return i, false
+}
+
+// Обход JSON с записью результата в out. Для объектов и массивов jsoniter вызывает onField и onItem, они
+// создаются один раз, чтобы не выделять память под замыкания на каждый объект.
+type jsonWalker struct {
+	replace *jsonDomainReplace
+	out     []byte
+	// Строка до замены
+	raw     []byte
+	changed bool
+	// Искать ли ссылки в элементах текущего массива
+	links bool
+
+	onField func(iter *jsoniter.Iterator, field string) bool
+	onItem  func(iter *jsoniter.Iterator) bool
+}
+
+func (w *jsonWalker) value(iter *jsoniter.Iterator, links bool) {
+	switch iter.WhatIsNext() {
+	case jsoniter.ObjectValue:
+		w.out = append(w.out, '{')
+		iter.ReadObjectCB(w.onField)
+		w.out = append(w.out, '}')
+	case jsoniter.ArrayValue:
+		w.out = append(w.out, '[')
+		parentLinks := w.links
+		w.links = links
+		iter.ReadArrayCB(w.onItem)
+		w.links = parentLinks
+		w.out = append(w.out, ']')
+	case jsoniter.StringValue:
+		if !links {
+			w.out = iter.SkipAndAppendBytes(w.out)
+			break
+		}
+		w.raw = iter.SkipAndAppendBytes(w.raw[:0])
+		var changed bool
+		if w.out, changed = w.replace.appendLinks(w.out, w.raw); changed {
+			w.changed = true
+		}
+	default:
+		w.out = iter.SkipAndAppendBytes(w.out)
+	}
+}
+
+func (w *jsonWalker) field(iter *jsoniter.Iterator, field string) bool {
+	w.comma('{')
+	w.out = appendJsonString(w.out, field)
+	w.out = append(w.out, ':')
+	w.value(iter, w.replace.matchKey(field))
+	return iter.Error == nil
+}
+
+func (w *jsonWalker) item(iter *jsoniter.Iterator) bool {
+	w.comma('[')
+	w.value(iter, w.links)
+	return iter.Error == nil
+}
+
+// Запятая нужна перед всеми элементами, кроме первого, то есть если out не заканчивается на open
+func (w *jsonWalker) comma(open byte) {
+	if w.out[len(w.out)-1] != open {
+		w.out = append(w.out, ',')
+	}
+}
+
+func appendJsonString(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c == '"' || c == '\\' {
+			escaped, _ := jsonConfig.Marshal(s)
+			return append(dst, escaped...)
+		}
+	}
+	return append(append(append(dst, '"'), s...), '"')
+}
@@ -2,9 +2,12 @@ package replacer
 
 import (
 	_ "embed"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
-	"net"
+	"os"
+	"sync/atomic"
 
 	"github.com/phuslu/iploc"
 )
@@ -16,8 +19,10 @@ type customPost struct {
 	items       []interface{}
 }
 
+const adPostFile = "newsfeed.json"
+
 var (
-	adPost *customPost
+	adPost atomic.Pointer[customPost]
 
 	//go:embed proxy-not-needed.json
 	uselessProxyPostData []byte
@@ -57,47 +62,86 @@ func (p *customPost) apply(response map[string]interface{}, inFront bool) bool {
 }
 
 func readCustomPost(bytes []byte) *customPost {
-	post := customPost{}
-	var parsed map[string]interface{}
-	if err := json.Unmarshal(bytes, &parsed); err != nil {
+	post, err := parseCustomPost(bytes)
+	if err != nil {
 		panic(err)
 	}
-	parsed = parsed["response"].(map[string]interface{})
+	return post
+}
 
-	post.probability = parsed["probability"].(float64)
-	if pp, ok := parsed["profiles"]; ok {
-		post.profiles = pp.([]interface{})
+func parseCustomPost(bytes []byte) (*customPost, error) {
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(bytes, &parsed); err != nil {
+		return nil, err
+	}
+	response, ok := parsed["response"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid custom post: response must be an object")
+	}
+	post := &customPost{}
+	if post.probability, ok = response["probability"].(float64); !ok {
+		return nil, errors.New("invalid custom post: probability must be a number")
+	}
+	var err error
+	if post.profiles, err = customPostList(response, "profiles"); err != nil {
+		return nil, err
+	}
+	if post.groups, err = customPostList(response, "groups"); err != nil {
+		return nil, err
 	}
-	if pp, ok := parsed["groups"]; ok {
-		post.groups = pp.([]interface{})
+	if post.items, err = customPostList(response, "items"); err != nil {
+		return nil, err
 	}
-	if pp, ok := parsed["items"]; ok {
-		post.items = pp.([]interface{})
+	return post, nil
+}
+
+// Необязательный массив из поста
+func customPostList(response map[string]interface{}, key string) ([]interface{}, error) {
+	value, ok := response[key]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid custom post: %s must be an array", key)
 	}
-	return &post
+	return list, nil
 }
 
 func init() {
 	uselessProxyPost = readCustomPost(uselessProxyPostData)
-	if bytes, err := ioutil.ReadFile("newsfeed.json"); err == nil {
-		adPost = readCustomPost(bytes)
+	if bytes, err := ioutil.ReadFile(adPostFile); err == nil {
+		adPost.Store(readCustomPost(bytes))
 	}
 }
 
-func tryInsertAdPost(response map[string]interface{}) bool {
-	if adPost == nil {
-		return false
+// ReloadAdPost перечитывает пост для вставки в ленту из newsfeed.json. Если файла нет, то пост больше не вставляется.
+func ReloadAdPost() error {
+	bytes, err := ioutil.ReadFile(adPostFile)
+	if os.IsNotExist(err) {
+		adPost.Store(nil)
+		return nil
+	} else if err != nil {
+		return err
 	}
-	return adPost.apply(response, false)
+	post, err := parseCustomPost(bytes)
+	if err != nil {
+		return err
+	}
+	adPost.Store(post)
+	return nil
 }
 
-func tryInsertUselessProxyPost(response map[string]interface{}, ctx *ReplaceContext) bool {
-	realIp := ctx.RequestCtx.Request.Header.Peek("X-Real-IP")
-	if len(realIp) == 0 {
+func tryInsertAdPost(response map[string]interface{}) bool {
+	post := adPost.Load()
+	if post == nil {
 		return false
 	}
+	return post.apply(response, false)
+}
 
-	if ip := net.ParseIP(string(realIp)); ip != nil {
+func tryInsertUselessProxyPost(response map[string]interface{}, ctx *ReplaceContext) bool {
+	if ip := ctx.ClientIP; ip != nil {
 		country := string(iploc.Country(ip))
 		if country == "RU" {
 			args := ctx.RequestCtx.Request.PostArgs()
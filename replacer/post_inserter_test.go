@@ -0,0 +1,30 @@
+package replacer
+
+import (
+	"testing"
+)
+
+func TestParseCustomPost(t *testing.T) {
+	post, err := parseCustomPost([]byte(`{"response": {"probability": 0.5, "items": [{"id": 1}], "groups": []}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post.probability != 0.5 || len(post.items) != 1 || len(post.groups) != 0 || post.profiles != nil {
+		t.Errorf("unexpected post %+v", post)
+	}
+
+	for _, data := range []string{
+		`[]`,
+		`{}`,
+		`{"response": []}`,
+		`{"response": {}}`,
+		`{"response": {"probability": "1"}}`,
+		`{"response": {"probability": 1, "items": {}}}`,
+		`{"response": {"probability": 1, "profiles": null}}`,
+		`{"response": {"probability": 1, "groups": 1}}`,
+	} {
+		if _, err = parseCustomPost([]byte(data)); err == nil {
+			t.Errorf("post %s must be invalid", data)
+		}
+	}
+}
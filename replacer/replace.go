@@ -2,14 +2,23 @@ package replacer
 
 import (
 	"bytes"
+	"io"
 	"regexp"
+	"regexp/syntax"
 	"sync"
+	"sync/atomic"
+	"unicode/utf8"
 
 	"github.com/valyala/bytebufferpool"
+	"github.com/xtrafrancyz/vk-proxy/replacer/x"
 )
 
+// Сколько байт потоковая замена по регулярке задерживает, если длина совпадения не ограничена. Более длинные
+// совпадения на границе кусков могут не найтись.
+const regexStreamLookahead = 4096
+
 var (
-	replaceBufferPool bytebufferpool.Pool
+	replaceBufferPool bufferPool
 
 	// В sync.Pool необходимо хранить только указатели, иначе при каждом Put будет аллокация для interface{}
 	// В итоге тут хранится *[]int, в добавок этот указатель нужно будет переиспользовать для записи
@@ -19,6 +28,28 @@ var (
 	}}
 )
 
+// Пул буферов реплейсера, который считает выданные и возвращенные буферы для метрик
+type bufferPool struct {
+	pool     bytebufferpool.Pool
+	acquired uint64
+	released uint64
+}
+
+func (p *bufferPool) Get() *bytebufferpool.ByteBuffer {
+	atomic.AddUint64(&p.acquired, 1)
+	return p.pool.Get()
+}
+
+func (p *bufferPool) Put(b *bytebufferpool.ByteBuffer) {
+	atomic.AddUint64(&p.released, 1)
+	p.pool.Put(b)
+}
+
+// BufferPoolStats возвращает количество выданных и возвращенных в пул буферов реплейсера
+func BufferPoolStats() (acquired, released uint64) {
+	return atomic.LoadUint64(&replaceBufferPool.acquired), atomic.LoadUint64(&replaceBufferPool.released)
+}
+
 type regexReplace struct {
 	regex       *regexp.Regexp
 	replacement []byte
@@ -37,6 +68,86 @@ func (v *regexReplace) Apply(input *bytebufferpool.ByteBuffer) *bytebufferpool.B
 	})
 }
 
+func (v *regexReplace) NewWriter(w io.Writer) io.WriteCloser {
+	return x.NewStreamWriter(w, 0, regexLookahead(v.regex), v.process)
+}
+
+func (v *regexReplace) process(dst, src []byte, from, limit int) ([]byte, int) {
+	next := from
+	for _, match := range v.regex.FindAllSubmatchIndex(src[from:], -1) {
+		if match[0]+from >= limit {
+			break
+		}
+		dst = append(dst, src[next:match[0]+from]...)
+		dst = v.regex.Expand(dst, v.replacement, src[from:], match)
+		next = match[1] + from
+	}
+	if next < limit {
+		dst = append(dst, src[next:limit]...)
+		next = limit
+	}
+	return dst, next
+}
+
+// Максимальная длина совпадения регулярки в байтах. Регулярки с ^, $ и \b зависят от текста вокруг совпадения,
+// а поиск в куске начинается как в начале текста, поэтому они обрабатываются только целиком (-1).
+func regexLookahead(regex *regexp.Regexp) int {
+	re, err := syntax.Parse(regex.String(), syntax.Perl)
+	if err != nil {
+		return -1
+	}
+	length, ok := maxMatchLength(re.Simplify())
+	if length < 0 {
+		return -1
+	}
+	if !ok || length > regexStreamLookahead {
+		return regexStreamLookahead
+	}
+	return length
+}
+
+// Возвращает -1 для регулярок с проверками границ и ok == false для неограниченной длины
+func maxMatchLength(re *syntax.Regexp) (int, bool) {
+	switch re.Op {
+	case syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return -1, false
+	case syntax.OpEmptyMatch, syntax.OpNoMatch:
+		return 0, true
+	case syntax.OpLiteral:
+		return len(re.Rune) * utf8.UTFMax, true
+	case syntax.OpCharClass, syntax.OpAnyCharNotNL, syntax.OpAnyChar:
+		return utf8.UTFMax, true
+	case syntax.OpCapture, syntax.OpQuest:
+		return maxMatchLength(re.Sub[0])
+	case syntax.OpStar, syntax.OpPlus, syntax.OpRepeat:
+		length, ok := maxMatchLength(re.Sub[0])
+		if length < 0 {
+			return -1, false
+		}
+		if re.Op != syntax.OpRepeat || re.Max == -1 {
+			return length, false
+		}
+		return length * re.Max, ok
+	case syntax.OpConcat, syntax.OpAlternate:
+		total, bounded := 0, true
+		for _, sub := range re.Sub {
+			length, ok := maxMatchLength(sub)
+			if length < 0 {
+				return -1, false
+			}
+			bounded = bounded && ok
+			if re.Op == syntax.OpConcat {
+				total += length
+			} else if length > total {
+				total = length
+			}
+		}
+		return total, bounded
+	}
+	return -1, false
+}
+
 type regexFuncReplace struct {
 	regex    *regexp.Regexp
 	replacer func(src, dst []byte, start, end int) []byte
@@ -96,6 +207,27 @@ func newStringReplace(needle, replace string) *stringReplace {
 	return r
 }
 
+func (v *stringReplace) NewWriter(w io.Writer) io.WriteCloser {
+	return x.NewStreamWriter(w, 0, v.needleLen, v.process)
+}
+
+func (v *stringReplace) process(dst, src []byte, from, limit int) ([]byte, int) {
+	next := from
+	for {
+		index := bytes.Index(src[next:], v.needle)
+		if index == -1 || next+index >= limit {
+			break
+		}
+		dst = append(append(dst, src[next:next+index]...), v.replacement...)
+		next += index + v.needleLen
+	}
+	if next < limit {
+		dst = append(dst, src[next:limit]...)
+		next = limit
+	}
+	return dst, next
+}
+
 func (v *stringReplace) Apply(input *bytebufferpool.ByteBuffer) *bytebufferpool.ByteBuffer {
 	index := bytes.Index(input.B, v.needle)
 	if index == -1 {
@@ -141,3 +273,129 @@ func (v *stringReplace) Apply(input *bytebufferpool.ByteBuffer) *bytebufferpool.
 	ReleaseBuffer(input)
 	return output
 }
+
+// Замена нескольких строк за один проход по автомату Ахо-Корасик. Если образцы перекрываются, то заменяется тот,
+// который закончился раньше, а из закончившихся в одном месте -- самый длинный. После замены поиск продолжается
+// с конца совпадения, поэтому замены не применяются к уже замененному тексту.
+type multiStringReplace struct {
+	// Переходы автомата: delta[state<<8|c], без возвратов по fail ссылкам во время поиска
+	delta []int32
+	// Самый длинный образец, который заканчивается в состоянии, или -1
+	out          []int32
+	needles      [][]byte
+	replacements [][]byte
+	// Пока автомат в начальном состоянии, текст до следующего возможного совпадения пропускается: если у всех
+	// образцов есть общее начало, то оно ищется через bytes.Index, иначе пропускаются байты, с которых не
+	// начинается ни один образец
+	prefix []byte
+	first  [256]bool
+}
+
+// Пары образец-замена: needle1, replace1, needle2, replace2...
+func newMultiStringReplace(pairs ...string) *multiStringReplace {
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		panic("multiStringReplace: needle and replacement pairs expected")
+	}
+	v := &multiStringReplace{}
+	// Бор из образцов, children[state*256+c] == 0 значит нет перехода (в корень переходов нет)
+	children := make([]int32, 256)
+	v.out = []int32{-1}
+	for i := 0; i < len(pairs); i += 2 {
+		if pairs[i] == "" {
+			panic("multiStringReplace: empty needle")
+		}
+		needle := []byte(pairs[i])
+		v.needles = append(v.needles, needle)
+		v.replacements = append(v.replacements, []byte(pairs[i+1]))
+		v.first[needle[0]] = true
+		state := int32(0)
+		for _, c := range needle {
+			next := children[int(state)<<8|int(c)]
+			if next == 0 {
+				next = int32(len(v.out))
+				children[int(state)<<8|int(c)] = next
+				children = append(children, make([]int32, 256)...)
+				v.out = append(v.out, -1)
+			}
+			state = next
+		}
+		// Одинаковые образцы заменяются первой заменой
+		if v.out[state] == -1 {
+			v.out[state] = int32(len(v.needles) - 1)
+		}
+	}
+	v.prefix = v.needles[0]
+	for _, needle := range v.needles[1:] {
+		v.prefix = v.prefix[:longestCommonPrefix(string(v.prefix), string(needle))]
+	}
+
+	// Обход в ширину: fail ссылки сразу превращаются в переходы, а выход состояния дополняется выходом fail
+	// состояния, если тот образец длиннее недошедшего до конца
+	v.delta = children
+	fail := make([]int32, len(v.out))
+	queue := make([]int32, 0, len(v.out))
+	for c := 0; c < 256; c++ {
+		if next := v.delta[c]; next != 0 {
+			queue = append(queue, next)
+		}
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		if v.out[state] == -1 {
+			v.out[state] = v.out[fail[state]]
+		}
+		for c := 0; c < 256; c++ {
+			idx := int(state)<<8 | c
+			if next := v.delta[idx]; next != 0 {
+				fail[next] = v.delta[int(fail[state])<<8|c]
+				queue = append(queue, next)
+			} else {
+				v.delta[idx] = v.delta[int(fail[state])<<8|c]
+			}
+		}
+	}
+	return v
+}
+
+func (v *multiStringReplace) Apply(input *bytebufferpool.ByteBuffer) *bytebufferpool.ByteBuffer {
+	var output *bytebufferpool.ByteBuffer
+	src := input.B
+	last := 0
+	state := int32(0)
+	for i := 0; i < len(src); i++ {
+		if state == 0 {
+			if len(v.prefix) > 0 {
+				idx := bytes.Index(src[i:], v.prefix)
+				if idx == -1 {
+					break
+				}
+				i += idx
+			} else {
+				for i < len(src) && !v.first[src[i]] {
+					i++
+				}
+				if i == len(src) {
+					break
+				}
+			}
+		}
+		state = v.delta[int(state)<<8|int(src[i])]
+		if match := v.out[state]; match != -1 {
+			if output == nil {
+				output = AcquireBuffer()
+			}
+			start := i + 1 - len(v.needles[match])
+			output.B = append(output.B, src[last:start]...)
+			output.B = append(output.B, v.replacements[match]...)
+			last = i + 1
+			state = 0
+		}
+	}
+	if output == nil {
+		return input
+	}
+	output.B = append(output.B, src[last:]...)
+	ReleaseBuffer(input)
+	return output
+}
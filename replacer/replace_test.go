@@ -2,12 +2,14 @@ package replacer
 
 import (
 	"bytes"
+	"io"
 	"io/ioutil"
 	"strings"
 	"testing"
 
 	"github.com/valyala/bytebufferpool"
 	"github.com/xtrafrancyz/vk-proxy/replacer/hardcode"
+	"github.com/xtrafrancyz/vk-proxy/replacer/x"
 )
 
 const domain = "vk-api-proxy.xtrafrancyz.net"
@@ -44,6 +46,11 @@ var _hardcodeDomainReplace = hardcode.NewHardcodedDomainReplace(hardcode.Hardcod
 	SimpleReplace: domain + `\/_\/`,
 	SmartReplace:  domain + `\/@`,
 })
+var _jsonDomainReplace = hardcode.NewJsonDomainReplace(hardcode.JsonDomainReplaceConfig{
+	Pool:          &replaceBufferPool,
+	SimpleReplace: domain + `\/_\/`,
+	SmartReplace:  domain + `\/@`,
+})
 
 func fillPool() {
 	for i := 0; i < 100; i++ {
@@ -107,6 +114,66 @@ func TestHardcode(t *testing.T) {
 	replaceBufferPool.Put(buffer)
 }
 
+func TestHardcodeJson(t *testing.T) {
+	buffer := getBufferedData()
+	buffer = _jsonDomainReplace.Apply(buffer)
+	if !bytes.Equal(buffer.B, replacedData) {
+		t.Logf("%s", buffer.B)
+		t.Error("Json replace is not valid")
+	}
+	replaceBufferPool.Put(buffer)
+
+	all := hardcode.NewJsonDomainReplace(hardcode.JsonDomainReplaceConfig{
+		Pool:          &replaceBufferPool,
+		SimpleReplace: domain + `\/_\/`,
+		SmartReplace:  domain + `\/@`,
+		Keys:          []string{"*"},
+	})
+	for _, c := range [][2]string{
+		// Ссылки, которые пропускает hardcode
+		{`{"url":"https://sun9-1.userapi.com/a.jpg"}`, `{"url":"https://` + domain + `/_/sun9-1.userapi.com/a.jpg"}`},
+		{`{"url":"http:\/\/sun9-1.userapi.com\/a.jpg"}`, `{"url":"https:\/\/` + domain + `\/_\/sun9-1.userapi.com\/a.jpg"}`},
+		{`{"src":"\/\/sun9-1.userapi.com\/a.jpg"}`, `{"src":"\/\/` + domain + `\/_\/sun9-1.userapi.com\/a.jpg"}`},
+		{`{"text":"photo: https:\/\/pp.userapi.com\/a.jpg, video: https://vk.com/video_hls.php?id=1"}`,
+			`{"text":"photo: https:\/\/` + domain + `\/_\/pp.userapi.com\/a.jpg, video: https://` + domain + `/@vk.com/video_hls.php?id=1"}`},
+		{`[{"sizes":["https://vk.com/images/a.png"]}]`, `[{"sizes":["https://` + domain + `/_/vk.com/images/a.png"]}]`},
+		// Пробелы между токенами убираются, остальные значения не меняются
+		{"{ \"a\" : [1.50, true, null, \"x\"], \"b\\\"\": \"https://sun9-1.userapi.com/\" }",
+			`{"a":[1.50,true,null,"x"],"b\"":"https://` + domain + `/_/sun9-1.userapi.com/"}`},
+		// Не меняются
+		{`{"url":"https://m.vk.com/a"}`, ``},
+		{`{"url":"https://vk.com/feed"}`, ``},
+		{`{"url":"ftp://sun9-1.userapi.com/a"}`, ``},
+		{`{"url":"xhttps://sun9-1.userapi.com/a"}`, ``},
+		{`{"url":"a//sun9-1.userapi.com/a"}`, ``},
+		{`{"url":"https://sun9-1.userapi.com"}`, ``},
+		{`{"https://sun9-1.userapi.com/":1}`, ``},
+		{`{"url":"https://sun9-1.userapi.com/a"`, ``},
+		{`{"url":"https://sun9-1.userapi.com/a"} {}`, ``},
+	} {
+		testJsonReplace(t, all, c[0], c[1])
+	}
+
+	// По умолчанию ссылки ищутся только в DefaultJsonKeys
+	testJsonReplace(t, _jsonDomainReplace,
+		`{"url":"https://pp.userapi.com/a","photo_100":["https://pp.userapi.com/b"],"text":"https://pp.userapi.com/c"}`,
+		`{"url":"https://`+domain+`/_/pp.userapi.com/a","photo_100":["https://`+domain+`/_/pp.userapi.com/b"],"text":"https://pp.userapi.com/c"}`)
+}
+
+// Пустой expected значит, что ответ не должен измениться
+func testJsonReplace(t *testing.T, replace x.Replace, input, expected string) {
+	if expected == "" {
+		expected = input
+	}
+	buffer := replaceBufferPool.Get()
+	buffer.SetString(input)
+	buffer = replace.Apply(buffer)
+	if string(buffer.B) != expected {
+		t.Errorf("%s must be replaced to %s but got %s", input, expected, buffer.B)
+	}
+	replaceBufferPool.Put(buffer)
+}
+
 func BenchmarkReplace(b *testing.B) {
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
@@ -128,6 +195,13 @@ func BenchmarkReplaceHardcode(b *testing.B) {
 	}
 }
 
+func BenchmarkReplaceHardcodeJson(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		replaceBufferPool.Put(_jsonDomainReplace.Apply(getBufferedData()))
+	}
+}
+
 func BenchmarkStringReplace(b *testing.B) {
 	b.ReportAllocs()
 	needle := []byte(".com")
@@ -144,3 +218,121 @@ func BenchmarkMyStringReplace(b *testing.B) {
 		replaceBufferPool.Put(replacer.Apply(getBufferedData()))
 	}
 }
+
+var multiReplacePairs = []string{
+	`"https:\/\/pp.userapi.com\/`, `"https:\/\/` + domain + `\/_\/pp.userapi.com\/`,
+	`"https:\/\/m.vk.com\/`, `"https:\/\/` + domain + `\/@m.vk.com\/`,
+	`"https:\/\/vk.com\/`, `"https:\/\/` + domain + `\/@vk.com\/`,
+	`"https:\/\/cs1-66v4.vkuseraudio.net\/`, `"https:\/\/` + domain + `\/_\/cs1-66v4.vkuseraudio.net\/`,
+}
+
+func TestMultiStringReplace(t *testing.T) {
+	testMultiStringReplace(t, "test", "bed", "test", "bed")
+	testMultiStringReplace(t, "2test2best2", "2bed2b2", "test", "bed", "best", "b")
+	testMultiStringReplace(t, "testbest", "bedb", "test", "bed", "best", "b")
+	// Перекрытия: выигрывает образец, который закончился раньше, а из них -- самый длинный
+	testMultiStringReplace(t, "abcd", "aYd", "abcd", "X", "bc", "Y")
+	testMultiStringReplace(t, "ttest", "xest", "test", "bed", "tt", "x")
+	testMultiStringReplace(t, "abc", "X", "bc", "Y", "abc", "X")
+	testMultiStringReplace(t, "aaaa", "bb", "aa", "b")
+	testMultiStringReplace(t, "", "", "a", "b")
+
+	testMultiStringReplaceData(t, multiReplacePairs...)
+	testMultiStringReplaceData(t, ".com", "bigstring", "userapi", "uapi", `"https:`, `"http:`)
+}
+
+func testMultiStringReplaceData(t *testing.T, pairs ...string) {
+	buffer := getBufferedData()
+	buffer = newMultiStringReplace(pairs...).Apply(buffer)
+	expected := string(rawData)
+	for i := 0; i < len(pairs); i += 2 {
+		expected = strings.Replace(expected, pairs[i], pairs[i+1], -1)
+	}
+	if string(buffer.B) != expected {
+		t.Errorf("Multi string replace of %v is not equal to chained replaces", pairs)
+	}
+	replaceBufferPool.Put(buffer)
+}
+
+func testMultiStringReplace(t *testing.T, input, expected string, pairs ...string) {
+	buffer := replaceBufferPool.Get()
+	buffer.SetString(input)
+	buffer = newMultiStringReplace(pairs...).Apply(buffer)
+	if string(buffer.B) != expected {
+		t.Errorf("%s must replaced to '%s' but got '%s'", input, expected, string(buffer.B))
+	}
+	replaceBufferPool.Put(buffer)
+}
+
+func BenchmarkChainedStringReplace(b *testing.B) {
+	b.ReportAllocs()
+	var replaces []*stringReplace
+	for i := 0; i < len(multiReplacePairs); i += 2 {
+		replaces = append(replaces, newStringReplace(multiReplacePairs[i], multiReplacePairs[i+1]))
+	}
+	for i := 0; i < b.N; i++ {
+		buffer := getBufferedData()
+		for _, replace := range replaces {
+			buffer = replace.Apply(buffer)
+		}
+		replaceBufferPool.Put(buffer)
+	}
+}
+
+func BenchmarkMultiStringReplace(b *testing.B) {
+	b.ReportAllocs()
+	replacer := newMultiStringReplace(multiReplacePairs...)
+	for i := 0; i < b.N; i++ {
+		replaceBufferPool.Put(replacer.Apply(getBufferedData()))
+	}
+}
+
+// Большой ответ, чтобы потоковая замена успела обработать его в несколько приемов
+var bigRawData = bytes.Repeat(rawData, 20)
+
+func TestStreamReplace(t *testing.T) {
+	testStreamReplace(t, "string", newStringReplace(".com", "bigstring"))
+	testStreamReplace(t, "string-long", newStringReplace(`userapi.com\/`, `x`))
+	testStreamReplace(t, "regex", _regexReplace)
+	testStreamReplace(t, "hardcode", _hardcodeDomainReplace)
+	// Регулярка с ^ обрабатывается только целиком
+	testStreamReplace(t, "regex-anchored", newRegexReplace(`(?m)^\s*"`, `'`))
+}
+
+func testStreamReplace(t *testing.T, name string, replace x.StreamReplace) {
+	buffer := replaceBufferPool.Get()
+	buffer.Set(bigRawData)
+	buffer = replace.Apply(buffer)
+	expected := string(buffer.B)
+	replaceBufferPool.Put(buffer)
+
+	for _, chunkSize := range []int{1, 7, 333, 4096, 100000, len(bigRawData)} {
+		var output bytes.Buffer
+		w := replace.NewWriter(&output)
+		for data := bigRawData; len(data) > 0; {
+			n := chunkSize
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := w.Write(data[:n]); err != nil {
+				t.Fatal(err)
+			}
+			data = data[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if output.String() != expected {
+			t.Errorf("%s stream replace with %d byte chunks is not equal to Apply", name, chunkSize)
+		}
+	}
+}
+
+func BenchmarkReplaceHardcodeStream(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w := _hardcodeDomainReplace.NewWriter(io.Discard)
+		w.Write(rawData)
+		w.Close()
+	}
+}
@@ -2,13 +2,15 @@ package replacer
 
 import (
 	"bytes"
+	"io"
+	"net"
 	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/json-iterator/go"
 	"github.com/valyala/bytebufferpool"
 	"github.com/valyala/fasthttp"
-	"github.com/xtrafrancyz/vk-proxy/replacer/hardcode"
 	"github.com/xtrafrancyz/vk-proxy/replacer/x"
 )
 
@@ -22,20 +24,33 @@ var (
 	methodPostStr    = []byte("POST")
 )
 
+// Наборы замен, которые маршрут может применить к запросу и ответу
+const (
+	RewriteNone   = ""
+	RewriteApi    = "api"
+	RewriteVk     = "vk"
+	RewriteStatic = "static"
+	RewriteOauth  = "oauth"
+	RewriteAudio  = "audio"
+	RewriteMycdn  = "mycdn"
+)
+
+// IsKnownRewrite проверяет название набора замен из конфига маршрутов
+func IsKnownRewrite(name string) bool {
+	switch name {
+	case RewriteNone, RewriteApi, RewriteVk, RewriteStatic, RewriteOauth, RewriteAudio, RewriteMycdn:
+		return true
+	}
+	return false
+}
+
 type domainConfig struct {
-	apiGlobalReplace           x.Replace
-	apiOfficialLongpollReplace x.Replace
-	apiVkmeLongpollReplace     x.Replace
-	apiLongpollReplace         x.Replace
+	// Замены в теле ответа из файла правил, см. rules.go
+	rules []compiledRule
 
-	hlsReplace      x.Replace
-	m3u8Replace     x.Replace
 	m3u8PathReplace *regexFuncReplace
 
 	headLocationReplace x.Replace
-
-	vkuiLangsHtml x.Replace
-	vkuiApiJs     x.Replace
 }
 
 type Replacer struct {
@@ -43,8 +58,11 @@ type Replacer struct {
 	ProxyStaticDomain      string
 	FilterFeed             bool
 	AddUselessProxyMessage bool
+	// Правила замен в теле ответа, по умолчанию встроенные из rules.json
+	Rules *RuleSet
 
-	config *domainConfig
+	configOnce sync.Once
+	config     *domainConfig
 }
 
 type ReplaceContext struct {
@@ -53,6 +71,12 @@ type ReplaceContext struct {
 	OriginHost string
 	Host       string
 	Path       string
+	// Набор замен из маршрута запроса, см. Rewrite* константы
+	Rewrite string
+	// Адрес клиента с учетом доверенных прокси перед vk-proxy
+	ClientIP net.IP
+	// Названия замен, которые изменили ответ, для лога запросов
+	Rules []string
 }
 
 func (c *ReplaceContext) Reset() {
@@ -61,32 +85,33 @@ func (c *ReplaceContext) Reset() {
 	c.OriginHost = ""
 	c.Host = ""
 	c.Path = ""
+	c.Rewrite = RewriteNone
+	c.ClientIP = nil
+	c.Rules = c.Rules[:0]
+}
+
+// Применяет замену и запоминает ее название, если она что-то заменила. Замены возвращают новый буфер только
+// когда есть совпадения.
+func (c *ReplaceContext) apply(name string, replace x.Replace, body *bytebufferpool.ByteBuffer) *bytebufferpool.ByteBuffer {
+	result := replace.Apply(body)
+	if result != body {
+		c.Rules = append(c.Rules, name)
+	}
+	return result
 }
 
 func (r *Replacer) getDomainConfig() *domainConfig {
-	if r.config == nil {
-		cfg := &domainConfig{}
-		cfg.apiGlobalReplace = hardcode.NewHardcodedDomainReplace(hardcode.HardcodedDomainReplaceConfig{
-			Pool:          &replaceBufferPool,
-			SimpleReplace: r.ProxyBaseDomain + `\/_\/`,
-			SmartReplace:  r.ProxyBaseDomain + `\/@`,
-		})
-		cfg.apiOfficialLongpollReplace = newStringReplace(`"server":"api.vk.com\/`, `"server":"`+r.ProxyBaseDomain+`\/@api.vk.com\/`)
-		cfg.apiVkmeLongpollReplace = newStringReplace(`"server":"api.vk.me\/`, `"server":"`+r.ProxyBaseDomain+`\/@api.vk.me\/`)
-		cfg.apiLongpollReplace = newStringReplace(`"server":"`, `"server":"`+r.ProxyBaseDomain+`\/@`)
-
-		cfg.hlsReplace = newRegexReplace(`https:\/\/([-_a-zA-Z0-9]+\.(?:userapi\.com|vk-cdn\.net|vk\.me|mycdn\.me|vkuser(?:live|video)\.(?:net|com)))\/`, `https://`+r.ProxyBaseDomain+`/_/$1/`)
-		cfg.m3u8Replace = newRegexReplace(`https:\/\/([-_a-zA-Z0-9]+\.(?:userapi\.com|vk-cdn\.net|vk\.me|mycdn\.me|vkuseraudio\.(?:net|com)))\/`, `https://`+r.ProxyBaseDomain+`/_/$1/`)
+	r.configOnce.Do(func() {
+		cfg := &domainConfig{
+			rules: r.compileRules(),
+		}
 		cfg.m3u8PathReplace = &regexFuncReplace{
 			regex: regexp.MustCompile(`(?mi)^[a-z0-9_-].*`),
 		}
 
 		cfg.headLocationReplace = newRegexReplace(`^https?://([^/]+)(.*)`, `https://`+r.ProxyBaseDomain+`/@$1$2`)
-
-		cfg.vkuiLangsHtml = newStringReplace(`https://vk.com/js/vkui_lang.js`, `https://`+r.ProxyBaseDomain+`/_/vk.com/js/vkui_lang.js`)
-		cfg.vkuiApiJs = newStringReplace(`api.vk.com`, r.ProxyBaseDomain)
 		r.config = cfg
-	}
+	})
 	return r.config
 }
 
@@ -108,7 +133,7 @@ func (r *Replacer) DoReplaceRequest(req *fasthttp.Request, ctx *ReplaceContext)
 
 	// UPD 22.08.2021 - Пока не будет выяснен способ получения secret для генерации подписи, этот код не имеет смысла
 	// UPD 17.11.2021 (YTKAB0BP) - Похоже, sig больше не используется в новых версиях VK, поэтому можно использовать замену без него
-	if ctx.Host == "oauth.vk.com" {
+	if ctx.Rewrite == RewriteOauth {
 		// Для авторизации страницы VKUI используют не уже готовый токен авторизации, а получают его при каждом
 		// открытии страницы. В запросе авторизации передается текущий урл страницы VKUI, а так как она проксируется,
 		// то она отличается от оригинальной. ВК проверяет этот урл страницы и отвергает авторизацию если он не
@@ -154,7 +179,9 @@ func (r *Replacer) DoReplaceRequest(req *fasthttp.Request, ctx *ReplaceContext)
 	}
 }
 
-func (r *Replacer) DoReplaceResponse(res *fasthttp.Response, body *bytebufferpool.ByteBuffer, ctx *ReplaceContext) *bytebufferpool.ByteBuffer {
+// DoReplaceResponseHeaders заменяет только заголовки ответа. Используется вместо DoReplaceResponse, когда тело
+// ответа не нужно менять и оно отдается клиенту потоком.
+func (r *Replacer) DoReplaceResponseHeaders(res *fasthttp.Response, ctx *ReplaceContext) {
 	config := r.getDomainConfig()
 
 	if bytes.Equal(ctx.Method, methodOptionsStr) {
@@ -162,58 +189,20 @@ func (r *Replacer) DoReplaceResponse(res *fasthttp.Response, body *bytebufferpoo
 		if corsOrigin := res.Header.Peek("Access-Control-Allow-Origin"); corsOrigin != nil {
 			res.Header.Set("Access-Control-Allow-Origin", "https://"+r.ProxyStaticDomain)
 		}
-		return body
+		return
 	}
 
-	if ctx.Host == "api.vk.com" {
-		body = config.apiGlobalReplace.Apply(body)
-
-		// Replace longpoll server
-		if ctx.Path == "/method/messages.getLongPollServer" {
-			body = config.apiLongpollReplace.Apply(body)
-		} else
-
-		// Replace longpoll server for official app
-		if ctx.Path == "/method/execute" ||
-			ctx.Path == "/method/execute.imGetLongPollHistoryExtended" ||
-			ctx.Path == "/method/execute.imLpInit" {
-			body = config.apiOfficialLongpollReplace.Apply(body)
-			body = config.apiVkmeLongpollReplace.Apply(body)
-		}
-
-		if r.FilterFeed {
-			if ctx.Path == "/method/execute.getNewsfeedSmart" ||
-				ctx.Path == "/method/newsfeed.get" {
-				var parsed map[string]interface{}
-				if err := json.Unmarshal(body.B, &parsed); err == nil {
-					if parsed["response"] != nil {
-						response := parsed["response"].(map[string]interface{})
-						modified := tryRemoveAds(response)
-						modified = tryInsertAdPost(response) || modified
-						if r.AddUselessProxyMessage {
-							modified = tryInsertUselessProxyPost(response, ctx) || modified
-						}
-						if modified {
-							body.B, err = json.Marshal(parsed)
-						}
-					}
-				}
-			}
-		}
-
-	} else if ctx.Host == "vk.com" {
-		if ctx.Path == "/video_hls.php" {
-			body = config.hlsReplace.Apply(body)
-		} else if ctx.Path == "/err404.php" {
+	if ctx.Rewrite == RewriteVk {
+		if ctx.Path == "/err404.php" {
 			if location := res.Header.Peek("Location"); location != nil {
 				// Если редирект идет на .m3u8, то редиректим на прокси с заменой
 				if bytes.Contains(location, indexM3u8Str) {
-					replaceLocationHeader(config, location, res)
+					replaceLocationHeader(config, location, res, ctx)
 				}
 			}
 		}
 
-	} else if ctx.Host == "static.vk.com" {
+	} else if ctx.Rewrite == RewriteStatic {
 		if location := res.Header.Peek("Location"); location != nil {
 			// Абсолютный редирект на статик меняем на относительный
 			locstr := string(location)
@@ -225,56 +214,20 @@ func (r *Replacer) DoReplaceResponse(res *fasthttp.Response, body *bytebufferpoo
 				relativeRedirectPath := locstr[idx+13: /*static.vk.com*/]
 				relativeRedirectPath = relativeRedirectPath[longestCommonPrefix(relativeRedirectPath, relativePath):]
 				res.Header.Set("Location", relativeRedirectPath)
+				ctx.Rules = append(ctx.Rules, "static-location")
 			} else {
-				replaceLocationHeader(config, location, res)
+				replaceLocationHeader(config, location, res, ctx)
 			}
 		}
 
-		if strings.HasSuffix(ctx.Path, ".js") {
-			body = config.vkuiApiJs.Apply(body)
-		} else {
-			contentType := string(res.Header.ContentType())
-			if strings.HasPrefix(contentType, "text/html") {
-				body = config.vkuiLangsHtml.Apply(body)
-			}
-		}
-	} else if strings.HasSuffix(ctx.Host, ".vkuseraudio.net") || strings.HasSuffix(ctx.Host, ".vkuseraudio.com") {
-		if strings.HasSuffix(ctx.Path, ".m3u8") {
-			if location := res.Header.Peek("Location"); location != nil {
-				replaceLocationHeader(config, location, res)
-			} else {
-				body = config.m3u8Replace.Apply(body)
-
-				// Заменяем относительный путь для .ts файлов на абсолютный, чтобы к ним не применялись умные фильтры
-				// с заменой ссылок
-				absolutePath := "https://" + r.ProxyBaseDomain + "/_/" + ctx.Host + ctx.Path[:strings.LastIndexByte(ctx.Path, '/')+1]
-				body = config.m3u8PathReplace.ApplyFunc(body, func(src, dst []byte, start, end int) []byte {
-					// Пропускаем если:
-					//  - это абсолютная ссылка (уже заменили ее заранее)
-					//  - это относительная ссылка на .m3u8, нам еще и его предстоит обработать
-					if bytes.HasPrefix(src[start:end], httpsStr) ||
-						bytes.Contains(src[start:end], m3u8ExtStr) {
-						goto cancel
-					}
-					return append(append(dst, absolutePath...), src[start:end]...)
-				cancel:
-					return append(dst, src[start:end]...)
-				})
-			}
-		}
-	} else if strings.HasSuffix(ctx.Host, ".mycdn.me") {
+	} else if ctx.Rewrite == RewriteAudio || ctx.Rewrite == RewriteMycdn {
 		if strings.HasSuffix(ctx.Path, ".m3u8") {
 			if location := res.Header.Peek("Location"); location != nil {
-				replaceLocationHeader(config, location, res)
-			} else {
-				body = config.m3u8Replace.Apply(body)
+				replaceLocationHeader(config, location, res, ctx)
 			}
 		}
-	} else if ctx.Host == "oauth.vk.com" {
-		if ctx.Path == "/token" {
-			body = config.apiGlobalReplace.Apply(body)
-		}
 
+	} else if ctx.Rewrite == RewriteOauth {
 		// При авторизации из VKUI порядок запросов следующий:
 		// 1. /authorize с подписью от приложения
 		// 2. Редирект на /auth_by_token
@@ -289,18 +242,143 @@ func (r *Replacer) DoReplaceResponse(res *fasthttp.Response, body *bytebufferpoo
 					"Location",
 					strings.Replace(string(location), "oauth.vk.com", ctx.OriginHost, 1),
 				)
+				ctx.Rules = append(ctx.Rules, "oauth-location")
 			}
 		}
 	}
+}
 
+// NeedsResponseBody проверяет, будет ли DoReplaceResponse менять тело ответа. Если нет, то тело можно не читать
+// в память целиком. Решение принимается по уже полученным заголовкам ответа.
+func (r *Replacer) NeedsResponseBody(res *fasthttp.Response, ctx *ReplaceContext) bool {
+	if bytes.Equal(ctx.Method, methodOptionsStr) {
+		return false
+	}
+	for _, rule := range r.getDomainConfig().rules {
+		if rule.matches(res, ctx) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Replacer) DoReplaceResponse(res *fasthttp.Response, body *bytebufferpool.ByteBuffer, ctx *ReplaceContext) *bytebufferpool.ByteBuffer {
+	r.DoReplaceResponseHeaders(res, ctx)
+	if bytes.Equal(ctx.Method, methodOptionsStr) {
+		return body
+	}
+
+	config := r.getDomainConfig()
+	for _, rule := range config.rules {
+		if !rule.matches(res, ctx) {
+			continue
+		}
+		switch rule.Action {
+		case actionFeedFilter:
+			body = r.filterFeed(rule.Name, body, ctx)
+		case actionM3u8Paths:
+			body = r.replaceM3u8Paths(config, body, ctx)
+		default:
+			body = ctx.apply(rule.Name, rule.replace, body)
+		}
+	}
 	return body
 }
 
-func replaceLocationHeader(config *domainConfig, location []byte, res *fasthttp.Response) {
+// NewResponseWriter возвращает writer, который пишет в w тело ответа с теми же заменами, что DoReplaceResponse,
+// не держа его в памяти целиком, и меняет заголовки ответа. Если какую-то из замен нельзя применять по частям,
+// то возвращает nil и ничего не меняет. Заранее неизвестно, найдутся ли совпадения, поэтому в ctx.Rules
+// попадают все подошедшие замены.
+func (r *Replacer) NewResponseWriter(res *fasthttp.Response, w io.Writer, ctx *ReplaceContext) io.WriteCloser {
+	if bytes.Equal(ctx.Method, methodOptionsStr) {
+		return nil
+	}
+	var replaces []x.StreamReplace
+	var names []string
+	for _, rule := range r.getDomainConfig().rules {
+		if !rule.matches(res, ctx) {
+			continue
+		}
+		replace, ok := rule.replace.(x.StreamReplace)
+		if !ok {
+			return nil
+		}
+		replaces = append(replaces, replace)
+		names = append(names, rule.Name)
+	}
+	if len(replaces) == 0 {
+		return nil
+	}
+	r.DoReplaceResponseHeaders(res, ctx)
+	ctx.Rules = append(ctx.Rules, names...)
+	// Каждая замена пишет в следующую, последняя -- в w
+	chain := make(writerChain, len(replaces))
+	for i := len(replaces) - 1; i >= 0; i-- {
+		chain[i] = replaces[i].NewWriter(w)
+		w = chain[i]
+	}
+	return chain
+}
+
+// Цепочка потоковых замен: данные пишутся в первую, закрываются по порядку, чтобы остаток каждой прошел
+// через следующие
+type writerChain []io.WriteCloser
+
+func (c writerChain) Write(p []byte) (int, error) {
+	return c[0].Write(p)
+}
+
+func (c writerChain) Close() error {
+	for _, w := range c {
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Replacer) filterFeed(name string, body *bytebufferpool.ByteBuffer, ctx *ReplaceContext) *bytebufferpool.ByteBuffer {
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(body.B, &parsed); err == nil {
+		if parsed["response"] != nil {
+			response := parsed["response"].(map[string]interface{})
+			modified := tryRemoveAds(response)
+			modified = tryInsertAdPost(response) || modified
+			if r.AddUselessProxyMessage {
+				modified = tryInsertUselessProxyPost(response, ctx) || modified
+			}
+			if modified {
+				body.B, err = json.Marshal(parsed)
+				ctx.Rules = append(ctx.Rules, name)
+			}
+		}
+	}
+	return body
+}
+
+func (r *Replacer) replaceM3u8Paths(config *domainConfig, body *bytebufferpool.ByteBuffer, ctx *ReplaceContext) *bytebufferpool.ByteBuffer {
+	// Заменяем относительный путь для .ts файлов на абсолютный, чтобы к ним не применялись умные фильтры
+	// с заменой ссылок
+	absolutePath := "https://" + r.ProxyBaseDomain + "/_/" + ctx.Host + ctx.Path[:strings.LastIndexByte(ctx.Path, '/')+1]
+	return config.m3u8PathReplace.ApplyFunc(body, func(src, dst []byte, start, end int) []byte {
+		// Пропускаем если:
+		//  - это абсолютная ссылка (уже заменили ее заранее)
+		//  - это относительная ссылка на .m3u8, нам еще и его предстоит обработать
+		if bytes.HasPrefix(src[start:end], httpsStr) ||
+			bytes.Contains(src[start:end], m3u8ExtStr) {
+			goto cancel
+		}
+		return append(append(dst, absolutePath...), src[start:end]...)
+	cancel:
+		return append(dst, src[start:end]...)
+	})
+}
+
+func replaceLocationHeader(config *domainConfig, location []byte, res *fasthttp.Response, ctx *ReplaceContext) {
 	// Заменяем абсолютные редиректы на прокси с заменой
 	buf := AcquireBuffer()
 	buf.Set(location)
-	buf = config.headLocationReplace.Apply(buf)
+	buf = ctx.apply("location", config.headLocationReplace, buf)
 	res.Header.SetBytesV("Location", buf.Bytes())
 	ReleaseBuffer(buf)
 }
@@ -0,0 +1,441 @@
+package replacer
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/json-iterator/go"
+	"github.com/valyala/fasthttp"
+	"github.com/xtrafrancyz/vk-proxy/replacer/hardcode"
+	"github.com/xtrafrancyz/vk-proxy/replacer/x"
+)
+
+// Действия правил
+const (
+	// Замена строки find на replace
+	actionString = "string"
+	// Замена нескольких строк из replaces за один проход по ответу
+	actionStrings = "strings"
+	// Замена регулярного выражения find на replace, в replace можно ссылаться на группы: $1
+	actionRegex = "regex"
+	// Замена ссылок на домены вк в JSON ответах апи, см. hardcode.NewHardcodedDomainReplace
+	actionHardcoded = "hardcoded"
+	// То же, что hardcoded, но с разбором JSON: находит ссылки в любом месте строк в ключах keys,
+	// см. hardcode.NewJsonDomainReplace
+	actionJsonDomains = "json-domains"
+	// Удаление рекламы из ленты и вставка постов из newsfeed.json, работает только с -filter-feed
+	actionFeedFilter = "feed-filter"
+	// Относительные ссылки в плейлисте .m3u8 становятся абсолютными ссылками через прокси
+	actionM3u8Paths = "m3u8-paths"
+)
+
+const methodPathPrefix = "/method/"
+
+var (
+	rulesJson = jsoniter.Config{DisallowUnknownFields: true}.Froze()
+
+	// Правила по умолчанию, используются если не задан -rewrite-rules
+	//
+	//go:embed rules.json
+	defaultRulesData []byte
+	defaultRules     = mustParseRules(defaultRulesData)
+)
+
+// Rule описывает одну замену в теле ответа из файла правил
+type Rule struct {
+	// Название для лога запросов, у нескольких правил может быть одно название
+	Name string `json:"name"`
+	// Правила применяются по возрастанию order, с одинаковым order -- в порядке файла
+	Order int `json:"order"`
+
+	// Условия, при которых применяется правило. Должны выполниться все заданные условия, в каждом списке
+	// достаточно одного совпадения.
+	Rewrite    []string `json:"rewrite"`
+	Host       []string `json:"host"`
+	Path       []string `json:"path"`
+	PathPrefix []string `json:"path_prefix"`
+	PathSuffix []string `json:"path_suffix"`
+	// Правило не применяется, если путь заканчивается на одно из значений
+	NotPathSuffix []string `json:"not_path_suffix"`
+	Method        []string `json:"method"`
+	// Начало заголовка Content-Type ответа
+	ContentType []string `json:"content_type"`
+	// Метод апи из пути /method/<метод>
+	ApiMethod []string `json:"api_method"`
+	// Есть ли в ответе заголовок Location
+	Location *bool `json:"location"`
+
+	Action string `json:"action"`
+	Find   string `json:"find"`
+	// В замене {domain} подставляется домен прокси (вместе с ключом доступа), {static} -- статик домен
+	Replace string `json:"replace"`
+	// Пары [find, replace] для действия strings
+	Replaces [][2]string `json:"replaces"`
+	// Ключи JSON со ссылками для действия json-domains, photo_* -- все ключи с префиксом photo_, * -- все строки
+	Keys []string `json:"keys"`
+	// Дополнительные домены для действий hardcoded и json-domains, заменяют правила DefaultHosts с тем же host
+	Hosts []hardcode.HostRule `json:"hosts"`
+}
+
+type parsedRule struct {
+	Rule
+	regex       *regexp.Regexp
+	method      [][]byte
+	contentType [][]byte
+	hosts       *hardcode.HostTable
+}
+
+// RuleSet -- разобранный файл правил. Замены из него создаются для каждого Replacer отдельно, так как зависят
+// от домена прокси.
+type RuleSet struct {
+	File  string
+	rules []*parsedRule
+	// Домены из всех правил вместе, их пропускает /_/
+	hosts *hardcode.HostTable
+	// Домены, которые вставляют в ссылки /_/ правила string и strings
+	passThroughHosts map[string]bool
+	// Правила regex, которые вставляют в ссылки /_/
+	passThroughRegex []*parsedRule
+	// Результаты проверки доменов правилами passThroughRegex, см. IsProxiedHost
+	regexHostsLock sync.Mutex
+	regexHosts     map[string]bool
+}
+
+const (
+	passThroughPath = "/_/"
+	// Домены в /_/ приходят от клиента, поэтому кеш проверок ограничен и очищается целиком, когда заполнится
+	maxRegexHosts = 10000
+)
+
+// LoadRules читает файл правил замен в ответах. Если file пустой, то возвращаются встроенные правила.
+func LoadRules(file string) (*RuleSet, error) {
+	if file == "" {
+		return defaultRules, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := parseRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rewrite rules %s: %w", file, err)
+	}
+	rules.File = file
+	return rules, nil
+}
+
+func mustParseRules(data []byte) *RuleSet {
+	rules, err := parseRules(data)
+	if err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+func parseRules(data []byte) (*RuleSet, error) {
+	var rules []Rule
+	if err := rulesJson.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	set := &RuleSet{passThroughHosts: make(map[string]bool), regexHosts: make(map[string]bool)}
+	hosts := [][]hardcode.HostRule{hardcode.DefaultHosts}
+	for i, rule := range rules {
+		parsed, err := parseRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule #%d %q: %w", i+1, rule.Name, err)
+		}
+		set.rules = append(set.rules, parsed)
+		hosts = append(hosts, rule.Hosts)
+		set.addPassThrough(parsed)
+	}
+	var err error
+	if set.hosts, err = hardcode.NewHostTable(hosts...); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(set.rules, func(i, j int) bool {
+		return set.rules[i].Order < set.rules[j].Order
+	})
+	return set, nil
+}
+
+func parseRule(rule Rule) (*parsedRule, error) {
+	if rule.Name == "" {
+		return nil, errors.New("name is not set")
+	}
+	for _, rewrite := range rule.Rewrite {
+		if !IsKnownRewrite(rewrite) {
+			return nil, fmt.Errorf("unknown rewrite %q", rewrite)
+		}
+	}
+	for _, host := range rule.Host {
+		if host == "" || strings.Contains(host[1:], "*") || host[0] == '*' && !strings.HasPrefix(host, "*.") {
+			return nil, fmt.Errorf("invalid host %q, expected domain or *.domain", host)
+		}
+	}
+	parsed := &parsedRule{Rule: rule}
+	for _, method := range rule.Method {
+		parsed.method = append(parsed.method, []byte(strings.ToUpper(method)))
+	}
+	for _, contentType := range rule.ContentType {
+		parsed.contentType = append(parsed.contentType, []byte(contentType))
+	}
+	if rule.Action != actionStrings && len(rule.Replaces) > 0 {
+		return nil, fmt.Errorf("replaces are not used by %s action", rule.Action)
+	}
+	if rule.Action != actionJsonDomains && rule.Keys != nil {
+		return nil, fmt.Errorf("keys are not used by %s action", rule.Action)
+	}
+	if rule.Hosts != nil {
+		if rule.Action != actionHardcoded && rule.Action != actionJsonDomains {
+			return nil, fmt.Errorf("hosts are not used by %s action", rule.Action)
+		}
+		var err error
+		if parsed.hosts, err = hardcode.NewHostTable(hardcode.DefaultHosts, rule.Hosts); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range rule.Keys {
+		if key == "" || strings.Contains(key[:len(key)-1], "*") {
+			return nil, fmt.Errorf("invalid key %q, expected name or prefix*", key)
+		}
+	}
+	switch rule.Action {
+	case actionStrings:
+		if len(rule.Replaces) == 0 || rule.Find != "" || rule.Replace != "" {
+			return nil, errors.New("strings action expects replaces instead of find and replace")
+		}
+		for _, pair := range rule.Replaces {
+			if pair[0] == "" {
+				return nil, errors.New("empty string in replaces")
+			}
+		}
+	case actionString, actionRegex:
+		if rule.Find == "" {
+			return nil, fmt.Errorf("find is not set for %s action", rule.Action)
+		}
+		if rule.Action == actionRegex {
+			var err error
+			if parsed.regex, err = regexp.Compile(rule.Find); err != nil {
+				return nil, err
+			}
+		}
+	case actionHardcoded, actionJsonDomains, actionFeedFilter, actionM3u8Paths:
+		if rule.Find != "" || rule.Replace != "" {
+			return nil, fmt.Errorf("find and replace are not used by %s action", rule.Action)
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q, expected string, strings, regex, hardcoded, json-domains, "+
+			"feed-filter or m3u8-paths", rule.Action)
+	}
+	return parsed, nil
+}
+
+// Запоминает, на какие домены правило вставляет ссылки через /_/
+func (s *RuleSet) addPassThrough(rule *parsedRule) {
+	switch rule.Action {
+	case actionString:
+		s.addPassThroughHosts(rule.Replace)
+	case actionStrings:
+		for _, pair := range rule.Replaces {
+			s.addPassThroughHosts(pair[1])
+		}
+	case actionRegex:
+		if strings.Contains(unescapeSlashes(rule.Replace), passThroughPath) {
+			s.passThroughRegex = append(s.passThroughRegex, rule)
+		}
+	}
+}
+
+func (s *RuleSet) addPassThroughHosts(replace string) {
+	replace = unescapeSlashes(replace)
+	for {
+		idx := strings.Index(replace, passThroughPath)
+		if idx == -1 {
+			return
+		}
+		replace = replace[idx+len(passThroughPath):]
+		host, _, _ := strings.Cut(replace, "/")
+		s.passThroughHosts[host] = true
+	}
+}
+
+func unescapeSlashes(s string) string {
+	return strings.ReplaceAll(s, `\/`, "/")
+}
+
+// IsProxiedHost проверяет, что домен можно проксировать через /_/: он есть в DefaultHosts или в hosts
+// одного из правил, либо правило string, strings или regex само вставляет ссылку на него через /_/. Проверка
+// правилами regex для каждого домена выполняется один раз.
+func (s *RuleSet) IsProxiedHost(host []byte) bool {
+	if s.hosts.IsProxiedHost(host) || s.passThroughHosts[string(host)] {
+		return true
+	}
+	if len(s.passThroughRegex) == 0 {
+		return false
+	}
+	s.regexHostsLock.Lock()
+	proxied, ok := s.regexHosts[string(host)]
+	s.regexHostsLock.Unlock()
+	if ok {
+		return proxied
+	}
+	proxied = s.matchesPassThroughRegex(string(host))
+	s.regexHostsLock.Lock()
+	if len(s.regexHosts) >= maxRegexHosts {
+		s.regexHosts = make(map[string]bool)
+	}
+	s.regexHosts[string(host)] = proxied
+	s.regexHostsLock.Unlock()
+	return proxied
+}
+
+// Ссылка на домен прогоняется через замену правила, как в теле ответа
+func (s *RuleSet) matchesPassThroughRegex(host string) bool {
+	target := passThroughPath + host + "/"
+	for _, link := range []string{"https://" + host + "/", `https:\/\/` + host + `\/`} {
+		for _, rule := range s.passThroughRegex {
+			if strings.Contains(unescapeSlashes(rule.regex.ReplaceAllString(link, rule.Replace)), target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *parsedRule) matches(res *fasthttp.Response, ctx *ReplaceContext) bool {
+	if len(r.Rewrite) > 0 && !containsString(r.Rewrite, ctx.Rewrite) {
+		return false
+	}
+	if len(r.Host) > 0 && !matchesHost(r.Host, ctx.Host) {
+		return false
+	}
+	if len(r.Path) > 0 && !containsString(r.Path, ctx.Path) {
+		return false
+	}
+	if len(r.PathPrefix) > 0 && !hasAny(r.PathPrefix, ctx.Path, strings.HasPrefix) {
+		return false
+	}
+	if len(r.PathSuffix) > 0 && !hasAny(r.PathSuffix, ctx.Path, strings.HasSuffix) {
+		return false
+	}
+	if hasAny(r.NotPathSuffix, ctx.Path, strings.HasSuffix) {
+		return false
+	}
+	if len(r.method) > 0 && !containsBytes(r.method, ctx.Method, bytes.Equal) {
+		return false
+	}
+	if len(r.contentType) > 0 && !containsBytes(r.contentType, res.Header.ContentType(), bytes.HasPrefix) {
+		return false
+	}
+	if len(r.ApiMethod) > 0 &&
+		(!strings.HasPrefix(ctx.Path, methodPathPrefix) || !containsString(r.ApiMethod, ctx.Path[len(methodPathPrefix):])) {
+		return false
+	}
+	if r.Location != nil && *r.Location != (res.Header.Peek(fasthttp.HeaderLocation) != nil) {
+		return false
+	}
+	return true
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAny(list []string, value string, match func(s, part string) bool) bool {
+	for _, item := range list {
+		if match(value, item) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsBytes(list [][]byte, value []byte, match func(s, part []byte) bool) bool {
+	for _, item := range list {
+		if match(value, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// Так же, как host в маршрутах: vk.com или все поддомены *.vk.com
+func matchesHost(list []string, host string) bool {
+	for _, pattern := range list {
+		if strings.HasPrefix(pattern, "*.") {
+			if len(host) > len(pattern)-1 && strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Правило с заменой для конкретного домена прокси
+type compiledRule struct {
+	*parsedRule
+	replace x.Replace
+}
+
+func (r *Replacer) compileRules() []compiledRule {
+	rules := r.Rules
+	if rules == nil {
+		rules = defaultRules
+	}
+	placeholders := strings.NewReplacer("{domain}", r.ProxyBaseDomain, "{static}", r.ProxyStaticDomain)
+	result := make([]compiledRule, 0, len(rules.rules))
+	for _, rule := range rules.rules {
+		compiled := compiledRule{parsedRule: rule}
+		switch rule.Action {
+		case actionString:
+			compiled.replace = newStringReplace(rule.Find, placeholders.Replace(rule.Replace))
+		case actionStrings:
+			pairs := make([]string, 0, len(rule.Replaces)*2)
+			for _, pair := range rule.Replaces {
+				pairs = append(pairs, pair[0], placeholders.Replace(pair[1]))
+			}
+			compiled.replace = newMultiStringReplace(pairs...)
+		case actionRegex:
+			compiled.replace = &regexReplace{
+				regex:       rule.regex,
+				replacement: []byte(placeholders.Replace(rule.Replace)),
+			}
+		case actionHardcoded:
+			compiled.replace = hardcode.NewHardcodedDomainReplace(hardcode.HardcodedDomainReplaceConfig{
+				Pool:          &replaceBufferPool,
+				SimpleReplace: r.ProxyBaseDomain + `\/_\/`,
+				SmartReplace:  r.ProxyBaseDomain + `\/@`,
+				Hosts:         rule.hosts,
+			})
+		case actionJsonDomains:
+			compiled.replace = hardcode.NewJsonDomainReplace(hardcode.JsonDomainReplaceConfig{
+				Pool:          &replaceBufferPool,
+				SimpleReplace: r.ProxyBaseDomain + `\/_\/`,
+				SmartReplace:  r.ProxyBaseDomain + `\/@`,
+				Keys:          rule.Keys,
+				Hosts:         rule.hosts,
+			})
+		case actionFeedFilter:
+			// Без -filter-feed правило не должно заставлять читать тело ответа в память
+			if !r.FilterFeed {
+				continue
+			}
+		}
+		result = append(result, compiled)
+	}
+	return result
+}
@@ -0,0 +1,219 @@
+package replacer
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func replaceResponse(r *Replacer, ctx *ReplaceContext, res *fasthttp.Response, body string) string {
+	buffer := replaceBufferPool.Get()
+	buffer.SetString(body)
+	if r.NeedsResponseBody(res, ctx) {
+		buffer = r.DoReplaceResponse(res, buffer, ctx)
+	}
+	result := buffer.String()
+	replaceBufferPool.Put(buffer)
+	return result
+}
+
+func TestDefaultRulesApi(t *testing.T) {
+	r := &Replacer{ProxyBaseDomain: domain}
+	ctx := &ReplaceContext{Method: []byte("GET"), Rewrite: RewriteApi, Host: "api.vk.com", Path: "/method/users.get"}
+	if result := replaceResponse(r, ctx, &fasthttp.Response{}, string(rawData)); result != string(replacedData) {
+		t.Error("api-domains rule is not valid")
+	}
+	if strings.Join(ctx.Rules, ",") != "api-domains" {
+		t.Errorf("unexpected rules %v", ctx.Rules)
+	}
+
+	ctx = &ReplaceContext{Method: []byte("GET"), Rewrite: RewriteApi, Host: "api.vk.com", Path: "/method/messages.getLongPollServer"}
+	result := replaceResponse(r, ctx, &fasthttp.Response{}, `{"response":{"server":"im.vk.com\/nim1"}}`)
+	if expected := `{"response":{"server":"` + domain + `\/@im.vk.com\/nim1"}}`; result != expected {
+		t.Errorf("expected %s but got %s", expected, result)
+	}
+
+	ctx = &ReplaceContext{Method: []byte("POST"), Rewrite: RewriteApi, Host: "api.vk.com", Path: "/method/execute.imLpInit"}
+	result = replaceResponse(r, ctx, &fasthttp.Response{}, `[{"server":"api.vk.com\/lp"},{"server":"api.vk.me\/lp"}]`)
+	if expected := `[{"server":"` + domain + `\/@api.vk.com\/lp"},{"server":"` + domain + `\/@api.vk.me\/lp"}]`; result != expected {
+		t.Errorf("expected %s but got %s", expected, result)
+	}
+}
+
+func TestDefaultRulesStatic(t *testing.T) {
+	r := &Replacer{ProxyBaseDomain: domain}
+	ctx := &ReplaceContext{Method: []byte("GET"), Rewrite: RewriteStatic, Host: "static.vk.com", Path: "/app.js"}
+	if result := replaceResponse(r, ctx, &fasthttp.Response{}, `fetch("https://api.vk.com/method")`); result != `fetch("https://`+domain+`/method")` {
+		t.Errorf("vkui-api rule is not valid: %s", result)
+	}
+
+	// Ссылка на переводы заменяется только в html страницах, но не в скриптах, даже отданных как text/html
+	lang := `<script src="https://vk.com/js/vkui_lang.js"></script>`
+	html := &fasthttp.Response{}
+	html.Header.SetContentType("text/html; charset=utf-8")
+	for path, expected := range map[string]string{
+		"/index.html": `<script src="https://` + domain + `/_/vk.com/js/vkui_lang.js"></script>`,
+		"/app.js":     lang,
+	} {
+		ctx = &ReplaceContext{Method: []byte("GET"), Rewrite: RewriteStatic, Host: "static.vk.com", Path: path}
+		if result := replaceResponse(r, ctx, html, lang); result != expected {
+			t.Errorf("%s: got %s, expected %s", path, result, expected)
+		}
+	}
+
+	ctx = &ReplaceContext{Method: []byte("GET"), Rewrite: RewriteStatic, Host: "static.vk.com", Path: "/image.png"}
+	res := &fasthttp.Response{}
+	res.Header.SetContentType("image/png")
+	if r.NeedsResponseBody(res, ctx) {
+		t.Error("static images must not be read into memory")
+	}
+}
+
+func TestRulesFile(t *testing.T) {
+	rules, err := parseRules([]byte(`[
+		{"name": "second", "order": 2, "host": ["*.vk.com"], "action": "string", "find": "b", "replace": "c"},
+		{"name": "first", "order": 1, "host": ["*.vk.com"], "method": ["get"], "content_type": ["text/"],
+			"action": "regex", "find": "a(\\d)", "replace": "{domain}${1}b"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Replacer{ProxyBaseDomain: domain, Rules: rules}
+	res := &fasthttp.Response{}
+	res.Header.SetContentType("text/plain")
+
+	ctx := &ReplaceContext{Method: []byte("GET"), Host: "m.vk.com", Path: "/"}
+	if result := replaceResponse(r, ctx, res, "a1"); result != domain+"1c" {
+		t.Errorf("rules must be applied by order, got %s", result)
+	}
+	if strings.Join(ctx.Rules, ",") != "first,second" {
+		t.Errorf("unexpected rules %v", ctx.Rules)
+	}
+
+	ctx = &ReplaceContext{Method: []byte("GET"), Host: "vk.com", Path: "/"}
+	if result := replaceResponse(r, ctx, res, "a1"); result != "a1" {
+		t.Errorf("*.vk.com must not match vk.com, got %s", result)
+	}
+}
+
+func TestRulesJsonDomains(t *testing.T) {
+	rules, err := parseRules([]byte(`[{"name": "json", "rewrite": ["api"], "action": "json-domains", "keys": ["text"]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Replacer{ProxyBaseDomain: domain, Rules: rules}
+	ctx := &ReplaceContext{Method: []byte("GET"), Rewrite: RewriteApi, Host: "api.vk.com", Path: "/method/wall.get"}
+	result := replaceResponse(r, ctx, &fasthttp.Response{}, `{"text":"see https://pp.userapi.com/a"}`)
+	if expected := `{"text":"see https://` + domain + `/_/pp.userapi.com/a"}`; result != expected {
+		t.Errorf("expected %s but got %s", expected, result)
+	}
+}
+
+func TestRulesHosts(t *testing.T) {
+	rules, err := parseRules([]byte(`[{"name": "api-domains", "rewrite": ["api"], "action": "hardcoded",
+		"hosts": [{"host": "*.vk.me", "paths": [{"prefix": "files/"}]}]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Replacer{ProxyBaseDomain: domain, Rules: rules}
+	ctx := &ReplaceContext{Method: []byte("GET"), Rewrite: RewriteApi, Host: "api.vk.com", Path: "/method/docs.get"}
+	result := replaceResponse(r, ctx, &fasthttp.Response{},
+		`["https:\/\/im.vk.me\/files\/a","https:\/\/im.vk.me\/a","https:\/\/sun9-1.userapi.com\/a"]`)
+	expected := `["https:\/\/` + domain + `\/_\/im.vk.me\/files\/a","https:\/\/im.vk.me\/a",` +
+		`"https:\/\/` + domain + `\/_\/sun9-1.userapi.com\/a"]`
+	if result != expected {
+		t.Errorf("expected %s but got %s", expected, result)
+	}
+	if !rules.IsProxiedHost([]byte("im.vk.me")) || !rules.IsProxiedHost([]byte("sun9-1.userapi.com")) {
+		t.Error("hosts from rules must be allowed for pass through")
+	}
+	if rules.IsProxiedHost([]byte("a.b.vk.me")) {
+		t.Error("a.b.vk.me does not match *.vk.me")
+	}
+}
+
+func TestRulesPassThroughHosts(t *testing.T) {
+	for host, expected := range map[string]bool{
+		// DefaultHosts
+		"sun9-1.userapi.com": true,
+		"vk.com":             true,
+		// Ссылки вставляют правила hls и m3u8
+		"sun9-1.vk.me":                         true,
+		"vkvd123-long-video-node.mycdn.me":     true,
+		"psv4-very-long-subdomain.userapi.com": true,
+		// Не вставляет ни одно правило
+		"vk.me":         false,
+		"a.b.vk.me":     false,
+		"example.com":   false,
+		"vk.me.example": false,
+		"":              false,
+	} {
+		if got := defaultRules.IsProxiedHost([]byte(host)); got != expected {
+			t.Errorf("IsProxiedHost(%q) = %v, expected %v", host, got, expected)
+		}
+	}
+
+	rules, err := parseRules([]byte(`[
+  {"name": "a", "action": "string", "find": "x", "replace": "https://{domain}/_/files.example.com/x"},
+  {"name": "b", "action": "strings", "replaces": [["y", "https:\\/\\/{domain}\\/_\\/cdn.example.com\\/y"]]},
+  {"name": "c", "action": "regex", "find": "https:\\/\\/([a-z]+\\.example\\.org)\\/", "replace": "https:\\/\\/{domain}\\/_\\/$1\\/"}
+]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, expected := range map[string]bool{
+		"files.example.com": true,
+		"cdn.example.com":   true,
+		"img.example.org":   true,
+		"img1.example.org":  false,
+		"example.com":       false,
+	} {
+		// Второй раз результат для regex берется из кеша
+		for i := 0; i < 2; i++ {
+			if got := rules.IsProxiedHost([]byte(host)); got != expected {
+				t.Errorf("IsProxiedHost(%q) = %v, expected %v", host, got, expected)
+			}
+		}
+	}
+	// Домены из string и strings проверяются без regex и в кеш не попадают
+	if len(rules.regexHosts) != 3 || !rules.regexHosts["img.example.org"] || rules.regexHosts["img1.example.org"] {
+		t.Errorf("regex hosts cache %v", rules.regexHosts)
+	}
+	for i := 0; i < maxRegexHosts+10; i++ {
+		rules.IsProxiedHost([]byte("h" + strconv.Itoa(i) + ".example.net"))
+	}
+	if len(rules.regexHosts) > maxRegexHosts {
+		t.Errorf("regex hosts cache grew to %d", len(rules.regexHosts))
+	}
+}
+
+func TestRulesValidation(t *testing.T) {
+	for _, data := range []string{
+		`[{"action": "string", "find": "a"}]`,
+		`[{"name": "x", "action": "unknown"}]`,
+		`[{"name": "x", "action": "string"}]`,
+		`[{"name": "x", "action": "regex", "find": "("}]`,
+		`[{"name": "x", "action": "hardcoded", "find": "a"}]`,
+		`[{"name": "x", "rewrite": ["nope"], "action": "hardcoded"}]`,
+		`[{"name": "x", "host": ["vk.*"], "action": "hardcoded"}]`,
+		`[{"name": "x", "action": "hardcoded", "unknown": 1}]`,
+		`[{"name": "x", "action": "strings", "find": "a", "replace": "b"}]`,
+		`[{"name": "x", "action": "strings", "replaces": [["", "b"]]}]`,
+		`[{"name": "x", "action": "string", "find": "a", "replaces": [["a", "b"]]}]`,
+		`[{"name": "x", "action": "hardcoded", "keys": ["url"]}]`,
+		`[{"name": "x", "action": "json-domains", "keys": ["*_url"]}]`,
+		`[{"name": "x", "action": "string", "find": "a", "hosts": [{"host": "*.vk.me"}]}]`,
+		`[{"name": "x", "action": "hardcoded", "hosts": [{"host": "vk.*"}]}]`,
+		`[{"name": "x", "action": "hardcoded", "hosts": [{"host": "*.vk.me", "unknown": 1}]}]`,
+	} {
+		if _, err := parseRules([]byte(data)); err == nil {
+			t.Errorf("rules %s must be invalid", data)
+		}
+	}
+	if !bytes.Contains(defaultRulesData, []byte(`"api-domains"`)) || len(defaultRules.rules) == 0 {
+		t.Error("default rules are empty")
+	}
+}
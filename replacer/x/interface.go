@@ -5,3 +5,8 @@ import "github.com/valyala/bytebufferpool"
 type Replace interface {
 	Apply(input *bytebufferpool.ByteBuffer) *bytebufferpool.ByteBuffer
 }
+
+type BufferPool interface {
+	Get() *bytebufferpool.ByteBuffer
+	Put(b *bytebufferpool.ByteBuffer)
+}
@@ -0,0 +1,77 @@
+package x
+
+import "io"
+
+// Минимальный объем данных, который накапливается перед обработкой, чтобы не обрабатывать каждый мелкий кусок
+const streamChunkSize = 32 * 1024
+
+// StreamReplace -- замена, которая умеет обрабатывать тело по частям, не держа его в памяти целиком
+type StreamReplace interface {
+	Replace
+
+	// NewWriter возвращает writer, который пишет в w все записанные в него данные с заменами. Конец данных
+	// задерживается, пока не станет ясно, что в нем нет начала совпадения. Close дописывает остаток в w,
+	// но сам w не закрывает.
+	NewWriter(w io.Writer) io.WriteCloser
+}
+
+// StreamProcessor заменяет совпадения, которые начинаются в src[from:limit], и дописывает результат в dst.
+// Возвращает позицию, до которой src обработан: limit или конец последнего совпадения, если оно заканчивается
+// после limit. Перед from в src лежит не меньше lookbehind байт уже обработанного текста, если поток не начался
+// позже, после limit -- не меньше lookahead байт или конец потока.
+type StreamProcessor func(dst, src []byte, from, limit int) ([]byte, int)
+
+type streamWriter struct {
+	w          io.Writer
+	process    StreamProcessor
+	lookbehind int
+	lookahead  int
+	buf        []byte
+	from       int
+	out        []byte
+	err        error
+}
+
+// NewStreamWriter оборачивает w заменой process, которой нужно lookbehind байт перед совпадением и lookahead
+// байт после его начала. Если lookahead отрицательный, то все данные обрабатываются только при Close.
+func NewStreamWriter(w io.Writer, lookbehind, lookahead int, process StreamProcessor) io.WriteCloser {
+	return &streamWriter{
+		w:          w,
+		process:    process,
+		lookbehind: lookbehind,
+		lookahead:  lookahead,
+	}
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.buf = append(s.buf, p...)
+	if s.lookahead >= 0 && len(s.buf)-s.from >= s.lookahead+streamChunkSize {
+		s.flush(len(s.buf) - s.lookahead)
+	}
+	return len(p), s.err
+}
+
+func (s *streamWriter) flush(limit int) {
+	var next int
+	s.out, next = s.process(s.out[:0], s.buf, s.from, limit)
+	if _, err := s.w.Write(s.out); err != nil {
+		s.err = err
+		return
+	}
+	keep := next - s.lookbehind
+	if keep < 0 {
+		keep = 0
+	}
+	s.buf = s.buf[:copy(s.buf, s.buf[keep:])]
+	s.from = next - keep
+}
+
+func (s *streamWriter) Close() error {
+	if s.err == nil && len(s.buf) > s.from {
+		s.flush(len(s.buf))
+	}
+	return s.err
+}
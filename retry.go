@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/xtrafrancyz/vk-proxy/replacer"
+)
+
+// Возвращается вместо запроса к апстриму, пока он считается недоступным
+var errCircuitOpen = errors.New("upstream is temporarily unavailable")
+
+// Тела запросов больше этого размера не читаются в память для повтора
+const maxRetryBody = 64 * 1024
+
+// Выполняет запрос по маршруту с повторами и учетом circuit breaker. Повторяются только запросы, которые можно
+// безопасно отправить еще раз, и только при ошибках соединения или 502/503/504 от апстрима.
+func (p *Proxy) doUpstream(r *route, ctx *fasthttp.RequestCtx, replaceContext *replacer.ReplaceContext,
+	maxBody int) error {
+	req, res := &ctx.Request, &ctx.Response
+	host := string(req.Host())
+	retries := 0
+	if r.Retries > 0 && isRetryableRequest(req, replaceContext) {
+		if err := bufferRequestBody(req, maxRetryBody); err != nil {
+			return err
+		}
+		retries = r.Retries
+	}
+	for attempt := 0; ; attempt++ {
+		if r.BreakerThreshold > 0 && !p.breakers.allow(host) {
+			return errCircuitOpen
+		}
+		err := doStreamed(r.client, req, res, serverConn(ctx), maxBody)
+		failed := err != nil || isRetryableStatus(res.StatusCode())
+		p.upstreamStats.report(hostLabel(host), failed)
+		if r.BreakerThreshold > 0 {
+			p.breakers.report(host, failed, r.BreakerThreshold, time.Duration(r.BreakerTimeout))
+		}
+		if !failed || attempt >= retries || err != nil && errorClass(err) != errorClassConnection {
+			return err
+		}
+		if p.metrics != nil {
+			p.metrics.upstreamRetries.With(hostLabel(host)).Inc()
+		}
+		// Соединение с апстримом не должно ждать повтора вместе с ненужным телом ответа
+		discardBody(res)
+		time.Sleep(r.backoff(attempt))
+	}
+}
+
+// Экспоненциальная задержка со случайной добавкой, чтобы повторы от разных клиентов не шли одновременно
+func (r *route) backoff(attempt int) time.Duration {
+	base := time.Duration(r.RetryBackoff)
+	if base <= 0 {
+		return 0
+	}
+	delay := base << attempt
+	return delay + time.Duration(rand.Int63n(int64(base)))
+}
+
+func isRetryableStatus(code int) bool {
+	return code == fasthttp.StatusBadGateway || code == fasthttp.StatusServiceUnavailable ||
+		code == fasthttp.StatusGatewayTimeout
+}
+
+// Сервер читает тела запросов потоком, а тело, которое уже ушло в апстрим, второй раз отправить нельзя. Поэтому
+// повторяются только запросы с телом не больше maxRetryBody, оно читается в память до первой попытки. Апи
+// выполняет метод и по GET запросу, поэтому запросы к апи повторяются только для методов, которые ничего не
+// меняют, каким бы методом HTTP они ни пришли. Запросы к oauth не повторяются никогда: код авторизации
+// одноразовый, и повтор после потерянного ответа получил бы ошибку вместо токена.
+func isRetryableRequest(req *fasthttp.Request, replaceContext *replacer.ReplaceContext) bool {
+	if length := req.Header.ContentLength(); req.IsBodyStream() && (length < 0 || length > maxRetryBody) {
+		return false
+	}
+	if replaceContext.Rewrite == replacer.RewriteOauth {
+		return false
+	}
+	if replaceContext.Rewrite == replacer.RewriteApi {
+		return isSafeApiMethod(replaceContext.Path)
+	}
+	return req.Header.IsGet() || req.Header.IsHead()
+}
+
+func isSafeApiMethod(path string) bool {
+	if !strings.HasPrefix(path, "/method/") {
+		return false
+	}
+	dot := strings.IndexByte(path, '.')
+	if dot == -1 {
+		return false
+	}
+	action := path[dot+1:]
+	return strings.HasPrefix(action, "get") || strings.HasPrefix(action, "search")
+}
+
+// Circuit breaker по хостам апстримов. После threshold ошибок подряд хост считается недоступным на timeout, затем
+// пропускается один пробный запрос: если он успешен, то хост снова доступен, иначе снова недоступен на timeout.
+type circuitBreakers struct {
+	lock  sync.Mutex
+	hosts map[string]*breakerState
+}
+
+// Хранится только для хостов с ошибками, успешный запрос удаляет состояние
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuitBreakers() *circuitBreakers {
+	return &circuitBreakers{hosts: make(map[string]*breakerState)}
+}
+
+func (b *circuitBreakers) allow(host string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	state := b.hosts[host]
+	if state == nil || state.openUntil.IsZero() {
+		return true
+	}
+	if state.probing || time.Now().Before(state.openUntil) {
+		return false
+	}
+	state.probing = true
+	return true
+}
+
+func (b *circuitBreakers) report(host string, failed bool, threshold int, timeout time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	state := b.hosts[host]
+	if !failed {
+		if state != nil {
+			delete(b.hosts, host)
+		}
+		return
+	}
+	if state == nil {
+		state = &breakerState{}
+		b.hosts[host] = state
+	}
+	state.failures++
+	if state.probing || state.failures >= threshold {
+		state.openUntil = time.Now().Add(timeout)
+		state.probing = false
+	}
+}
+
+// Количество хостов, которые сейчас считаются недоступными
+func (b *circuitBreakers) openCount() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	count := 0
+	now := time.Now()
+	for _, state := range b.hosts {
+		if now.Before(state.openUntil) || state.probing {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/xtrafrancyz/vk-proxy/replacer"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const host, threshold, timeout = "api.vk.com", 3, 20 * time.Millisecond
+	b := newCircuitBreakers()
+	report := func(failed bool) {
+		b.report(host, failed, threshold, timeout)
+	}
+
+	// Успешный запрос сбрасывает счетчик ошибок
+	report(true)
+	report(true)
+	report(false)
+	report(true)
+	report(true)
+	if !b.allow(host) || b.openCount() != 0 {
+		t.Fatal("breaker must stay closed below the threshold")
+	}
+	report(true)
+	if b.allow(host) || b.openCount() != 1 {
+		t.Fatal("breaker must open after threshold failures in a row")
+	}
+	if !b.allow("other.vk.com") {
+		t.Fatal("breaker of one host must not affect others")
+	}
+
+	// После timeout пропускается только один пробный запрос, его ошибка снова открывает breaker
+	time.Sleep(timeout)
+	if !b.allow(host) {
+		t.Fatal("breaker must let a probe through after timeout")
+	}
+	if b.allow(host) || b.openCount() != 1 {
+		t.Fatal("only one probe must be let through")
+	}
+	report(true)
+	if b.allow(host) {
+		t.Fatal("failed probe must open breaker again")
+	}
+
+	time.Sleep(timeout)
+	if !b.allow(host) {
+		t.Fatal("breaker must let a probe through after timeout")
+	}
+	report(false)
+	if !b.allow(host) || !b.allow(host) || b.openCount() != 0 {
+		t.Fatal("successful probe must close breaker")
+	}
+}
+
+func TestIsRetryableRequest(t *testing.T) {
+	small, large := strings.Repeat("a", 100), strings.Repeat("a", maxRetryBody+1)
+	for _, c := range []struct {
+		method   string
+		path     string
+		rewrite  string
+		body     string
+		stream   int
+		expected bool
+	}{
+		{method: "GET", path: "/method/users.get", rewrite: replacer.RewriteApi, expected: true},
+		{method: "GET", path: "/method/messages.send", rewrite: replacer.RewriteApi},
+		{method: "GET", path: "/method/wall.post", rewrite: replacer.RewriteApi},
+		{method: "HEAD", path: "/method/likes.add", rewrite: replacer.RewriteApi},
+		{method: "GET", path: "/file", expected: true},
+		{method: "HEAD", path: "/file", expected: true},
+		{method: "GET", path: "/access_token", rewrite: replacer.RewriteOauth},
+		{method: "GET", path: "/authorize", rewrite: replacer.RewriteOauth},
+		{method: "POST", path: "/method/users.get", rewrite: replacer.RewriteApi, expected: true},
+		{method: "POST", path: "/method/groups.search", rewrite: replacer.RewriteApi, expected: true},
+		{method: "POST", path: "/method/users.get", rewrite: replacer.RewriteApi, body: small, stream: len(small), expected: true},
+		{method: "POST", path: "/method/users.get", rewrite: replacer.RewriteApi, body: large, stream: len(large)},
+		{method: "POST", path: "/method/users.get", rewrite: replacer.RewriteApi, body: small, stream: -1},
+		{method: "POST", path: "/method/messages.send", rewrite: replacer.RewriteApi},
+		{method: "POST", path: "/method/execute", rewrite: replacer.RewriteApi},
+		{method: "POST", path: "/users.get", rewrite: replacer.RewriteApi},
+		{method: "POST", path: "/method/users.get"},
+		{method: "PUT", path: "/file"},
+	} {
+		req := &fasthttp.Request{}
+		req.Header.SetMethod(c.method)
+		if c.stream != 0 {
+			req.SetBodyStream(strings.NewReader(c.body), c.stream)
+		}
+		replaceContext := &replacer.ReplaceContext{Path: c.path, Rewrite: c.rewrite}
+		if got := isRetryableRequest(req, replaceContext); got != c.expected {
+			t.Errorf("isRetryableRequest(%s %s, rewrite %q, body %d/%d) = %v, expected %v", c.method, c.path,
+				c.rewrite, len(c.body), c.stream, got, c.expected)
+		}
+	}
+
+	for code, expected := range map[int]bool{200: false, 500: false, 502: true, 503: true, 504: true} {
+		if isRetryableStatus(code) != expected {
+			t.Errorf("isRetryableStatus(%d) = %v, expected %v", code, !expected, expected)
+		}
+	}
+}
+
+func TestUpstreamRetry(t *testing.T) {
+	routes := `[
+  {"host": "files.test", "via": ["default"], "upstream_scheme": "http"},
+  {"host": "api.test", "via": ["endpoint"], "upstream_scheme": "http", "rewrite": "api", "retries": 2},
+  {"host": "oauth.test", "via": ["endpoint"], "upstream_scheme": "http", "rewrite": "oauth", "retries": 2}
+]`
+	var lock sync.Mutex
+	attempts := make(map[string]int)
+	bodies := make(map[string][]string)
+	_, client := newTestProxy(t, ProxyConfig{RoutesFile: writeTestFile(t, "routes.json", routes)}, func(ctx *fasthttp.RequestCtx) {
+		path := string(ctx.Method()) + " " + string(ctx.Path())
+		lock.Lock()
+		attempts[path]++
+		attempt := attempts[path]
+		bodies[path] = append(bodies[path], string(ctx.PostBody()))
+		lock.Unlock()
+		if attempt == 1 {
+			// Тело больше того, что дочитывается перед повтором
+			ctx.SetStatusCode(fasthttp.StatusBadGateway)
+			ctx.SetBodyStream(strings.NewReader(strings.Repeat("x", maxDiscardedBody*2)), -1)
+			return
+		}
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"response":1}`)
+	})
+
+	post := func(req *fasthttp.Request) {
+		req.Header.SetMethod("POST")
+		req.Header.SetContentType("application/x-www-form-urlencoded")
+		req.SetBodyString("user_ids=1&v=5.131")
+	}
+	res := doTestRequest(t, client, "http://proxy.test/@api.test/method/users.get", post)
+	if res.StatusCode() != 200 || attempts["POST /method/users.get"] != 2 {
+		t.Fatalf("safe api method got %d after %d attempts", res.StatusCode(), attempts["POST /method/users.get"])
+	}
+	for i, body := range bodies["POST /method/users.get"] {
+		if body != "user_ids=1&v=5.131" {
+			t.Errorf("attempt %d sent body %q", i+1, body)
+		}
+	}
+
+	res = doTestRequest(t, client, "http://proxy.test/@api.test/method/messages.send", post)
+	if res.StatusCode() != fasthttp.StatusBadGateway || attempts["POST /method/messages.send"] != 1 {
+		t.Errorf("unsafe api method got %d after %d attempts", res.StatusCode(), attempts["POST /method/messages.send"])
+	}
+
+	// Апи выполняет метод и по GET, такой запрос мог уже отправить сообщение
+	res = doTestRequest(t, client, "http://proxy.test/@api.test/method/messages.send?peer_id=1&message=hi&v=5.131", nil)
+	if res.StatusCode() != fasthttp.StatusBadGateway || attempts["GET /method/messages.send"] != 1 {
+		t.Errorf("unsafe api method by GET got %d after %d attempts", res.StatusCode(),
+			attempts["GET /method/messages.send"])
+	}
+
+	// Код авторизации одноразовый, даже если для маршрута указаны повторы
+	res = doTestRequest(t, client, "http://proxy.test/@oauth.test/access_token?client_id=1&code=abc", nil)
+	if res.StatusCode() != fasthttp.StatusBadGateway || attempts["GET /access_token"] != 1 {
+		t.Errorf("oauth got %d after %d attempts", res.StatusCode(), attempts["GET /access_token"])
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestParseRouteTableErrors(t *testing.T) {
+	for _, c := range []struct {
+		routes, err string
+	}{
+		{`[{"host": "a.test", "via": ["endpoint"]}]`, "no default route"},
+		{`[]`, "no default route"},
+		{`{"host": "a.test"}`, "cannot unmarshal"},
+		{`[{"host": "a.test", "via": ["default"], "upstream": "b.test"}]`, "unknown field"},
+		{`[{"host": "a.test", "via": ["default"]}, {"host": "b.test", "via": ["default"]}]`,
+			`route "b.test": default route is already set to "a.test"`},
+		{`[{"host": "a.test", "via": ["default", "static"]}, {"host": "b.test", "via": ["static"]}]`,
+			`route "b.test": static route is already set to "a.test"`},
+		{`[{"host": "", "via": ["default"]}]`, "invalid host pattern"},
+		{`[{"host": "*.", "via": ["endpoint"]}]`, "invalid host pattern"},
+		{`[{"host": "a.*.test", "via": ["endpoint"]}]`, "invalid host pattern"},
+		{`[{"host": "a.test/path", "via": ["endpoint"]}]`, "invalid host pattern"},
+		{`[{"host": "*.a.test", "via": ["default"]}]`, "default route needs an exact host"},
+		{`[{"host": "*.a.test", "via": ["static"]}]`, "static route needs an exact host"},
+		{`[{"host": "a.test", "via": ["sometimes"]}]`, `unknown via "sometimes"`},
+		{`[{"host": "a.test", "via": ["default"], "upstream_scheme": "ftp"}]`, `unknown upstream_scheme "ftp"`},
+		{`[{"host": "a.test", "via": ["default"], "rewrite": "magic"}]`, `unknown rewrite "magic"`},
+		{`[{"host": "a.test", "via": ["default"], "retries": -1}]`, "can not be negative"},
+		{`[{"host": "a.test", "via": ["default"], "read_timeout": "soon"}]`, "invalid duration"},
+		{`[{"host": "a.test", "via": ["default"], "egress": "ftp://b.test"}]`, "ftp"},
+	} {
+		if _, err := parseRouteTable([]byte(c.routes)); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got error %v, expected %q", c.routes, err, c.err)
+		}
+	}
+}
+
+func TestParseRouteTableDefaults(t *testing.T) {
+	table, err := parseRouteTable([]byte(`[
+  {"host": "a.test", "via": ["default"], "breaker_threshold": 5},
+  {"host": "b.test", "via": ["endpoint"], "upstream_scheme": "http", "breaker_threshold": 5, "breaker_timeout": "1m"}
+]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := table.routes[0], table.routes[1]
+	if a.UpstreamScheme != "https" || b.UpstreamScheme != "http" {
+		t.Errorf("upstream schemes %q and %q", a.UpstreamScheme, b.UpstreamScheme)
+	}
+	if a.BreakerTimeout != duration(defaultBreakerTimeout) || b.BreakerTimeout != duration(60e9) {
+		t.Errorf("breaker timeouts %v and %v", a.BreakerTimeout, b.BreakerTimeout)
+	}
+	if a.client.ReadTimeout != defaultUpstreamReadTimeout || a.client.WriteTimeout != defaultUpstreamWriteTimeout {
+		t.Errorf("default timeouts %v and %v", a.client.ReadTimeout, a.client.WriteTimeout)
+	}
+	if table.staticRoute != nil {
+		t.Errorf("static route %q without via static", table.staticRoute.Host)
+	}
+}
+
+func TestRouteTableFind(t *testing.T) {
+	table, err := loadRouteTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		via, host, route, upstream string
+	}{
+		{routeViaDefault, "", "api.vk.com", "api.vk.com"},
+		{routeViaDefault, "ignored.test", "api.vk.com", "api.vk.com"},
+		{routeViaStatic, "", "static.vk.com", "static.vk.com"},
+		{routeViaEndpoint, "api.vk.com", "api.vk.com", "api.vk.com"},
+		{routeViaEndpoint, "vk.com", "vk.com", "vk.com"},
+		// Шаблон подходит только для поддоменов, самый первый подходящий маршрут важнее
+		{routeViaEndpoint, "m.vk.com", "*.vk.com", "m.vk.com"},
+		{routeViaEndpoint, "oauth.vk.com", "oauth.vk.com", "oauth.vk.com"},
+		{routeViaEndpoint, "a.b.mycdn.me", "*.mycdn.me", "a.b.mycdn.me"},
+		{routeViaEndpoint, "mycdn.me", "", ""},
+		{routeViaEndpoint, "evilvk.com", "", ""},
+		{routeViaEndpoint, "vk.com.evil.test", "", ""},
+		{routeViaEndpoint, "", "", ""},
+		// Proxy-Host разрешен не для всех хостов
+		{routeViaProxyHost, "oauth.vk.com", "oauth.vk.com", "oauth.vk.com"},
+		{routeViaProxyHost, "static.vk.com", "static.vk.com", "static.vk.com"},
+		{routeViaProxyHost, "api.vk.com", "", ""},
+		{routeViaProxyHost, "m.vk.com", "", ""},
+	} {
+		r, host := table.find(c.via, c.host)
+		name := ""
+		if r != nil {
+			name = r.Host
+		}
+		if name != c.route || host != c.upstream {
+			t.Errorf("%s %q: got route %q with host %q, expected %q with %q", c.via, c.host, name, host, c.route, c.upstream)
+		}
+	}
+
+	for host, expected := range map[string]string{
+		"sun9-1.userapi.com":  "",
+		"m.vk.com":            "*.vk.com",
+		"api.ok.ru":           "api.ok.ru",
+		"cs1.vkuseraudio.net": "*.vkuseraudio.net",
+	} {
+		name := ""
+		if r := table.lookup(host); r != nil {
+			name = r.Host
+		}
+		if name != expected {
+			t.Errorf("lookup %s = %q, expected %q", host, name, expected)
+		}
+	}
+
+	// Без static маршрута prepareProxyRequest отправляет запросы на статик домен по default, см. TestProxyRouting
+	table, err = parseRouteTable([]byte(`[{"host": "a.test", "via": ["default"]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := table.find(routeViaStatic, ""); r != nil {
+		t.Errorf("static route %q in a table without it", r.Host)
+	}
+}
+
+// Куда уходит запрос в зависимости от /@, Proxy-Host и домена, на который он пришел
+func TestProxyRouting(t *testing.T) {
+	routes := `[
+  {"host": "api.test", "via": ["default", "endpoint"], "upstream_scheme": "http"},
+  {"host": "static.test", "via": ["static", "proxy-host"], "upstream_scheme": "http"},
+  {"host": "*.cdn.test", "via": ["endpoint"], "upstream_scheme": "http"},
+  {"host": "alias.test", "via": ["endpoint"], "upstream_scheme": "http", "upstream_host": "origin.test"}
+]`
+	echo := func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString(string(ctx.Host()) + string(ctx.RequestURI()))
+	}
+	_, client := newTestProxy(t, ProxyConfig{
+		RoutesFile:       writeTestFile(t, "routes.json", routes),
+		BaseDomain:       "proxy.test",
+		BaseStaticDomain: "static-proxy.test",
+	}, echo)
+	for _, c := range []struct {
+		uri, proxyHost string
+		status         int
+		upstream       string
+	}{
+		{"http://proxy.test/method/users.get", "", 200, "api.test/method/users.get"},
+		{"http://static-proxy.test/a.js", "", 200, "static.test/a.js"},
+		{"http://proxy.test/a.js", "static.test", 200, "static.test/a.js"},
+		{"http://proxy.test/@api.test/method/users.get", "", 200, "api.test/method/users.get"},
+		{"http://proxy.test/@a1.cdn.test/x.jpg?size=1", "", 200, "a1.cdn.test/x.jpg?size=1"},
+		{"http://proxy.test/@alias.test/x", "", 200, "origin.test/x"},
+		{"http://proxy.test/@cdn.test/x", "", 400, ""},
+		{"http://proxy.test/@evil.test/x", "", 400, ""},
+		{"http://proxy.test/@api.test", "", 400, ""},
+		{"http://proxy.test/x", "api.test", 400, ""},
+		{"http://proxy.test/x", "evil.test", 400, ""},
+	} {
+		res := doTestRequest(t, client, c.uri, func(req *fasthttp.Request) {
+			if c.proxyHost != "" {
+				req.Header.Set("Proxy-Host", c.proxyHost)
+			}
+		})
+		if res.StatusCode() != c.status || c.status == 200 && string(res.Body()) != c.upstream {
+			t.Errorf("%s (Proxy-Host %q) got %d %q, expected %d %q", c.uri, c.proxyHost, res.StatusCode(), res.Body(),
+				c.status, c.upstream)
+		}
+	}
+
+	// Без static маршрута запросы на статик домен идут по default
+	_, client = newTestProxy(t, ProxyConfig{
+		RoutesFile:       writeTestFile(t, "routes.json", `[{"host": "api.test", "via": ["default"], "upstream_scheme": "http"}]`),
+		BaseDomain:       "proxy.test",
+		BaseStaticDomain: "static-proxy.test",
+	}, echo)
+	if res := doTestRequest(t, client, "http://static-proxy.test/a.js", nil); string(res.Body()) != "api.test/a.js" {
+		t.Errorf("static domain without static route got %d %q", res.StatusCode(), res.Body())
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var acmeChallengePrefix = []byte("/.well-known/acme-challenge/")
+
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+
+	// Получение сертификатов для доменов прокси через ACME (Let's Encrypt)
+	ACME          bool
+	ACMEDirectory string
+	ACMEEmail     string
+	ACMECacheDir  string
+	// Дополнительный корневой сертификат для подключения к ACME серверу, например к тестовому Pebble
+	ACMERootCA string
+}
+
+// Создает конфиг для TLS листенеров. Если не указаны ни файлы сертификата, ни ACME, то TLS листенеры не запустятся.
+func (p *Proxy) SetupTLS(config TLSConfig) error {
+	if config.ACME {
+		if config.CertFile != "" || config.KeyFile != "" {
+			return errors.New("tls-cert and tls-key can not be used together with acme")
+		}
+		client := &acme.Client{DirectoryURL: config.ACMEDirectory}
+		if config.ACMERootCA != "" {
+			pem, err := os.ReadFile(config.ACMERootCA)
+			if err != nil {
+				return fmt.Errorf("could not read acme root ca: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificates found in %s", config.ACMERootCA)
+			}
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+			client.HTTPClient = &http.Client{Transport: transport}
+		}
+		p.acme = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(config.ACMECacheDir),
+			HostPolicy: p.acmeHostPolicy,
+			Client:     client,
+			Email:      config.ACMEEmail,
+		}
+		p.acmeHandler = fasthttpadaptor.NewFastHTTPHandler(p.acme.HTTPHandler(nil))
+		p.tlsConfig = p.acme.TLSConfig()
+	} else if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return fmt.Errorf("could not load certificate: %w", err)
+		}
+		p.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+	}
+	return nil
+}
+
+// Домены могут поменяться при перезагрузке конфига, поэтому проверяются текущие
+func (p *Proxy) acmeHostPolicy(_ context.Context, host string) error {
+	config := p.getConfig()
+	if host != config.BaseDomain && host != config.BaseStaticDomain {
+		return fmt.Errorf("acme: host %q is not configured", host)
+	}
+	return nil
+}
+
+// Запросы проверки домена по http-01 обрабатывает сам ACME клиент
+func (p *Proxy) isAcmeChallenge(ctx *fasthttp.RequestCtx) bool {
+	return p.acmeHandler != nil && bytes.HasPrefix(ctx.Path(), acmeChallengePrefix)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Самоподписанный сертификат для proxy.test в файлах PEM
+func writeTestCertificate(t *testing.T) (certFile, keyFile string, der []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "proxy.test"},
+		DNSNames:     []string{"proxy.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if der, err = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key); err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = writeTestFile(t, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyFile = writeTestFile(t, "key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})))
+	return certFile, keyFile, der
+}
+
+func TestSetupTLSFromFiles(t *testing.T) {
+	certFile, keyFile, der := writeTestCertificate(t)
+	p, _ := newTestProxy(t, ProxyConfig{}, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("ok")
+	})
+
+	lc, _ := parseListenerConfig("127.0.0.1:0+tls")
+	if err := p.Listen(lc, nil); err == nil {
+		t.Fatal("tls listener must not start without certificate")
+	}
+	if err := p.SetupTLS(TLSConfig{CertFile: certFile, KeyFile: keyFile}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Listen(lc, nil); err != nil {
+		t.Fatal(err)
+	}
+	ln := p.listeners[len(p.listeners)-1].ln
+	t.Cleanup(func() {
+		ln.Close()
+	})
+
+	var peer []byte
+	client := &fasthttp.Client{
+		Dial: func(string) (net.Conn, error) {
+			conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+			if err == nil {
+				peer = conn.ConnectionState().PeerCertificates[0].Raw
+			}
+			return conn, err
+		},
+	}
+	res := doTestRequest(t, client, "http://proxy.test/file", nil)
+	if string(res.Body()) != "ok" {
+		t.Errorf("unexpected response %q", res.Body())
+	}
+	if !bytes.Equal(peer, der) {
+		t.Error("server presented another certificate")
+	}
+}
+
+func TestSetupTLSErrors(t *testing.T) {
+	certFile, keyFile, _ := writeTestCertificate(t)
+	p := &Proxy{}
+	for _, config := range []TLSConfig{
+		{CertFile: certFile},
+		{CertFile: certFile, KeyFile: certFile},
+		{CertFile: certFile, KeyFile: keyFile + ".missing"},
+		{CertFile: certFile, KeyFile: keyFile, ACME: true},
+	} {
+		if err := p.SetupTLS(config); err == nil {
+			t.Errorf("SetupTLS(%+v) must fail", config)
+		}
+	}
+	if p.tlsConfig != nil {
+		t.Error("failed setup must not enable tls")
+	}
+}
+
+func TestAcmeHostPolicy(t *testing.T) {
+	p, _ := newTestProxy(t, ProxyConfig{BaseDomain: "proxy.test", BaseStaticDomain: "static.proxy.test"}, nil)
+	for host, allowed := range map[string]bool{
+		"proxy.test":        true,
+		"static.proxy.test": true,
+		"evil.test":         false,
+		"a.proxy.test":      false,
+		"proxy.test.evil":   false,
+		"":                  false,
+	} {
+		if err := p.acmeHostPolicy(context.Background(), host); (err == nil) != allowed {
+			t.Errorf("acmeHostPolicy(%q) = %v, expected allowed = %v", host, err, allowed)
+		}
+	}
+}
+
+// Проверку домена по http-01 делает ACME сервер, у него нет ключа доступа, и она не должна упираться в лимиты
+func TestAcmeChallengeRouting(t *testing.T) {
+	const token = "test-token"
+	limit := rateLimit{Rate: 0.001, Burst: 1}
+	for name, config := range map[string]ProxyConfig{
+		"access keys": {AccessKeysFile: writeTestFile(t, "keys.txt", "secret-key test\n")},
+		"rate limits": {ApiRateLimit: limit, MediaRateLimit: limit, LongpollRateLimit: limit},
+	} {
+		config.BaseDomain = "proxy.test"
+		p, client := newTestProxy(t, config, func(ctx *fasthttp.RequestCtx) {
+			ctx.SetBodyString("upstream")
+		})
+		cacheDir := t.TempDir()
+		// Так autocert хранит ответ на проверку, пока ее ждет
+		if err := os.WriteFile(filepath.Join(cacheDir, token+"+http-01"), []byte(token+".thumbprint"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.SetupTLS(TLSConfig{ACME: true, ACMEDirectory: "http://127.0.0.1:1/directory", ACMECacheDir: cacheDir}); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			res := doTestRequest(t, client, "http://proxy.test/.well-known/acme-challenge/"+token, nil)
+			if res.StatusCode() != 200 || string(res.Body()) != token+".thumbprint" {
+				t.Errorf("%s: challenge %d got %d %q", name, i+1, res.StatusCode(), res.Body())
+			}
+		}
+		res := doTestRequest(t, client, "http://evil.test/.well-known/acme-challenge/"+token, nil)
+		if res.StatusCode() != fasthttp.StatusForbidden {
+			t.Errorf("%s: challenge for unknown host got %d", name, res.StatusCode())
+		}
+
+		// Остальные запросы проверки по-прежнему проходят
+		var blocked bool
+		for i := 0; i < 2 && !blocked; i++ {
+			res = doTestRequest(t, client, "http://proxy.test/file", nil)
+			blocked = string(res.Body()) != "upstream"
+		}
+		if !blocked {
+			t.Errorf("%s: regular requests must still be checked", name)
+		}
+	}
+}
+
+// Выпуск сертификата у настоящего ACME сервера. Нужен запущенный Pebble (https://github.com/letsencrypt/pebble),
+// например с PEBBLE_VA_ALWAYS_VALID=1, и переменные:
+//
+//	VK_PROXY_PEBBLE_DIRECTORY=https://localhost:14000/dir
+//	VK_PROXY_PEBBLE_CA=pebble.minica.pem
+//
+// Без PEBBLE_VA_ALWAYS_VALID проверка http-01 придет на порт VK_PROXY_PEBBLE_HTTP_PORT (5002 по умолчанию) домена
+// VK_PROXY_PEBBLE_DOMAIN, он должен указывать на этот компьютер.
+func TestAcmePebble(t *testing.T) {
+	directory := os.Getenv("VK_PROXY_PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("VK_PROXY_PEBBLE_DIRECTORY is not set")
+	}
+	domain := os.Getenv("VK_PROXY_PEBBLE_DOMAIN")
+	if domain == "" {
+		domain = "proxy.test"
+	}
+	httpPort := os.Getenv("VK_PROXY_PEBBLE_HTTP_PORT")
+	if httpPort == "" {
+		httpPort = "5002"
+	}
+
+	p, _ := newTestProxy(t, ProxyConfig{BaseDomain: domain}, nil)
+	err := p.SetupTLS(TLSConfig{
+		ACME:          true,
+		ACMEDirectory: directory,
+		ACMECacheDir:  t.TempDir(),
+		ACMERootCA:    os.Getenv("VK_PROXY_PEBBLE_CA"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bind := range []string{"0.0.0.0:" + httpPort, "127.0.0.1:0+tls"} {
+		lc, err := parseListenerConfig(bind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = p.Listen(lc, nil); err != nil {
+			t.Fatal(err)
+		}
+		ln := p.listeners[len(p.listeners)-1].ln
+		t.Cleanup(func() {
+			ln.Close()
+		})
+	}
+
+	// Сертификат выпускается при первом рукопожатии
+	addr := p.listeners[len(p.listeners)-1].ln.Addr().String()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Minute}, "tcp", addr,
+		&tls.Config{ServerName: domain, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cert := conn.ConnectionState().PeerCertificates[0]
+	if err = cert.VerifyHostname(domain); err != nil {
+		t.Error(err)
+	}
+	if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		t.Error("certificate must be issued by pebble")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// Туннель закрывается, если одна из сторон ничего не присылает дольше этого времени. Клиенты и серверы
+	// WebSocket обычно обмениваются ping раз в 30-60 секунд.
+	tunnelIdleTimeout = 5 * time.Minute
+	tunnelBufferSize  = 32 * 1024
+)
+
+var (
+	upgradeStr = []byte("Upgrade")
+
+	tunnelBufferPool = sync.Pool{New: func() interface{} {
+		b := make([]byte, tunnelBufferSize)
+		return &b
+	}}
+)
+
+// Активные туннели и трафик через них
+type tunnelStats struct {
+	active   atomic.Int64
+	total    atomic.Uint64
+	received atomic.Uint64
+	sent     atomic.Uint64
+	// Туннели, для которых ответ 101 еще не отправлен клиенту, по соединению клиента на fasthttp сервере
+	pending sync.Map
+}
+
+// Соединение клиента закрылось, не дойдя до обработчика туннеля: fasthttp не смог отправить ответ 101 и
+// обработчик уже не вызовет
+func (s *tunnelStats) abortPending(client net.Conn) {
+	if t, ok := s.pending.LoadAndDelete(client); ok {
+		t.(*pendingTunnel).abort()
+	}
+}
+
+// Туннель, для которого апстрим уже ответил 101. Работать он начинает, когда сервер отправит ответ клиенту и
+// отдаст его соединение в run. Если этого не случилось, соединение с апстримом закрывается через abort.
+type pendingTunnel struct {
+	stats *tunnelStats
+	// Соединение клиента из serverConn, под ним туннель лежит в stats.pending до вызова run
+	client net.Conn
+	conn   net.Conn
+	// В br могут остаться данные, которые апстрим отправил сразу после ответа
+	br *bufio.Reader
+}
+
+// ConnState fasthttp сервера
+func (p *Proxy) trackConnState(conn net.Conn, state fasthttp.ConnState) {
+	if state == fasthttp.StateClosed {
+		p.tunnels.abortPending(conn)
+	}
+	if p.conns != nil {
+		p.conns.track(conn, state)
+	}
+}
+
+// Запрос с Connection: Upgrade (WebSocket) нельзя выполнить через fasthttp.Client, для него открывается отдельное
+// соединение с апстримом. Если апстрим ответил 101, то соединение клиента забирается у fasthttp и дальше байты
+// передаются в обе стороны как есть. На любой другой ответ запрос обрабатывается как обычно.
+func (p *Proxy) openTunnel(r *route, ctx *fasthttp.RequestCtx) (bool, error) {
+	req := &ctx.Request
+	host := string(req.Host())
+	addr := host
+	if !strings.Contains(addr, ":") {
+		if r.UpstreamScheme == "https" {
+			addr += ":443"
+		} else {
+			addr += ":80"
+		}
+	}
+	conn, err := r.client.Dial(addr)
+	if err != nil {
+		return false, err
+	}
+	conn.SetDeadline(time.Now().Add(r.client.WriteTimeout + r.client.ReadTimeout))
+	if r.UpstreamScheme == "https" {
+		config := r.client.TLSConfig.Clone()
+		config.ServerName = host
+		if idx := strings.IndexByte(host, ':'); idx != -1 {
+			config.ServerName = host[:idx]
+		}
+		tlsConn := tls.Client(conn, config)
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return false, err
+		}
+		conn = tlsConn
+	}
+
+	// prepareProxyRequest убирает Connection, для апгрейда он нужен
+	req.Header.SetBytesV(fasthttp.HeaderConnection, upgradeStr)
+	bw := bufio.NewWriter(conn)
+	if err = req.Write(bw); err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return false, err
+	}
+
+	res := &ctx.Response
+	res.Reset()
+	br := bufio.NewReader(conn)
+	if err = res.Header.Read(br); err != nil {
+		conn.Close()
+		return false, err
+	}
+	if res.StatusCode() != fasthttp.StatusSwitchingProtocols {
+		err = res.ReadBody(br, 0)
+		conn.Close()
+		return false, err
+	}
+	conn.SetDeadline(time.Time{})
+	res.Header.SetNoDefaultContentType(true)
+	res.Header.SetBytesV(fasthttp.HeaderServer, vkProxyName)
+
+	tunnel := &pendingTunnel{stats: &p.tunnels, client: serverConn(ctx), conn: conn, br: br}
+	if tunnel.client != nil {
+		// Если ответ 101 не удастся отправить, fasthttp закроет соединение клиента, см. Proxy.trackConnState
+		p.tunnels.pending.Store(tunnel.client, tunnel)
+	}
+	ctx.Hijack(tunnel.run)
+	// Адреса с +h2 обслуживает net/http, он забирает соединение клиента сам, см. hijackHttp
+	ctx.SetUserValue(tunnelHandlerKey, tunnel)
+	return true, nil
+}
+
+func (t *pendingTunnel) run(client net.Conn) {
+	if t.client != nil {
+		if _, ok := t.stats.pending.LoadAndDelete(t.client); !ok {
+			// Уже закрыт через abort
+			return
+		}
+	}
+	t.stats.active.Add(1)
+	t.stats.total.Add(1)
+	defer t.stats.active.Add(-1)
+	// Дедлайны, которые выставил сервер для обычного запроса, туннелю не подходят
+	client.SetDeadline(time.Time{})
+	done := make(chan struct{}, 2)
+	go func() {
+		t.stats.received.Add(pipeIdle(t.conn, client, client))
+		done <- struct{}{}
+	}()
+	go func() {
+		t.stats.sent.Add(pipeIdle(client, t.br, t.conn))
+		done <- struct{}{}
+	}()
+	// Когда одна сторона закрылась, вторую тоже нужно закрыть, иначе ее горутина так и будет ждать данных
+	<-done
+	client.Close()
+	t.conn.Close()
+	<-done
+}
+
+func (t *pendingTunnel) abort() {
+	t.conn.Close()
+}
+
+// Копирует данные из src в dst, пока src не закроется или ничего не присылает дольше tunnelIdleTimeout.
+// srcConn - соединение, из которого читает src, на нем выставляется таймаут.
+func pipeIdle(dst net.Conn, src io.Reader, srcConn net.Conn) uint64 {
+	buf := tunnelBufferPool.Get().(*[]byte)
+	defer tunnelBufferPool.Put(buf)
+	var written uint64
+	for {
+		srcConn.SetReadDeadline(time.Now().Add(tunnelIdleTimeout))
+		n, err := src.Read(*buf)
+		if n > 0 {
+			if _, werr := dst.Write((*buf)[:n]); werr != nil {
+				return written
+			}
+			written += uint64(n)
+		}
+		if err != nil {
+			return written
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const testUpgradeRequest = "GET /echo HTTP/1.1\r\nHost: proxy.test\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"
+
+// Апстрим принимает Upgrade через delay и дальше отвечает эхом. В closed приходит сигнал, когда соединение
+// с ним закрылось.
+func newTestUpgradeProxy(t *testing.T, delay time.Duration) (*Proxy, *fasthttp.Client, chan struct{}) {
+	closed := make(chan struct{}, 1)
+	p, client := newTestProxy(t, ProxyConfig{}, func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(delay)
+		ctx.SetStatusCode(fasthttp.StatusSwitchingProtocols)
+		ctx.Response.Header.Set(fasthttp.HeaderConnection, "Upgrade")
+		ctx.Response.Header.Set(fasthttp.HeaderUpgrade, "echo")
+		ctx.Hijack(func(conn net.Conn) {
+			io.Copy(conn, conn)
+			closed <- struct{}{}
+		})
+	})
+	return p, client, closed
+}
+
+func TestTunnel(t *testing.T) {
+	p, client, closed := newTestUpgradeProxy(t, 0)
+	conn, err := client.Dial("proxy.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write([]byte(testUpgradeRequest)); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected response %s", res.Status)
+	}
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, 4)
+	if _, err = io.ReadFull(r, echo); err != nil || string(echo) != "ping" {
+		t.Fatalf("tunnel echoed %q, %v", echo, err)
+	}
+	if p.tunnels.active.Load() != 1 || p.tunnels.total.Load() != 1 {
+		t.Errorf("%d active and %d total tunnels, expected 1 and 1", p.tunnels.active.Load(), p.tunnels.total.Load())
+	}
+
+	conn.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream connection was not closed")
+	}
+	waitFor(t, "tunnel close", func() bool {
+		return p.tunnels.active.Load() == 0
+	})
+}
+
+// Клиент отключился, пока апстрим думал над Upgrade: ответ 101 отправить некуда, обработчик туннеля не
+// вызывается, а соединение с апстримом должно закрыться
+func TestTunnelClientGoneBefore101(t *testing.T) {
+	p, client, closed := newTestUpgradeProxy(t, 100*time.Millisecond)
+	conn, err := client.Dial("proxy.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte(testUpgradeRequest)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream connection leaked")
+	}
+	pending := 0
+	p.tunnels.pending.Range(func(_, _ any) bool {
+		pending++
+		return true
+	})
+	if p.tunnels.active.Load() != 0 || p.tunnels.total.Load() != 0 || pending != 0 {
+		t.Errorf("%d active, %d total and %d pending tunnels after aborted upgrade", p.tunnels.active.Load(),
+			p.tunnels.total.Load(), pending)
+	}
+}
@@ -0,0 +1,155 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// Адреса из -bind для сокетов, переданных предыдущим процессом, через запятую
+	upgradeFdsEnv = "VK_PROXY_UPGRADE_FDS"
+	// Pid предыдущего процесса, которому нужно сообщить о запуске
+	upgradePidEnv = "VK_PROXY_UPGRADE_PID"
+	// Первый переданный сокет, так же как в systemd
+	listenFdsStart = 3
+)
+
+var upgradeSignal os.Signal = syscall.SIGUSR2
+
+func loadInheritedListeners() (*inheritedListeners, error) {
+	result := &inheritedListeners{}
+	if value := os.Getenv(upgradeFdsEnv); value != "" {
+		result.names = strings.Split(value, ",")
+		result.fromUpgrade = true
+		result.parentPid, _ = strconv.Atoi(os.Getenv(upgradePidEnv))
+		os.Unsetenv(upgradeFdsEnv)
+		os.Unsetenv(upgradePidEnv)
+	} else if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid == os.Getpid() {
+		// https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+		count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid LISTEN_FDS: %w", err)
+		}
+		result.names = make([]string, count)
+		if names := os.Getenv("LISTEN_FDNAMES"); names != "" {
+			copy(result.names, strings.Split(names, ":"))
+		}
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	} else {
+		return nil, nil
+	}
+
+	for i, name := range result.names {
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not use inherited socket %d: %w", listenFdsStart+i, err)
+		}
+		result.listeners = append(result.listeners, ln)
+	}
+	return result, nil
+}
+
+// Сообщает systemd (Type=notify), что прокси запущен и какой процесс теперь главный. Без NOTIFY_SOCKET ничего
+// не делает. См. https://www.freedesktop.org/software/systemd/man/sd_notify.html
+func notifyReady() {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// Абстрактный сокет в адресе начинается с @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Could not notify systemd: %s", err)
+		return
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("MAINPID=" + strconv.Itoa(os.Getpid()) + "\nREADY=1")); err != nil {
+		log.Printf("Could not notify systemd: %s", err)
+	}
+}
+
+// Предыдущий процесс мог уже завершиться, тогда родителем стал init или subreaper, и сигнал ушел бы ему. Поэтому
+// сигнал посылается, только если родитель все еще тот процесс, который передал сокеты.
+func notifyUpgradeParent(pid int) {
+	if pid <= 0 || pid != os.Getppid() {
+		log.Printf("Previous process %d has already exited", pid)
+		return
+	}
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		log.Printf("Could not stop previous process: %s", err)
+	}
+}
+
+// Upgrade запускает новый процесс прокси (обычно с обновленным бинарником) и передает ему все слушающие сокеты.
+// Новый процесс после запуска посылает текущему SIGTERM, и тот завершается, дорабатывая активные запросы.
+//
+// Новый процесс -- дочерний для текущего, поэтому под systemd сервис должен быть Type=notify с NotifyAccess=all:
+// новый процесс сообщает свой MAINPID через notifyReady, и systemd не останавливает сервис, когда старый процесс
+// завершается. С Type=simple сервис остановится вместе со старым процессом.
+func (p *Proxy) Upgrade() error {
+	p.listenersLock.Lock()
+	defer p.listenersLock.Unlock()
+
+	listeners := append(append([]*proxyListener(nil), p.listeners...), p.serviceListeners...)
+	names := make([]string, 0, len(listeners))
+	files := make([]*os.File, 0, len(listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		filer, ok := l.ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("listener on %s can not be passed to another process", l.config)
+		}
+		f, err := filer.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		names = append(names, l.config.address)
+	}
+
+	// os.Executable указывает на старый бинарник, даже если на его место уже положили новый
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), upgradeFdsEnv+"="+strings.Join(names, ","),
+		upgradePidEnv+"="+strconv.Itoa(os.Getpid()))
+	cmd.ExtraFiles = files
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	// Файлы unix сокетов теперь использует новый процесс, удалять их при закрытии нельзя
+	for _, l := range p.listeners {
+		if ul, ok := l.ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	go func() {
+		log.Printf("New process %d exited: %v", cmd.Process.Pid, cmd.Wait())
+	}()
+	return nil
+}
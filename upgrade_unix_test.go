@@ -0,0 +1,159 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const inheritHelperEnv = "VK_PROXY_TEST_INHERIT_HELPER"
+
+// Сокеты передаются только новому процессу, поэтому loadInheritedListeners проверяется в дочернем процессе теста
+func TestInheritHelperProcess(t *testing.T) {
+	if os.Getenv(inheritHelperEnv) == "" {
+		t.Skip("runs only as a child of TestLoadInheritedListeners")
+	}
+	inherited, err := loadInheritedListeners()
+	if err != nil {
+		fmt.Printf("error: %s\n", err)
+	} else if inherited == nil {
+		fmt.Println("none")
+	} else {
+		fmt.Printf("upgrade=%v env=%q,%q\n", inherited.fromUpgrade, os.Getenv(upgradeFdsEnv), os.Getenv("LISTEN_FDS"))
+		for i, ln := range inherited.listeners {
+			fmt.Printf("%s %s\n", inherited.names[i], ln.Addr())
+		}
+	}
+	os.Exit(0)
+}
+
+func runInheritHelper(t *testing.T, files []*os.File, systemd bool, env ...string) string {
+	t.Helper()
+	args := []string{"-test.run=^TestInheritHelperProcess$"}
+	cmd := exec.Command(os.Args[0], args...)
+	if systemd {
+		// LISTEN_PID должен совпадать с pid процесса, который его читает
+		cmd = exec.Command("/bin/sh", append([]string{"-c", `LISTEN_PID=$$ exec "$0" "$@"`, os.Args[0]}, args...)...)
+	}
+	cmd.Env = append(os.Environ(), append(env, inheritHelperEnv+"=1")...)
+	cmd.ExtraFiles = files
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("helper process failed with %s: %s", err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestLoadInheritedListeners(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	socket := filepath.Join(t.TempDir(), "vk-proxy.sock")
+	unixLn, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixLn.Close()
+
+	var files []*os.File
+	for _, l := range []net.Listener{ln, unixLn} {
+		f, err := l.(interface{ File() (*os.File, error) }).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+
+	expected := fmt.Sprintf("upgrade=true env=\"\",\"\"\n:8881 %s\n%s %s", ln.Addr(), socket, socket)
+	if out := runInheritHelper(t, files, false, upgradeFdsEnv+"=:8881,"+socket); out != expected {
+		t.Errorf("sockets from upgrade:\n%s\nexpected:\n%s", out, expected)
+	}
+
+	expected = fmt.Sprintf("upgrade=false env=\"\",\"\"\nweb %s\n %s", ln.Addr(), socket)
+	if out := runInheritHelper(t, files, true, "LISTEN_FDS=2", "LISTEN_FDNAMES=web"); out != expected {
+		t.Errorf("sockets from systemd:\n%s\nexpected:\n%s", out, expected)
+	}
+
+	if out := runInheritHelper(t, files, false, "LISTEN_PID=1", "LISTEN_FDS=2"); out != "none" {
+		t.Errorf("sockets for another pid must be ignored, got:\n%s", out)
+	}
+	if out := runInheritHelper(t, files, true, "LISTEN_FDS=x"); !strings.HasPrefix(out, "error: invalid LISTEN_FDS") {
+		t.Errorf("invalid LISTEN_FDS must fail, got:\n%s", out)
+	}
+}
+
+const notifyHelperEnv = "VK_PROXY_TEST_NOTIFY_HELPER"
+
+func TestNotifyParentHelperProcess(t *testing.T) {
+	if os.Getenv(notifyHelperEnv) == "" {
+		t.Skip("runs only as a child of TestNotifyUpgradeParent")
+	}
+	inherited, err := loadInheritedListeners()
+	if err != nil {
+		fmt.Printf("error: %s\n", err)
+	}
+	inherited.release()
+	os.Exit(0)
+}
+
+// Предыдущий процесс изображает shell: он ждет нового и сообщает, получил ли SIGTERM
+func TestNotifyUpgradeParent(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for pid, expected := range map[string]string{
+		"$$": "terminated",
+		// Родитель уже другой процесс, например init после завершения предыдущего
+		"1": "exited",
+		"":  "exited",
+	} {
+		script := `trap 'echo terminated; exit 0' TERM; ` + upgradePidEnv + `=` + pid + ` "$0" "$@" & wait $!; echo exited`
+		cmd := exec.Command("/bin/sh", "-c", script, os.Args[0], "-test.run=^TestNotifyParentHelperProcess$")
+		cmd.Env = append(os.Environ(), upgradeFdsEnv+"=:8881", notifyHelperEnv+"=1")
+		cmd.ExtraFiles = []*os.File{f}
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("pid %q: previous process failed with %s: %s", pid, err, out)
+		}
+		if got := strings.TrimSpace(string(out)); got != expected {
+			t.Errorf("pid %q: previous process %s, expected %s", pid, got, expected)
+		}
+	}
+}
+
+func TestNotifyReady(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", socket)
+
+	notifyReady()
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid()); string(buf[:n]) != expected {
+		t.Errorf("systemd got %q, expected %q", buf[:n], expected)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var upgradeSignal os.Signal
+
+func loadInheritedListeners() (*inheritedListeners, error) {
+	return nil, nil
+}
+
+func notifyReady() {
+}
+
+func notifyUpgradeParent(pid int) {
+}
+
+func (p *Proxy) Upgrade() error {
+	return errors.New("upgrade is not supported on windows")
+}